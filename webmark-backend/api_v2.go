@@ -0,0 +1,701 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"webmark/repo"
+)
+
+// /api/v2：面向资源的接口，使用 HTTP 状态码与带错误码的错误响应
+// /wmapi 保持不变，供现有前端使用
+const apiV2Prefix = "/api/v2"
+
+// 错误码
+const (
+	codeUnauthenticated    = "unauthenticated"
+	codeForbidden          = "forbidden"
+	codeNotFound           = "not_found"
+	codeAlreadyExists      = "already_exists"
+	codeInvalidArgument    = "invalid_argument"
+	codePreconditionFailed = "precondition_failed"
+	codeMethodNotAllowed   = "method_not_allowed"
+	codeUnavailable        = "unavailable"
+	codeInternal           = "internal"
+)
+
+type apiErrorBody struct {
+	Code    string `json:"code" doc:"错误码"`
+	Message string `json:"message"`
+}
+
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiGroup struct {
+	Name      string `json:"name"`
+	Documents int    `json:"documents" doc:"文档数量"`
+	CreatedAt int64  `json:"created_at" doc:"创建时间(Unix 秒)"`
+}
+
+type apiDocSummary struct {
+	Group string `json:"group"`
+	Title string `json:"title"`
+}
+
+type apiDocument struct {
+	Group     string `json:"group"`
+	Title     string `json:"title"`
+	Content   string `json:"content" doc:"Markdown 原文"`
+	Public    bool   `json:"public"`
+	ViewCount int    `json:"view_count"`
+	UpdatedAt int64  `json:"updated_at" doc:"最后修改时间(Unix 秒)"`
+}
+
+type apiPublicUpdate struct {
+	Public bool `json:"public"`
+}
+
+func apiJSON(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func apiFail(w http.ResponseWriter, status int, code, message string) {
+	apiJSON(w, status, apiError{Error: apiErrorBody{Code: code, Message: message}})
+}
+
+func apiInternal(w http.ResponseWriter, err error) {
+	slog.Error("api error", "err", err)
+	apiFail(w, http.StatusInternalServerError, codeInternal, "internal error")
+}
+
+// 认证：Authorization: Bearer <访问令牌>，或者网页登录的会话 cookie
+func apiAuth(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if username, ok := tokenUser(strings.TrimSpace(token)); ok {
+			return username, true
+		}
+		apiFail(w, http.StatusUnauthorized, codeUnauthenticated, "invalid access token")
+		return "", false
+	}
+	if session := checkSession(w, r); session != nil {
+		return session.Name, true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="webmark"`)
+	apiFail(w, http.StatusUnauthorized, codeUnauthenticated, "authentication required")
+	return "", false
+}
+
+// 路径中的分组名与文档名
+func apiNames(w http.ResponseWriter, r *http.Request, keys ...string) ([]string, bool) {
+	var names = make([]string, 0, len(keys))
+	for _, key := range keys {
+		name := r.PathValue(key)
+		if !validName(name) {
+			apiFail(w, http.StatusBadRequest, codeInvalidArgument, "invalid "+key+" name")
+			return nil, false
+		}
+		names = append(names, name)
+	}
+	return names, true
+}
+
+func groupExists(username, group string) (bool, error) {
+	_, err := GDB.Groups.Get(username, group)
+	if errors.Is(err, repo.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GET /api/v2/groups
+func apiListGroups(w http.ResponseWriter, r *http.Request, username string) {
+	groups, err := GDB.Groups.List(username)
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	var res = make([]apiGroup, 0, len(groups))
+	for _, g := range groups {
+		res = append(res, apiGroup{Name: g.Name, CreatedAt: g.CreateAt, Documents: g.Docs})
+	}
+	apiJSON(w, http.StatusOK, res)
+}
+
+// PUT /api/v2/groups/{group}
+func apiPutGroup(w http.ResponseWriter, r *http.Request, username string) {
+	names, ok := apiNames(w, r, "group")
+	if !ok {
+		return
+	}
+	exists, err := groupExists(username, names[0])
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	group_check(username, names[0])
+	created, err := GDB.Groups.Get(username, names[0])
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	var g = apiGroup{Name: names[0], CreatedAt: created.CreateAt}
+	var status = http.StatusCreated
+	if exists {
+		status = http.StatusOK
+	}
+	apiJSON(w, status, g)
+}
+
+// DELETE /api/v2/groups/{group}
+func apiDeleteGroup(w http.ResponseWriter, r *http.Request, username string) {
+	names, ok := apiNames(w, r, "group")
+	if !ok {
+		return
+	}
+	exists, err := groupExists(username, names[0])
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	if !exists {
+		apiFail(w, http.StatusNotFound, codeNotFound, "group not found")
+		return
+	}
+	if err := deleteGroup(username, names[0]); err != nil {
+		apiInternal(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/v2/groups/{group}/docs?q=
+func apiListDocs(w http.ResponseWriter, r *http.Request, username string) {
+	names, ok := apiNames(w, r, "group")
+	if !ok {
+		return
+	}
+	exists, err := groupExists(username, names[0])
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	if !exists {
+		apiFail(w, http.StatusNotFound, codeNotFound, "group not found")
+		return
+	}
+	titles, err := GDB.Docs.Search(username, names[0], splitWord(r.URL.Query().Get("q")))
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	var res = make([]apiDocSummary, 0, len(titles))
+	for _, title := range titles {
+		res = append(res, apiDocSummary{Group: names[0], Title: title})
+	}
+	apiJSON(w, http.StatusOK, res)
+}
+
+// GET /api/v2/groups/{group}/docs/{title}
+func apiGetDoc(w http.ResponseWriter, r *http.Request, username string) {
+	names, ok := apiNames(w, r, "group", "title")
+	if !ok {
+		return
+	}
+	var fname = path.Join(username, names[0], names[1]+".md")
+	info, err := Store.Stat(fname)
+	if errors.Is(err, fs.ErrNotExist) {
+		apiFail(w, http.StatusNotFound, codeNotFound, "document not found")
+		return
+	}
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	content, err := Store.Open(fname)
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	defer content.Close()
+	if strings.Contains(r.Header.Get("Accept"), "text/markdown") {
+		// 只要原文
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		io.Copy(w, content)
+		return
+	}
+	b, err := io.ReadAll(content)
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	var doc = apiDocument{Group: names[0], Title: names[1], Content: string(b), UpdatedAt: info.ModTime.Unix()}
+	doc.Public, doc.ViewCount, _ = GDB.Docs.PublicStatus(username, names[0], names[1])
+	apiJSON(w, http.StatusOK, doc)
+}
+
+// PUT /api/v2/groups/{group}/docs/{title}，请求体为 Markdown 原文
+// If-None-Match: * 只新建，If-Match: * 只修改
+func apiPutDoc(w http.ResponseWriter, r *http.Request, username string) {
+	names, ok := apiNames(w, r, "group", "title")
+	if !ok {
+		return
+	}
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		apiFail(w, http.StatusBadRequest, codeInvalidArgument, "read body failed")
+		return
+	}
+	_, err = Store.Stat(path.Join(username, names[0], names[1]+".md"))
+	var exists = err == nil
+	if r.Header.Get("If-None-Match") == "*" && exists {
+		apiFail(w, http.StatusPreconditionFailed, codePreconditionFailed, "document already exists")
+		return
+	}
+	if r.Header.Get("If-Match") == "*" && !exists {
+		apiFail(w, http.StatusPreconditionFailed, codePreconditionFailed, "document does not exist")
+		return
+	}
+	err = saveMarkdown(username, names[0], names[1], content, !exists)
+	switch {
+	case errors.Is(err, errDocExists), errors.Is(err, errDocNotFound):
+		// 并发修改
+		apiFail(w, http.StatusConflict, codeAlreadyExists, "document changed concurrently, retry")
+	case err != nil:
+		apiInternal(w, err)
+	case exists:
+		apiJSON(w, http.StatusOK, apiDocSummary{Group: names[0], Title: names[1]})
+	default:
+		apiJSON(w, http.StatusCreated, apiDocSummary{Group: names[0], Title: names[1]})
+	}
+}
+
+// DELETE /api/v2/groups/{group}/docs/{title}
+func apiDeleteDoc(w http.ResponseWriter, r *http.Request, username string) {
+	names, ok := apiNames(w, r, "group", "title")
+	if !ok {
+		return
+	}
+	err := deleteMarkdown(username, names[0], names[1])
+	if errors.Is(err, errDocNotFound) {
+		apiFail(w, http.StatusNotFound, codeNotFound, "document not found")
+		return
+	}
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PUT /api/v2/groups/{group}/docs/{title}/public
+func apiPutPublic(w http.ResponseWriter, r *http.Request, username string) {
+	names, ok := apiNames(w, r, "group", "title")
+	if !ok {
+		return
+	}
+	var input apiPublicUpdate
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		apiFail(w, http.StatusBadRequest, codeInvalidArgument, "invalid json body")
+		return
+	}
+	found, err := GDB.Docs.SetPublic(username, names[0], names[1], input.Public)
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	if !found {
+		apiFail(w, http.StatusNotFound, codeNotFound, "document not found")
+		return
+	}
+	apiJSON(w, http.StatusOK, input)
+}
+
+// GET /api/v2/groups/{group}/docs/{title}/attachments/{name}
+func apiGetAttachment(w http.ResponseWriter, r *http.Request, username string) {
+	names, ok := apiNames(w, r, "group", "title", "name")
+	if !ok {
+		return
+	}
+	f, err := Store.Open(path.Join(username, names[0], names[1], names[2]))
+	if errors.Is(err, fs.ErrNotExist) {
+		apiFail(w, http.StatusNotFound, codeNotFound, "attachment not found")
+		return
+	}
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	defer f.Close()
+	var ctype = mime.TypeByExtension(path.Ext(names[2]))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ctype)
+	io.Copy(w, f)
+}
+
+// PUT /api/v2/groups/{group}/docs/{title}/attachments/{name}，请求体为文件内容
+func apiPutAttachment(w http.ResponseWriter, r *http.Request, username string) {
+	names, ok := apiNames(w, r, "group", "title", "name")
+	if !ok {
+		return
+	}
+	if _, err := Store.Stat(path.Join(username, names[0], names[1]+".md")); err != nil {
+		apiFail(w, http.StatusNotFound, codeNotFound, "document not found")
+		return
+	}
+	var key = path.Join(username, names[0], names[1], names[2])
+	_, err := Store.Stat(key)
+	var exists = err == nil
+	if err := Store.Write(key, r.Body); err != nil {
+		apiInternal(w, err)
+		return
+	}
+	gitCommit(username, "upload "+path.Join(names...))
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// DELETE /api/v2/groups/{group}/docs/{title}/attachments/{name}
+func apiDeleteAttachment(w http.ResponseWriter, r *http.Request, username string) {
+	names, ok := apiNames(w, r, "group", "title", "name")
+	if !ok {
+		return
+	}
+	var key = path.Join(username, names[0], names[1], names[2])
+	if _, err := Store.Stat(key); errors.Is(err, fs.ErrNotExist) {
+		apiFail(w, http.StatusNotFound, codeNotFound, "attachment not found")
+		return
+	}
+	if err := Store.Remove(key); err != nil {
+		apiInternal(w, err)
+		return
+	}
+	gitCommit(username, "delete "+path.Join(names...))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /api/v2/public?q=，不需要登录
+func apiListPublic(w http.ResponseWriter, r *http.Request) {
+	var res []*PublicDoc
+	var err error
+	if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+		res, err = GDB.Docs.PublicSearch(splitWord(q), q)
+	} else {
+		res, err = GDB.Docs.PublicList()
+	}
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	apiJSON(w, http.StatusOK, res)
+}
+
+// GET /api/v2/public/{user}/{group}/{title}，公开文档的 Markdown 原文，不需要登录
+// 不同用户可以有同名的分组与文档，必须指定用户
+func apiGetPublicDoc(w http.ResponseWriter, r *http.Request) {
+	names, ok := apiNames(w, r, "user", "group", "title")
+	if !ok {
+		return
+	}
+	_, err := GDB.Docs.PublicOwner(names[0], names[1], names[2])
+	if errors.Is(err, repo.ErrNotFound) {
+		apiFail(w, http.StatusNotFound, codeNotFound, "document not found")
+		return
+	}
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	content, err := Store.Open(path.Join(names[0], names[1], names[2]+".md"))
+	if errors.Is(err, fs.ErrNotExist) {
+		apiFail(w, http.StatusNotFound, codeNotFound, "document not found")
+		return
+	}
+	if err != nil {
+		apiInternal(w, err)
+		return
+	}
+	defer content.Close()
+	if r.Method == http.MethodGet {
+		// 增加点击量
+		if err := GDB.Docs.AddView(names[0], names[1], names[2]); err != nil {
+			slog.ErrorContext(r.Context(), "update view count failed", "err", err)
+		}
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	io.Copy(w, content)
+}
+
+// 接口描述，同时用于注册路由和生成 OpenAPI 文档
+type apiRoute struct {
+	Method   string
+	Pattern  string // 相对 /api/v2，路径参数使用 {name}
+	Summary  string
+	Query    []string // 查询参数
+	Body     string   // 请求体：json、markdown 或 binary，空表示没有
+	BodyType any      // Body 为 json 时的结构
+	Status   int      // 成功时的状态码
+	Response any      // 成功时的响应结构，nil 表示没有响应体
+	Errors   []int    // 可能的错误状态码
+	Public   bool     // 不需要登录
+	handler  func(w http.ResponseWriter, r *http.Request, username string)
+	public   func(w http.ResponseWriter, r *http.Request)
+	Produces string            // 非 json 响应的类型
+	Headers  map[string]string // 可选请求头及说明
+}
+
+var apiV2Routes = []*apiRoute{
+	{Method: "GET", Pattern: "/groups", Summary: "列出分组", Status: 200, Response: []apiGroup{},
+		Errors: []int{401}, handler: apiListGroups},
+	{Method: "PUT", Pattern: "/groups/{group}", Summary: "新建分组，已存在时返回 200", Status: 201, Response: apiGroup{},
+		Errors: []int{400, 401}, handler: apiPutGroup},
+	{Method: "DELETE", Pattern: "/groups/{group}", Summary: "删除分组及其中的所有文档", Status: 204,
+		Errors: []int{400, 401, 404}, handler: apiDeleteGroup},
+	{Method: "GET", Pattern: "/groups/{group}/docs", Summary: "列出或搜索分组中的文档", Query: []string{"q"}, Status: 200, Response: []apiDocSummary{},
+		Errors: []int{400, 401, 404}, handler: apiListDocs},
+	{Method: "GET", Pattern: "/groups/{group}/docs/{title}", Summary: "读取文档，Accept: text/markdown 时只返回原文", Status: 200, Response: apiDocument{},
+		Errors: []int{400, 401, 404}, handler: apiGetDoc},
+	{Method: "PUT", Pattern: "/groups/{group}/docs/{title}", Summary: "新建或修改文档，新建时返回 201", Body: "markdown", Status: 200, Response: apiDocSummary{},
+		Errors: []int{400, 401, 409, 412}, handler: apiPutDoc,
+		Headers: map[string]string{"If-None-Match": "* 表示只新建", "If-Match": "* 表示只修改"}},
+	{Method: "DELETE", Pattern: "/groups/{group}/docs/{title}", Summary: "删除文档及其附件", Status: 204,
+		Errors: []int{400, 401, 404}, handler: apiDeleteDoc},
+	{Method: "PUT", Pattern: "/groups/{group}/docs/{title}/public", Summary: "设置文档是否公开", Body: "json", BodyType: apiPublicUpdate{}, Status: 200, Response: apiPublicUpdate{},
+		Errors: []int{400, 401, 404}, handler: apiPutPublic},
+	{Method: "GET", Pattern: "/groups/{group}/docs/{title}/attachments/{name}", Summary: "下载附件", Status: 200, Produces: "application/octet-stream",
+		Errors: []int{400, 401, 404}, handler: apiGetAttachment},
+	{Method: "PUT", Pattern: "/groups/{group}/docs/{title}/attachments/{name}", Summary: "上传附件，新建时返回 201，覆盖时返回 204", Body: "binary", Status: 201,
+		Errors: []int{400, 401}, handler: apiPutAttachment},
+	{Method: "DELETE", Pattern: "/groups/{group}/docs/{title}/attachments/{name}", Summary: "删除附件", Status: 204,
+		Errors: []int{400, 401, 404}, handler: apiDeleteAttachment},
+	{Method: "GET", Pattern: "/public", Summary: "列出或搜索公开文档", Query: []string{"q"}, Status: 200, Response: []PublicDoc{},
+		Public: true, public: apiListPublic},
+	{Method: "GET", Pattern: "/public/{user}/{group}/{title}", Summary: "公开文档的 Markdown 原文，会增加点击量", Status: 200, Produces: "text/markdown",
+		Errors: []int{400, 404}, Public: true, public: apiGetPublicDoc},
+}
+
+// 注册 /api/v2 路由，同一路径的不同方法在这里分发，不支持的方法返回 405
+func registerApiV2(mux *http.ServeMux) {
+	var byPattern = make(map[string][]*apiRoute)
+	var patterns = make([]string, 0)
+	for _, route := range apiV2Routes {
+		if _, ok := byPattern[route.Pattern]; !ok {
+			patterns = append(patterns, route.Pattern)
+		}
+		byPattern[route.Pattern] = append(byPattern[route.Pattern], route)
+	}
+	for _, pattern := range patterns {
+		var routes = byPattern[pattern]
+		mux.HandleFunc(apiV2Prefix+pattern, func(w http.ResponseWriter, r *http.Request) {
+			for _, route := range routes {
+				if route.Method == r.Method || (route.Method == "GET" && r.Method == "HEAD") {
+					route.serve(w, r)
+					return
+				}
+			}
+			var allow = make([]string, 0, len(routes))
+			for _, route := range routes {
+				allow = append(allow, route.Method)
+			}
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			apiFail(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		})
+	}
+	mux.HandleFunc("GET "+apiV2Prefix+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		apiJSON(w, http.StatusOK, openAPISpec())
+	})
+	mux.HandleFunc(apiV2Prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		apiFail(w, http.StatusNotFound, codeNotFound, "no such endpoint")
+	})
+}
+
+func (route *apiRoute) serve(w http.ResponseWriter, r *http.Request) {
+	if route.Public {
+		route.public(w, r)
+		return
+	}
+	username, ok := apiAuth(w, r)
+	if !ok {
+		return
+	}
+	if safeMethod(r.Method) {
+		route.handler(w, r, username)
+		return
+	}
+	if bgCtx.Err() != nil {
+		apiFail(w, http.StatusServiceUnavailable, codeUnavailable, "server is shutting down")
+		return
+	}
+	// 与备份互斥，保证备份时数据库与文件一致
+	snapshotLock.RLock()
+	defer snapshotLock.RUnlock()
+	route.handler(w, r, username)
+}
+
+// 根据路由表生成 OpenAPI 3 文档
+func openAPISpec() map[string]any {
+	var schemas = map[string]any{}
+	var paths = map[string]map[string]any{}
+	var ref = func(v any) map[string]any {
+		return jsonSchema(reflect.TypeOf(v), schemas)
+	}
+	ref(apiError{})
+	for _, route := range apiV2Routes {
+		var op = map[string]any{
+			"summary":     route.Summary,
+			"operationId": strings.ToLower(route.Method) + operationName(route.Pattern),
+		}
+		var params = make([]any, 0)
+		for _, seg := range strings.Split(route.Pattern, "/") {
+			if strings.HasPrefix(seg, "{") {
+				params = append(params, map[string]any{
+					"name": strings.Trim(seg, "{}"), "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+				})
+			}
+		}
+		for _, q := range route.Query {
+			params = append(params, map[string]any{"name": q, "in": "query", "schema": map[string]any{"type": "string"}})
+		}
+		var headers = make([]string, 0, len(route.Headers))
+		for h := range route.Headers {
+			headers = append(headers, h)
+		}
+		sort.Strings(headers)
+		for _, h := range headers {
+			params = append(params, map[string]any{
+				"name": h, "in": "header", "description": route.Headers[h], "schema": map[string]any{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		switch route.Body {
+		case "markdown":
+			op["requestBody"] = map[string]any{"required": true, "content": map[string]any{
+				"text/markdown": map[string]any{"schema": map[string]any{"type": "string"}}}}
+		case "binary":
+			op["requestBody"] = map[string]any{"required": true, "content": map[string]any{
+				"application/octet-stream": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}}
+		case "json":
+			op["requestBody"] = map[string]any{"required": true, "content": map[string]any{
+				"application/json": map[string]any{"schema": ref(route.BodyType)}}}
+		}
+		var responses = map[string]any{}
+		var ok = map[string]any{"description": http.StatusText(route.Status)}
+		if route.Response != nil {
+			ok["content"] = map[string]any{"application/json": map[string]any{"schema": ref(route.Response)}}
+		} else if route.Produces != "" {
+			ok["content"] = map[string]any{route.Produces: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}
+		}
+		responses[strconv.Itoa(route.Status)] = ok
+		for _, status := range route.Errors {
+			responses[strconv.Itoa(status)] = map[string]any{
+				"description": http.StatusText(status),
+				"content":     map[string]any{"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/apiError"}}},
+			}
+		}
+		op["responses"] = responses
+		if route.Public {
+			op["security"] = []any{}
+		}
+		if paths[apiV2Prefix+route.Pattern] == nil {
+			paths[apiV2Prefix+route.Pattern] = map[string]any{}
+		}
+		paths[apiV2Prefix+route.Pattern][strings.ToLower(route.Method)] = op
+	}
+	var spec = map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "webmark",
+			"version":     "2",
+			"description": "错误响应统一为 {\"error\":{\"code\":\"...\",\"message\":\"...\"}}，错误码: " + strings.Join([]string{codeUnauthenticated, codeForbidden, codeNotFound, codeAlreadyExists, codeInvalidArgument, codePreconditionFailed, codeMethodNotAllowed, codeUnavailable, codeInternal}, ", "),
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "description": "访问令牌，见 /wmapi/token-create"},
+				"cookieAuth": map[string]any{"type": "apiKey", "in": "cookie", "name": "session_id"},
+			},
+		},
+		"security": []any{map[string]any{"bearerAuth": []any{}}, map[string]any{"cookieAuth": []any{}}},
+	}
+	if BasePath != "" {
+		spec["servers"] = []any{map[string]any{"url": BasePath}}
+	}
+	return spec
+}
+
+// /groups/{group}/docs -> GroupsGroupDocs
+func operationName(pattern string) string {
+	var b strings.Builder
+	for _, seg := range strings.Split(pattern, "/") {
+		seg = strings.Trim(seg, "{}")
+		if seg != "" {
+			b.WriteString(strings.ToUpper(seg[:1]) + seg[1:])
+		}
+	}
+	return b.String()
+}
+
+// 根据结构体的 json 标签生成 JSON Schema，结构体放入 schemas 并返回引用
+func jsonSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchema(t.Elem(), schemas)
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		var name = t.Name()
+		if _, ok := schemas[name]; !ok {
+			schemas[name] = map[string]any{} // 防止递归
+			var props = map[string]any{}
+			var required = make([]string, 0)
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				key, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+				if key == "" || key == "-" || !f.IsExported() {
+					continue
+				}
+				prop := jsonSchema(f.Type, schemas)
+				if desc := f.Tag.Get("doc"); desc != "" {
+					if _, isRef := prop["$ref"]; isRef {
+						// $ref 不能与其它字段并列
+						prop = map[string]any{"allOf": []any{prop}}
+					}
+					prop["description"] = desc
+				}
+				props[key] = prop
+				required = append(required, key)
+			}
+			schemas[name] = map[string]any{"type": "object", "properties": props, "required": required}
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
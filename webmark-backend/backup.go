@@ -0,0 +1,453 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+	"webmark/repo"
+	"webmark/storage"
+)
+
+// 备份格式版本
+const BackupFormat = 1
+
+// 备份包中的固定文件
+const (
+	backupManifestName = "manifest.json"
+	backupDBName       = "webmark.db"
+	backupDataDir      = "data/"
+)
+
+// 备份期间阻止修改文档，保证数据库与文件一致
+// 修改文档的接口持有读锁，备份持有写锁
+var snapshotLock dataLock
+
+// 修改文档的接口在备份期间等待
+func snapshot_guard(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snapshotLock.RLock()
+		defer snapshotLock.RUnlock()
+		h(w, r)
+	}
+}
+
+// 备份清单
+type BackupManifest struct {
+	Format        int          `json:"format"`         // 备份格式版本
+	CreatedAt     int64        `json:"created_at"`     // 备份时间
+	SchemaVersion int          `json:"schema_version"` // 数据库结构版本
+	Database      BackupFile   `json:"database"`
+	Files         []BackupFile `json:"files"` // 文档与附件，路径相对数据目录
+	Dirs          []string     `json:"dirs"`  // 目录，包括空分组
+}
+
+type BackupFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// 写入一个文件并计算校验值
+func backupAdd(archive *zip.Writer, name string, modified time.Time, r io.Reader) (BackupFile, error) {
+	writer, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return BackupFile{}, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(writer, h), r)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	return BackupFile{Path: name, Size: n, Sha256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// 生成备份：数据库使用 VACUUM INTO 做在线一致性快照，随后打包数据目录
+func writeBackup(w io.Writer) (*BackupManifest, error) {
+	if GDB.Dialect != repo.SQLite {
+		return nil, errors.New("backup only supports sqlite, use pg_dump for postgres")
+	}
+	schema, err := GDB.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp("", "webmark-backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+
+	var now = time.Now()
+	var dbfile = filepath.Join(tmp, backupDBName)
+	if _, err := GDB.Exec(`VACUUM INTO ?`, dbfile); err != nil {
+		return nil, fmt.Errorf("snapshot database: %w", err)
+	}
+	var manifest = &BackupManifest{
+		Format:        BackupFormat,
+		CreatedAt:     now.Unix(),
+		SchemaVersion: schema,
+		Files:         make([]BackupFile, 0),
+		Dirs:          make([]string, 0),
+	}
+	archive := zip.NewWriter(w)
+	f, err := os.Open(dbfile)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Database, err = backupAdd(archive, backupDBName, now, f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = storage.Walk(Store, "", func(key string, info storage.FileInfo) error {
+		if key == lockFileName {
+			return nil
+		}
+		if info.IsDir {
+			manifest.Dirs = append(manifest.Dirs, key)
+			_, err := archive.CreateHeader(&zip.FileHeader{Name: backupDataDir + key + "/", Modified: now})
+			return err
+		}
+		rc, err := Store.Open(key)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		bf, err := backupAdd(archive, backupDataDir+key, info.ModTime, rc)
+		if err != nil {
+			return err
+		}
+		bf.Path = key
+		manifest.Files = append(manifest.Files, bf)
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("snapshot data: %w", err)
+	}
+	mw, err := archive.CreateHeader(&zip.FileHeader{Name: backupManifestName, Method: zip.Deflate, Modified: now})
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, archive.Close()
+}
+
+// 备份包中的 key 不能跳出数据目录
+func backupKeyValid(key string) bool {
+	return key != "" && storage.Clean(key) == key
+}
+
+// 校验备份包：清单完整、校验值一致、数据库可以打开且结构版本不高于程序
+func verifyBackup(name string) (*BackupManifest, error) {
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var entries = make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+	mf, ok := entries[backupManifestName]
+	if !ok {
+		return nil, errors.New("backup: missing manifest")
+	}
+	rc, err := mf.Open()
+	if err != nil {
+		return nil, err
+	}
+	var manifest BackupManifest
+	err = json.NewDecoder(rc).Decode(&manifest)
+	rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("backup: invalid manifest: %w", err)
+	}
+	if manifest.Format != BackupFormat {
+		return nil, fmt.Errorf("backup: unsupported format %d", manifest.Format)
+	}
+	if manifest.SchemaVersion > repo.LatestVersion() {
+		return nil, fmt.Errorf("backup: %w: backup version %d, binary supports %d", repo.ErrSchemaTooNew, manifest.SchemaVersion, repo.LatestVersion())
+	}
+	var check = func(entry string, bf BackupFile) error {
+		f, ok := entries[entry]
+		if !ok {
+			return fmt.Errorf("backup: missing %s", entry)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		h := sha256.New()
+		n, err := io.Copy(h, rc)
+		if err != nil {
+			return fmt.Errorf("backup: read %s: %w", entry, err)
+		}
+		if n != bf.Size || hex.EncodeToString(h.Sum(nil)) != bf.Sha256 {
+			return fmt.Errorf("backup: checksum mismatch %s", entry)
+		}
+		return nil
+	}
+	if err := check(backupDBName, manifest.Database); err != nil {
+		return nil, err
+	}
+	for _, bf := range manifest.Files {
+		if !backupKeyValid(bf.Path) {
+			return nil, fmt.Errorf("backup: invalid path %q", bf.Path)
+		}
+		if err := check(backupDataDir+bf.Path, bf); err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range manifest.Dirs {
+		if !backupKeyValid(dir) {
+			return nil, fmt.Errorf("backup: invalid path %q", dir)
+		}
+	}
+	// 数据库完整性检查
+	tmp, err := os.MkdirTemp("", "webmark-verify-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	var dbfile = filepath.Join(tmp, backupDBName)
+	if err := extractFile(entries[backupDBName], dbfile); err != nil {
+		return nil, err
+	}
+	db, err := repo.Open(repo.SQLite, dbfile)
+	if err != nil {
+		return nil, fmt.Errorf("backup: open database: %w", err)
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRow(`PRAGMA integrity_check`).Scan(&result); err != nil || result != "ok" {
+		return nil, fmt.Errorf("backup: database integrity check failed: %v %s", err, result)
+	}
+	return &manifest, nil
+}
+
+func extractFile(f *zip.File, name string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, rc); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// 恢复备份，只能恢复到空的数据目录和不存在的数据库文件
+func restoreBackup(name string) (*BackupManifest, error) {
+	if Conf.Database.Driver != string(repo.SQLite) {
+		return nil, errors.New("restore only supports sqlite")
+	}
+	manifest, err := verifyBackup(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if _, err := os.Stat(Conf.Database.Path + suffix); err == nil {
+			return nil, fmt.Errorf("restore: database %s already exists", Conf.Database.Path+suffix)
+		}
+	}
+	items, err := Store.List("")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, item := range items {
+		if item.Name == lockFileName {
+			continue
+		}
+		return nil, errors.New("restore: data directory is not empty")
+	}
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var entries = make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+	for _, dir := range manifest.Dirs {
+		if err := Store.MkdirAll(dir); err != nil {
+			return nil, err
+		}
+	}
+	for _, bf := range manifest.Files {
+		rc, err := entries[backupDataDir+bf.Path].Open()
+		if err != nil {
+			return nil, err
+		}
+		err = Store.Write(bf.Path, rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("restore %s: %w", bf.Path, err)
+		}
+	}
+	// 数据库最后写入，先写临时文件再改名
+	if dir := filepath.Dir(Conf.Database.Path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	var tmp = Conf.Database.Path + ".restore"
+	if err := extractFile(entries[backupDBName], tmp); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, Conf.Database.Path); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// 写入备份文件并校验，成功后才改为目标文件名
+func backupToFile(name string) (*BackupManifest, error) {
+	var tmp = name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	_, err = writeBackup(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := verifyBackup(tmp)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, os.Rename(tmp, name)
+}
+
+// webmark backup [-o file]
+func cmd_backup(args []string) error {
+	var configPath, out string
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	configFlags(fs, &configPath)
+	fs.StringVar(&out, "o", "webmark-backup-"+time.Now().Format("20060102-150405")+".zip", "备份文件")
+	fs.Parse(args)
+	if err := loadConfig(fs, configPath, args); err != nil {
+		return err
+	}
+	unlock, err := lockExclusive()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := openDB(); err != nil {
+		return err
+	}
+	defer closeDB()
+	manifest, err := backupToFile(out)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("backup %s: schema %d, %d files, %d dirs\n", out, manifest.SchemaVersion, len(manifest.Files), len(manifest.Dirs))
+	return nil
+}
+
+// webmark restore -i file [-verify]
+func cmd_restore(args []string) error {
+	var configPath, in string
+	var verifyOnly bool
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	configFlags(fs, &configPath)
+	fs.StringVar(&in, "i", "", "备份文件")
+	fs.BoolVar(&verifyOnly, "verify", false, "只校验备份文件，不恢复")
+	fs.Parse(args)
+	if in == "" {
+		return errors.New("restore: -i is required")
+	}
+	if err := loadConfig(fs, configPath, args); err != nil {
+		return err
+	}
+	var manifest *BackupManifest
+	var err error
+	if verifyOnly {
+		manifest, err = verifyBackup(in)
+	} else {
+		var unlock func()
+		if unlock, err = lockExclusive(); err != nil {
+			return err
+		}
+		defer unlock()
+		manifest, err = restoreBackup(in)
+	}
+	if err != nil {
+		return err
+	}
+	var action = "restored"
+	if verifyOnly {
+		action = "verified"
+	}
+	fmt.Printf("%s %s: schema %d, %d files, created %s\n", action, in, manifest.SchemaVersion, len(manifest.Files),
+		time.Unix(manifest.CreatedAt, 0).Format(time.RFC3339))
+	return nil
+}
+
+// 下载备份，仅管理员
+// /backup
+func backup(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	if !isAdmin(session.Name) {
+		ErrorResponseWithStatus(w, r, http.StatusForbidden, "仅管理员可以下载备份")
+		return
+	}
+	// 先写临时文件，校验通过后再发送
+	tmp, err := os.MkdirTemp("", "webmark-backup-")
+	if err != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	defer os.RemoveAll(tmp)
+	var fname = "webmark-backup-" + time.Now().Format("20060102-150405") + ".zip"
+	var full = path.Join(filepath.ToSlash(tmp), fname)
+	if _, err := backupToFile(full); err != nil {
+		slog.ErrorContext(r.Context(), "backup failed", "err", err)
+		ErrorResponseWithMsg(w, r, "备份失败")
+		return
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	defer f.Close()
+	slog.InfoContext(r.Context(), "backup downloaded", "user", session.Name)
+	w.Header().Set("Content-Disposition", "attachment; filename="+fname)
+	w.Header().Set("Content-Type", "application/zip")
+	http.ServeContent(w, r, fname, time.Now(), f)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"webmark/repo"
+	"webmark/storage"
+)
+
+// 恢复目标切换到新的临时目录，数据库文件尚不存在
+func useRestoreTarget(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	Conf.Server.DataDir = filepath.Join(dir, "markdown")
+	Conf.Database.Path = filepath.Join(dir, "webmark.db")
+	if err := applyConfig(Conf); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// 数据目录中所有文件与目录，目录的值为 "/"
+func storeContents(t *testing.T) map[string]string {
+	t.Helper()
+	var files = make(map[string]string)
+	err := storage.Walk(Store, "", func(key string, info storage.FileInfo) error {
+		if key == lockFileName {
+			return nil
+		}
+		if info.IsDir {
+			files[key] = "/"
+			return nil
+		}
+		data, err := storage.ReadFile(Store, key)
+		files[key] = string(data)
+		return err
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// 用于比较的数据库内容
+func dbRows(t *testing.T) map[string][]string {
+	t.Helper()
+	var rows = make(map[string][]string)
+	for name, query := range map[string]string{
+		"user_info":  `select username || ':' || password from user_info order by username`,
+		"docs_group": `select username || '/' || groupname from docs_group order by username, groupname`,
+		"docs_info":  `select username || '/' || groupname || '/' || title from docs_info order by username, groupname, title`,
+		"docs":       `select title || ':' || content from docs order by title`,
+	} {
+		r, err := GDB.Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r.Next() {
+			var s string
+			if err := r.Scan(&s); err != nil {
+				t.Fatal(err)
+			}
+			rows[name] = append(rows[name], s)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rows
+}
+
+// 生成包含文档、附件与空分组的备份
+func newTestBackup(t *testing.T) (name string, files map[string]string, rows map[string][]string) {
+	t.Helper()
+	srv := newTestServer(t)
+	ctx := context.Background()
+	cl, _ := loginRoot(t, srv)
+	if err := cl.CreateDocument(ctx, "notes", "hello", "# hello\n![图](hello/a.png)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.CreateDocument(ctx, "notes", "world", "world"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Upload(ctx, "notes", "hello", "a.png", strings.NewReader("\x89PNG\r\n\x1a\nfake")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cl.CreateGroup(ctx, "empty"); err != nil {
+		t.Fatal(err)
+	}
+	name = filepath.Join(t.TempDir(), "backup.zip")
+	if _, err := backupToFile(name); err != nil {
+		t.Fatal(err)
+	}
+	return name, storeContents(t), dbRows(t)
+}
+
+func TestBackupRestore(t *testing.T) {
+	name, files, rows := newTestBackup(t)
+	if _, ok := files["root/empty"]; !ok {
+		t.Fatalf("empty group not in data dir: %v", files)
+	}
+	manifest, err := verifyBackup(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.SchemaVersion != repo.LatestVersion() {
+		t.Errorf("schema = %d", manifest.SchemaVersion)
+	}
+
+	closeDB()
+	useRestoreTarget(t)
+	if _, err := restoreBackup(name); err != nil {
+		t.Fatal(err)
+	}
+	if got := storeContents(t); !reflect.DeepEqual(got, files) {
+		t.Errorf("restored files = %v, want %v", got, files)
+	}
+	if err := openDB(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dbRows(t); !reflect.DeepEqual(got, rows) {
+		t.Errorf("restored rows = %v, want %v", got, rows)
+	}
+	if v, err := GDB.SchemaVersion(); err != nil || v != manifest.SchemaVersion {
+		t.Errorf("restored schema = %d, %v", v, err)
+	}
+}
+
+// 复制备份包，modify 修改清单与文件内容
+func rewriteBackup(t *testing.T, src string, modify func(m *BackupManifest, entries map[string][]byte)) string {
+	t.Helper()
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var entries = make(map[string][]byte)
+	var order []string
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[f.Name] = data
+		order = append(order, f.Name)
+	}
+	var manifest BackupManifest
+	if err := json.Unmarshal(entries[backupManifestName], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	modify(&manifest, entries)
+	if entries[backupManifestName], err = json.Marshal(manifest); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	var seen = make(map[string]bool)
+	var add = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(entries[name])
+	}
+	// 先按原顺序写入，再写入 modify 新增的文件
+	for _, name := range order {
+		add(name)
+	}
+	for name := range entries {
+		add(name)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "modified.zip")
+	if err := os.WriteFile(dst, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return dst
+}
+
+func TestBackupRestoreInvalid(t *testing.T) {
+	name, _, _ := newTestBackup(t)
+	closeDB()
+	GDB = nil
+
+	cases := []struct {
+		name   string
+		modify func(m *BackupManifest, entries map[string][]byte)
+		// 恢复前准备目标目录
+		prepare func(t *testing.T, dir string)
+		err     string
+		is      error
+	}{
+		{
+			name: "tampered file",
+			modify: func(m *BackupManifest, entries map[string][]byte) {
+				entries[backupDataDir+"root/notes/hello.md"] = []byte("tampered")
+			},
+			err: "checksum mismatch data/root/notes/hello.md",
+		},
+		{
+			name: "tampered checksum",
+			modify: func(m *BackupManifest, entries map[string][]byte) {
+				m.Database.Sha256 = strings.Repeat("0", 64)
+			},
+			err: "checksum mismatch webmark.db",
+		},
+		{
+			name: "parent path in files",
+			modify: func(m *BackupManifest, entries map[string][]byte) {
+				m.Files = append(m.Files, BackupFile{Path: "../evil.md", Size: 4, Sha256: "88d4266fd4e6338d13b845fcf289579d209c897823b9217da3e161936f031589"})
+				entries[backupDataDir+"../evil.md"] = []byte("abcd")
+			},
+			err: `invalid path "../evil.md"`,
+		},
+		{
+			name: "parent path in dirs",
+			modify: func(m *BackupManifest, entries map[string][]byte) {
+				m.Dirs = append(m.Dirs, "root/../../evil")
+			},
+			err: `invalid path "root/../../evil"`,
+		},
+		{
+			name: "schema too new",
+			modify: func(m *BackupManifest, entries map[string][]byte) {
+				m.SchemaVersion = repo.LatestVersion() + 1
+			},
+			is: repo.ErrSchemaTooNew,
+		},
+		{
+			name: "data directory not empty",
+			prepare: func(t *testing.T, dir string) {
+				if err := Store.Write("root/notes/other.md", strings.NewReader("other")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			err: "data directory is not empty",
+		},
+		{
+			name: "database exists",
+			prepare: func(t *testing.T, dir string) {
+				if err := os.WriteFile(Conf.Database.Path, nil, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			err: "already exists",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var src = name
+			if tc.modify != nil {
+				src = rewriteBackup(t, name, tc.modify)
+			}
+			dir := useRestoreTarget(t)
+			if tc.prepare != nil {
+				tc.prepare(t, dir)
+			}
+			before := storeContents(t)
+			_, err := restoreBackup(src)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if tc.is != nil && !errors.Is(err, tc.is) {
+				t.Errorf("error = %v, want %v", err, tc.is)
+			}
+			if tc.err != "" && !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error = %v, want %q", err, tc.err)
+			}
+			// 失败时不写入任何内容
+			if got := storeContents(t); !reflect.DeepEqual(got, before) {
+				t.Errorf("data dir changed: %v", got)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "evil.md")); err == nil {
+				t.Error("file written outside data dir")
+			}
+			if tc.prepare == nil {
+				if _, err := os.Stat(Conf.Database.Path); err == nil {
+					t.Error("database written")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"webmark/config"
+	"webmark/repo"
+)
+
+// 子命令，参数不含子命令名
+var commands = map[string]func(args []string) error{
+	"backup":  cmd_backup,
+	"restore": cmd_restore,
+	"reindex": cmd_reindex,
+	"fsck":    cmd_fsck,
+	"user":    cmd_user,
+	"export":  cmd_export,
+	"import":  cmd_import,
+	"publish": cmd_publish,
+}
+
+// 注册配置文件路径及各配置项对应的命令行参数，命令行参数优先级最高
+func configFlags(fs *flag.FlagSet, configPath *string) {
+	fs.StringVar(configPath, "config", os.Getenv(config.EnvPrefix+"CONFIG"), "配置文件路径(TOML)")
+	fs.StringVar(&Conf.Server.DataDir, "data", Conf.Server.DataDir, "文档存储目录")
+	fs.StringVar(&Conf.Server.Bind, "bind", Conf.Server.Bind, "绑定host与端口信息")
+	fs.StringVar(&Conf.Server.SessionsDir, "sessions", Conf.Server.SessionsDir, "会话持久化目录")
+	fs.StringVar(&Conf.Database.Path, "db", Conf.Database.Path, "数据库文件")
+	fs.StringVar(&Conf.Server.BasePath, "base-path", Conf.Server.BasePath, "挂载路径，如 /notes")
+	fs.BoolVar(&Conf.TLS.Enabled, "tls", Conf.TLS.Enabled, "启用HTTPS")
+	fs.StringVar(&Conf.TLS.CertFile, "tls-cert", Conf.TLS.CertFile, "HTTPS证书文件")
+	fs.StringVar(&Conf.TLS.KeyFile, "tls-key", Conf.TLS.KeyFile, "HTTPS私钥文件")
+	fs.StringVar(&Conf.WebAuthn.RPID, "webauthn-rpid", "", "通行密钥依赖方ID，默认取访问域名")
+	fs.StringVar(&Conf.WebAuthn.Origin, "webauthn-origin", "", "通行密钥来源，如 https://notes.example.com，默认根据请求推断")
+	fs.StringVar(&Conf.LDAP.URL, "ldap-url", "", "LDAP地址，如 ldap://127.0.0.1:389，为空不启用")
+	fs.BoolVar(&Conf.LDAP.StartTLS, "ldap-starttls", false, "LDAP连接使用StartTLS")
+	fs.StringVar(&Conf.LDAP.BindDN, "ldap-bind-dn", "", "LDAP查询用户的服务账号DN")
+	fs.StringVar(&Conf.LDAP.BindPassword, "ldap-bind-password", "", "LDAP服务账号密码")
+	fs.StringVar(&Conf.LDAP.BaseDN, "ldap-base-dn", "", "LDAP用户查询根节点")
+	fs.StringVar(&Conf.LDAP.UserFilter, "ldap-user-filter", Conf.LDAP.UserFilter, "LDAP用户过滤条件")
+	fs.StringVar(&Conf.LDAP.GroupAttr, "ldap-group-attr", Conf.LDAP.GroupAttr, "LDAP用户所属分组属性")
+	fs.StringVar(&Conf.OIDC.Issuer, "oidc-issuer", "", "OIDC发行方地址，为空不启用")
+	fs.StringVar(&Conf.OIDC.ClientID, "oidc-client-id", "", "OIDC客户端ID")
+	fs.StringVar(&Conf.OIDC.ClientSecret, "oidc-client-secret", "", "OIDC客户端密钥")
+	fs.StringVar(&Conf.OIDC.RedirectURL, "oidc-redirect-url", "", "OIDC回调地址，如 https://notes.example.com/wmapi/oidc-callback")
+	fs.Func("oidc-scopes", "OIDC申请的scope，默认 openid profile email groups", func(s string) error {
+		Conf.OIDC.Scopes = strings.Fields(s)
+		return nil
+	})
+	fs.StringVar(&Conf.OIDC.UsernameClaim, "oidc-username-claim", Conf.OIDC.UsernameClaim, "OIDC用户名字段")
+	fs.StringVar(&Conf.OIDC.GroupsClaim, "oidc-groups-claim", Conf.OIDC.GroupsClaim, "OIDC分组字段")
+	fs.StringVar(&Conf.Auth.RoleMap, "role-map", "", "外部分组到角色的映射，如 admins=admin,staff=user")
+}
+
+// 加载配置：默认值 < 配置文件 < 环境变量 < 命令行
+// 调用前命令行已解析过一次，这里加载文件和环境变量后再解析一次使命令行优先
+func loadConfig(fs *flag.FlagSet, configPath string, args []string) error {
+	if configPath != "" {
+		if err := Conf.LoadFile(configPath); err != nil {
+			return err
+		}
+	}
+	if err := Conf.LoadEnv(os.LookupEnv); err != nil {
+		return err
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := applyConfig(Conf); err != nil {
+		return fmt.Errorf("配置错误: %w", err)
+	}
+	return nil
+}
+
+// 解析参数，允许参数名出现在位置参数之后，如 user add alice -role admin
+// 返回只包含参数名与值的部分(供 loadConfig 再次解析)和按顺序的位置参数
+func parseArgs(fs *flag.FlagSet, args []string) (flags, positional []string, err error) {
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, nil, err
+		}
+		var parsed = args[:len(args)-fs.NArg()]
+		flags = append(flags, parsed...)
+		if fs.NArg() == 0 {
+			return flags, positional, nil
+		}
+		// -- 之后全部是位置参数
+		if len(parsed) > 0 && parsed[len(parsed)-1] == "--" {
+			return flags, append(positional, fs.Args()...), nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// 按配置打开数据库
+func openDB() error {
+	db, err := repo.Open(repo.Dialect(Conf.Database.Driver), Conf.Database.DSN())
+	if err != nil {
+		return err
+	}
+	GDB = db
+	return nil
+}
+
+// 修改数据的子命令：持有排它锁，打开数据库并执行迁移
+// 服务同时运行时，服务端的修改会等待命令完成；返回的函数关闭数据库并释放锁
+func beginCommand() (func(), error) {
+	unlock, err := lockExclusive()
+	if err != nil {
+		return nil, err
+	}
+	if err := openDB(); err != nil {
+		unlock()
+		return nil, err
+	}
+	if err := createTable(); err != nil {
+		closeDB()
+		unlock()
+		return nil, err
+	}
+	return func() {
+		closeDB()
+		unlock()
+	}, nil
+}
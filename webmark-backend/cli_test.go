@@ -0,0 +1,200 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"webmark/config"
+)
+
+// 默认值 < 配置文件 < 环境变量 < 命令行，按 main 中的顺序先解析一次命令行再加载
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "webmark.toml")
+	content := "[server]\nbind = \"127.0.0.1:1001\"\nbase_path = \"/file\"\n[log]\nlevel = \"error\"\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		file     bool
+		env      map[string]string
+		args     []string
+		bind     string
+		basePath string
+	}{
+		{"defaults", false, nil, nil, "127.0.0.1:11990", ""},
+		{"file", true, nil, nil, "127.0.0.1:1001", "/file"},
+		{"env over file", true, map[string]string{"WEBMARK_SERVER_BIND": "127.0.0.1:1002"}, nil, "127.0.0.1:1002", "/file"},
+		{"flag over env", true, map[string]string{"WEBMARK_SERVER_BIND": "127.0.0.1:1002"}, []string{"-bind", "127.0.0.1:1003"}, "127.0.0.1:1003", "/file"},
+		{"flag over file", true, nil, []string{"-base-path", "/flag"}, "127.0.0.1:1001", "/flag"},
+		{"flag over defaults", false, nil, []string{"-bind", "127.0.0.1:1003"}, "127.0.0.1:1003", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			old := Conf
+			Conf = config.Default()
+			Conf.Server.DataDir = filepath.Join(dir, "markdown")
+			Conf.Log.Level = "error"
+			t.Cleanup(func() {
+				Conf = old
+				applyConfig(Conf)
+			})
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			var configPath string
+			fs := flag.NewFlagSet("webmark", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			configFlags(fs, &configPath)
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			if tc.file {
+				configPath = file
+			}
+			if err := loadConfig(fs, configPath, tc.args); err != nil {
+				t.Fatal(err)
+			}
+			if Conf.Server.Bind != tc.bind || Conf.Server.BasePath != tc.basePath {
+				t.Errorf("bind = %s, base_path = %s", Conf.Server.Bind, Conf.Server.BasePath)
+			}
+			// 未被覆盖的配置项保留前一层的值
+			if tc.file && Conf.Log.Level != "error" {
+				t.Errorf("log.level = %s", Conf.Log.Level)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		env  map[string]string
+		args []string
+	}{
+		{"invalid env", map[string]string{"WEBMARK_LOGIN_MAX_FAILURES": "many"}, nil},
+		{"invalid flag", nil, []string{"-tls=maybe"}},
+		{"fails validation", map[string]string{"WEBMARK_STORAGE_TYPE": "ftp"}, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			old := Conf
+			Conf = config.Default()
+			Conf.Log.Level = "error"
+			t.Cleanup(func() {
+				Conf = old
+				applyConfig(Conf)
+			})
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			var configPath string
+			fs := flag.NewFlagSet("webmark", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			configFlags(fs, &configPath)
+			if err := loadConfig(fs, configPath, tc.args); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	cases := []struct {
+		args       []string
+		flags      []string
+		positional []string
+	}{
+		{nil, nil, nil},
+		{[]string{"alice"}, nil, []string{"alice"}},
+		{[]string{"-role", "admin", "alice"}, []string{"-role", "admin"}, []string{"alice"}},
+		// 用户名之后的参数名同样生效
+		{[]string{"alice", "-role", "admin", "-db", "x.db"}, []string{"-role", "admin", "-db", "x.db"}, []string{"alice"}},
+		{[]string{"-db", "x.db", "alice", "-role=admin", "bob"}, []string{"-db", "x.db", "-role=admin"}, []string{"alice", "bob"}},
+		{[]string{"alice", "--", "-role"}, []string{"--"}, []string{"alice", "-role"}},
+	}
+	for _, tc := range cases {
+		t.Run(strings.Join(tc.args, " "), func(t *testing.T) {
+			var newFlagSet = func() (*flag.FlagSet, *string, *string) {
+				fs := flag.NewFlagSet("user add", flag.ContinueOnError)
+				return fs, fs.String("role", "user", ""), fs.String("db", "", "")
+			}
+			fs, role, db := newFlagSet()
+			flags, positional, err := parseArgs(fs, tc.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(flags, tc.flags) || !reflect.DeepEqual(positional, tc.positional) {
+				t.Errorf("flags = %q, positional = %q", flags, positional)
+			}
+			// 只解析参数名部分得到相同的值，供 loadConfig 再次解析
+			fs2, role2, db2 := newFlagSet()
+			if err := fs2.Parse(flags); err != nil || *role2 != *role || *db2 != *db {
+				t.Errorf("reparse = %s %s, want %s %s, %v", *role2, *db2, *role, *db, err)
+			}
+		})
+	}
+}
+
+// 多余或缺少的位置参数返回用法错误，不会打开数据库
+func TestUserCmdUsage(t *testing.T) {
+	for _, args := range [][]string{
+		nil,
+		{"rename", "alice"},
+		{"add"},
+		{"add", "alice", "bob"},
+		{"add", "alice", "-password", "x", "bob"},
+		{"passwd", "alice", "extra"},
+		{"del", "alice", "-purge", "bob"},
+		{"list", "alice"},
+	} {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			err := cmd_user(args)
+			if err == nil || !strings.HasPrefix(err.Error(), "usage:") {
+				t.Errorf("error = %v", err)
+			}
+		})
+	}
+}
+
+// 用户名之后的参数名同样生效
+func TestUserCmdFlagsAfterUsername(t *testing.T) {
+	dir := t.TempDir()
+	old := Conf
+	Conf = config.Default()
+	Conf.Log.Level = "error"
+	t.Cleanup(func() {
+		closeDB()
+		GDB = nil
+		Conf = old
+		applyConfig(Conf)
+	})
+	var db = filepath.Join(dir, "webmark.db")
+	err := cmd_user([]string{"add", "alice", "-role", "admin", "-password", "secret",
+		"-data", filepath.Join(dir, "markdown"), "-db", db})
+	if err != nil {
+		if strings.Contains(err.Error(), "fts5") {
+			t.Skip("sqlite built without fts5, run with -tags fts5")
+		}
+		t.Fatal(err)
+	}
+	if Conf.Database.Path != db {
+		t.Fatalf("database.path = %s", Conf.Database.Path)
+	}
+	if err := openDB(); err != nil {
+		t.Fatal(err)
+	}
+	user, err := GDB.Users.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != "admin" || !Verify(user.Password, "secret") {
+		t.Errorf("user = %+v", user)
+	}
+}
@@ -0,0 +1,244 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 登录结果，开启了两步验证时需要再调用 LoginTOTP
+type LoginResult struct {
+	TOTP   bool   `json:"totp"`
+	Ticket string `json:"ticket"`
+}
+
+type Token struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	CreateAt int64  `json:"create_at"`
+	LastUsed int64  `json:"last_used"`
+}
+
+// 新建的访问令牌，Token 只在创建时返回一次
+type NewToken struct {
+	Id    string `json:"id"`
+	Token string `json:"token"`
+}
+
+type Group struct {
+	Name      string `json:"name"`
+	Documents int    `json:"documents"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type DocSummary struct {
+	Group string `json:"group"`
+	Title string `json:"title"`
+}
+
+type Document struct {
+	Group     string `json:"group"`
+	Title     string `json:"title"`
+	Content   string `json:"content"`
+	Public    bool   `json:"public"`
+	ViewCount int    `json:"view_count"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+type PublicDoc struct {
+	Groupname string `json:"groupname"`
+	Title     string `json:"title"`
+	Username  string `json:"username"`
+	ViewCount int    `json:"view_count"`
+}
+
+// 用户名密码登录，成功后会话保存在 cookie jar 中
+func (c *Client) Login(ctx context.Context, username, password string) (*LoginResult, error) {
+	var raw any
+	err := c.wmapi(ctx, http.MethodPost, "login", map[string]string{"username": username, "password": password}, &raw)
+	if err != nil {
+		return nil, err
+	}
+	var res = &LoginResult{}
+	if m, ok := raw.(map[string]any); ok {
+		res.TOTP, _ = m["totp"].(bool)
+		res.Ticket, _ = m["ticket"].(string)
+	}
+	return res, nil
+}
+
+// 两步验证，code 为验证码或恢复码
+func (c *Client) LoginTOTP(ctx context.Context, ticket, code string) error {
+	return c.wmapi(ctx, http.MethodPost, "totp-login", map[string]string{"ticket": ticket, "code": code}, nil)
+}
+
+func (c *Client) Logout(ctx context.Context) error {
+	return c.wmapi(ctx, http.MethodPost, "logout", nil, nil)
+}
+
+func (c *Client) Tokens(ctx context.Context) ([]Token, error) {
+	var res []Token
+	return res, c.wmapi(ctx, http.MethodGet, "token-list", nil, &res)
+}
+
+func (c *Client) CreateToken(ctx context.Context, name string) (*NewToken, error) {
+	var res NewToken
+	if err := c.wmapi(ctx, http.MethodPost, "token-create", map[string]string{"name": name}, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (c *Client) DeleteToken(ctx context.Context, id string) error {
+	return c.wmapi(ctx, http.MethodPost, "token-delete", map[string]string{"id": id}, nil)
+}
+
+func (c *Client) Groups(ctx context.Context) ([]Group, error) {
+	var res []Group
+	_, err := c.api(ctx, http.MethodGet, []string{"groups"}, nil, nil, nil, &res)
+	return res, err
+}
+
+// 新建分组，已存在时 created 为 false
+func (c *Client) CreateGroup(ctx context.Context, name string) (group *Group, created bool, err error) {
+	group = &Group{}
+	status, err := c.api(ctx, http.MethodPut, []string{"groups", name}, nil, nil, nil, group)
+	if err != nil {
+		return nil, false, err
+	}
+	return group, status == http.StatusCreated, nil
+}
+
+// 删除分组及其中的所有文档
+func (c *Client) DeleteGroup(ctx context.Context, name string) error {
+	_, err := c.api(ctx, http.MethodDelete, []string{"groups", name}, nil, nil, nil, nil)
+	return err
+}
+
+// 分组中的文档，query 不为空时搜索
+func (c *Client) Search(ctx context.Context, group, query string) ([]DocSummary, error) {
+	var res []DocSummary
+	_, err := c.api(ctx, http.MethodGet, []string{"groups", group, "docs"}, queryOf(query), nil, nil, &res)
+	return res, err
+}
+
+func (c *Client) Document(ctx context.Context, group, title string) (*Document, error) {
+	var res Document
+	if _, err := c.api(ctx, http.MethodGet, []string{"groups", group, "docs", title}, nil, nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// 新建文档，已存在时返回 precondition_failed
+func (c *Client) CreateDocument(ctx context.Context, group, title, content string) error {
+	_, err := c.putDocument(ctx, group, title, content, http.Header{"If-None-Match": {"*"}})
+	return err
+}
+
+// 修改文档，不存在时返回 precondition_failed
+func (c *Client) UpdateDocument(ctx context.Context, group, title, content string) error {
+	_, err := c.putDocument(ctx, group, title, content, http.Header{"If-Match": {"*"}})
+	return err
+}
+
+// 新建或修改文档
+func (c *Client) PutDocument(ctx context.Context, group, title, content string) (created bool, err error) {
+	return c.putDocument(ctx, group, title, content, nil)
+}
+
+func (c *Client) putDocument(ctx context.Context, group, title, content string, header http.Header) (bool, error) {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "text/markdown; charset=utf-8")
+	status, err := c.api(ctx, http.MethodPut, []string{"groups", group, "docs", title}, nil, strings.NewReader(content), header, nil)
+	return status == http.StatusCreated, err
+}
+
+// 删除文档及其附件
+func (c *Client) DeleteDocument(ctx context.Context, group, title string) error {
+	_, err := c.api(ctx, http.MethodDelete, []string{"groups", group, "docs", title}, nil, nil, nil, nil)
+	return err
+}
+
+func (c *Client) SetPublic(ctx context.Context, group, title string, public bool) error {
+	var body = `{"public":false}`
+	if public {
+		body = `{"public":true}`
+	}
+	_, err := c.api(ctx, http.MethodPut, []string{"groups", group, "docs", title, "public"}, nil, strings.NewReader(body),
+		http.Header{"Content-Type": {"application/json"}}, nil)
+	return err
+}
+
+// 上传附件，文档中以 title/name 引用
+func (c *Client) Upload(ctx context.Context, group, title, name string, r io.Reader) error {
+	_, err := c.api(ctx, http.MethodPut, []string{"groups", group, "docs", title, "attachments", name}, nil, r,
+		http.Header{"Content-Type": {"application/octet-stream"}}, nil)
+	return err
+}
+
+// 下载附件，调用方负责关闭
+func (c *Client) Attachment(ctx context.Context, group, title, name string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.url("/api/v2", "groups", group, "docs", title, "attachments", name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *Client) DeleteAttachment(ctx context.Context, group, title, name string) error {
+	_, err := c.api(ctx, http.MethodDelete, []string{"groups", group, "docs", title, "attachments", name}, nil, nil, nil, nil)
+	return err
+}
+
+// 公开文档，query 不为空时搜索，不需要登录
+func (c *Client) PublicDocuments(ctx context.Context, query string) ([]PublicDoc, error) {
+	var res []PublicDoc
+	_, err := c.api(ctx, http.MethodGet, []string{"public"}, queryOf(query), nil, nil, &res)
+	return res, err
+}
+
+// 公开文档的 Markdown 原文，会增加点击量
+// 不同用户可以有同名的公开文档，username 取自 PublicDocuments 返回的 Username
+func (c *Client) PublicMarkdown(ctx context.Context, username, group, title string) (string, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.url("/api/v2/public", username, group, title), nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return string(b), err
+}
+
+// 导出为 zip 写入 w，不指定 group 时导出全部，指定 title 时只导出一篇文档
+func (c *Client) Export(ctx context.Context, w io.Writer, group, title string) error {
+	var u = c.base.String() + "/wmapi/export/"
+	if group != "" {
+		u = c.url("/wmapi/export", group)
+		if title != "" {
+			u = c.url("/wmapi/export", group, title)
+		}
+	}
+	resp, err := c.do(ctx, http.MethodGet, u, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		// 未登录
+		return readError(resp)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func queryOf(q string) url.Values {
+	if q == "" {
+		return nil
+	}
+	return url.Values{"q": {q}}
+}
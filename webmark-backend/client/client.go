@@ -0,0 +1,240 @@
+// webmark 的 Go 客户端
+//
+// 分组、文档、附件与公开文档使用 /api/v2，可以用访问令牌或登录会话认证；
+// 登录、访问令牌管理与导出使用 /wmapi，只能用登录会话
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+)
+
+// 与服务端一致的错误码
+const (
+	CodeUnauthenticated    = "unauthenticated"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeAlreadyExists      = "already_exists"
+	CodeInvalidArgument    = "invalid_argument"
+	CodePreconditionFailed = "precondition_failed"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeUnavailable        = "unavailable"
+	CodeInternal           = "internal"
+)
+
+// 服务端返回的错误
+// /wmapi 接口失败时状态码通常为 200，Code 为空，Message 为服务端的提示
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("webmark: %d %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("webmark: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// 错误码，不是服务端返回的错误时为空
+func ErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+func IsNotFound(err error) bool {
+	return ErrorCode(err) == CodeNotFound
+}
+
+func IsUnauthenticated(err error) bool {
+	return ErrorCode(err) == CodeUnauthenticated
+}
+
+// 文档已存在(新建时)或不存在(修改时)
+func IsPreconditionFailed(err error) bool {
+	return ErrorCode(err) == CodePreconditionFailed
+}
+
+type Config struct {
+	BaseURL    string       // 服务地址，如 http://127.0.0.1:11990
+	Token      string       // 访问令牌，为空时使用 Login 建立的会话
+	HTTPClient *http.Client // 为空时新建，没有 cookie jar 时会补上
+}
+
+type Client struct {
+	base  *url.URL
+	token string
+	http  *http.Client
+}
+
+func New(c Config) (*Client, error) {
+	base, err := url.Parse(strings.TrimSuffix(c.BaseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("webmark: invalid base url %q", c.BaseURL)
+	}
+	var hc = c.HTTPClient
+	if hc == nil {
+		hc = &http.Client{}
+	}
+	if hc.Jar == nil {
+		// 会话与 CSRF 令牌都保存在 cookie 中
+		jar, _ := cookiejar.New(nil)
+		copied := *hc
+		copied.Jar = jar
+		hc = &copied
+	}
+	return &Client{base: base, token: c.Token, http: hc}, nil
+}
+
+// 拼接路径，每一段单独转义
+func (c *Client) url(prefix string, segments ...string) string {
+	var b strings.Builder
+	b.WriteString(c.base.String())
+	b.WriteString(prefix)
+	for _, s := range segments {
+		b.WriteString("/")
+		b.WriteString(url.PathEscape(s))
+	}
+	return b.String()
+}
+
+// 发送请求，返回 2xx 响应，调用方负责关闭 Body
+func (c *Client) do(ctx context.Context, method, u string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if method != http.MethodGet && method != http.MethodHead {
+		// 已登录的修改请求需要带上 CSRF 令牌
+		for _, cookie := range c.http.Jar.Cookies(req.URL) {
+			if cookie.Name == "csrf_token" {
+				req.Header.Set("X-CSRF-Token", cookie.Value)
+			}
+		}
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, readError(resp)
+}
+
+func readError(resp *http.Response) error {
+	var e = &Error{StatusCode: resp.StatusCode, Message: resp.Status}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var v2 struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	var v1 struct {
+		Ok  *bool  `json:"ok"`
+		Msg string `json:"msg"`
+	}
+	if json.Unmarshal(b, &v2) == nil && v2.Error.Code != "" {
+		e.Code, e.Message = v2.Error.Code, v2.Error.Message
+	} else if json.Unmarshal(b, &v1) == nil && v1.Ok != nil {
+		e.Message = v1.Msg
+		if e.Message == "" {
+			e.Message = "request failed"
+		}
+	} else if s := strings.TrimSpace(string(b)); s != "" {
+		e.Message = s
+	}
+	if e.Code == "" {
+		switch resp.StatusCode {
+		case http.StatusUnauthorized:
+			e.Code = CodeUnauthenticated
+		case http.StatusForbidden:
+			e.Code = CodeForbidden
+		case http.StatusNotFound:
+			e.Code = CodeNotFound
+		}
+	}
+	return e
+}
+
+// /api/v2 请求，out 不为空时解析 JSON 响应，返回状态码
+func (c *Client) api(ctx context.Context, method string, segments []string, query url.Values, body io.Reader, header http.Header, out any) (int, error) {
+	var u = c.url("/api/v2", segments...)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	resp, err := c.do(ctx, method, u, body, header)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("webmark: decode response: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// /wmapi 请求，in 不为空时以 JSON 发送，解析 ResponseBase 中的 data
+func (c *Client) wmapi(ctx context.Context, method, name string, in, out any) error {
+	var body io.Reader
+	var header = http.Header{}
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+		header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.do(ctx, method, c.base.String()+"/wmapi/"+name, body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Ok   bool            `json:"ok"`
+		Data json.RawMessage `json:"data"`
+		Msg  string          `json:"msg"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("webmark: decode response: %w", err)
+	}
+	if !res.Ok {
+		var e = &Error{StatusCode: resp.StatusCode, Message: res.Msg}
+		if e.Message == "" {
+			// 未登录与一般的失败没有区分
+			e.Message = "request failed"
+		}
+		return e
+	}
+	if out != nil {
+		if err := json.Unmarshal(res.Data, out); err != nil {
+			return fmt.Errorf("webmark: decode response: %w", err)
+		}
+	}
+	return nil
+}
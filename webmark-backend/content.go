@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"webmark/repo"
+)
+
+// webmark export -user name [-group g] [-o file]
+func cmd_export(args []string) error {
+	var configPath, username, group, out string
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	configFlags(fs, &configPath)
+	fs.StringVar(&username, "user", "", "用户名")
+	fs.StringVar(&group, "group", "", "只导出该分组")
+	fs.StringVar(&out, "o", "", "导出文件，默认为 用户名.zip 或 分组名.zip")
+	fs.Parse(args)
+	if username == "" {
+		return errors.New("export: -user is required")
+	}
+	if err := loadConfig(fs, configPath, args); err != nil {
+		return err
+	}
+	var src = username
+	if group != "" {
+		src = path.Join(username, group)
+	}
+	if out == "" {
+		out = path.Base(src) + ".zip"
+	}
+	if _, err := Store.Stat(src); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	unlock, err := lockExclusive()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	// 失败时删除不完整的压缩包
+	err = ZipDir(src, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		return fmt.Errorf("export: %w", err)
+	}
+	fmt.Printf("exported %s to %s\n", src, out)
+	return nil
+}
+
+// 待导入的文件，路径相对用户目录
+type importFile struct {
+	name string
+	open func() (io.ReadCloser, error)
+}
+
+// webmark import -user name [-group g] [-overwrite] file.zip|dir
+// 不指定分组时第一层目录为分组(导出整个用户的格式)，指定时第一层为文档(导出分组的格式)
+func cmd_import(args []string) error {
+	var configPath, username, group string
+	var overwrite bool
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	configFlags(fs, &configPath)
+	fs.StringVar(&username, "user", "", "用户名")
+	fs.StringVar(&group, "group", "", "导入到该分组")
+	fs.BoolVar(&overwrite, "overwrite", false, "覆盖已存在的文档与附件")
+	fs.Parse(args)
+	var src = fs.Arg(0)
+	if username == "" || src == "" {
+		return errors.New("usage: webmark import -user name [-group g] [-overwrite] file.zip|dir")
+	}
+	if group != "" && !validName(group) {
+		return fmt.Errorf("import: invalid group %q", group)
+	}
+	if err := loadConfig(fs, configPath, args); err != nil {
+		return err
+	}
+	files, closer, err := importSource(src)
+	if err != nil {
+		return err
+	}
+	defer closer()
+	end, err := beginCommand()
+	if err != nil {
+		return err
+	}
+	defer end()
+	if _, err := GDB.Users.Get(username); errors.Is(err, repo.ErrNotFound) {
+		return fmt.Errorf("import: user %s not found", username)
+	} else if err != nil {
+		return err
+	}
+	user_check(username)
+
+	var groups = make(map[string]struct{})
+	var written, skipped int
+	for _, file := range files {
+		var name = file.name
+		if group != "" {
+			name = path.Join(group, name)
+		}
+		parts := strings.Split(name, "/")
+		var valid = len(parts) == 3 || (len(parts) == 2 && strings.HasSuffix(parts[1], ".md"))
+		for _, p := range parts {
+			valid = valid && validName(p)
+		}
+		if !valid {
+			fmt.Printf("skip %s: not group/title.md or group/title/attachment\n", file.name)
+			skipped++
+			continue
+		}
+		var key = path.Join(username, name)
+		if _, err := Store.Stat(key); err == nil && !overwrite {
+			fmt.Printf("skip %s: already exists\n", name)
+			skipped++
+			continue
+		}
+		rc, err := file.open()
+		if err != nil {
+			return err
+		}
+		err = Store.Write(key, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("import %s: %w", name, err)
+		}
+		groups[parts[0]] = struct{}{}
+		written++
+	}
+	var names = make([]string, 0, len(groups))
+	for g := range groups {
+		names = append(names, g)
+	}
+	sort.Strings(names)
+	for _, g := range names {
+		indexGroupFiles(username, g)
+	}
+	if written > 0 {
+		gitCommit(username, "import "+filepath.Base(src))
+	}
+	fmt.Printf("imported %d files into %d groups, skipped %d\n", written, len(names), skipped)
+	return nil
+}
+
+// 读取 zip 包或目录中的文件，忽略隐藏文件
+func importSource(src string) ([]importFile, func(), error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	var files = make([]importFile, 0)
+	if info.IsDir() {
+		err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if p != src && ignored(d.Name()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(src, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, importFile{name: filepath.ToSlash(rel), open: func() (io.ReadCloser, error) {
+				return os.Open(p)
+			}})
+			return nil
+		})
+		return files, func() {}, err
+	}
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		var name = path.Clean(f.Name)
+		if strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			zr.Close()
+			return nil, nil, fmt.Errorf("import: invalid path %q in %s", f.Name, src)
+		}
+		var hidden = false
+		for _, p := range strings.Split(name, "/") {
+			hidden = hidden || ignored(p)
+		}
+		if !hidden {
+			files = append(files, importFile{name: name, open: f.Open})
+		}
+	}
+	return files, func() { zr.Close() }, nil
+}
+
+// webmark publish [-off] -user name group title
+func cmd_publish(args []string) error {
+	var configPath, username string
+	var off bool
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	configFlags(fs, &configPath)
+	fs.StringVar(&username, "user", "", "用户名")
+	fs.BoolVar(&off, "off", false, "取消公开")
+	fs.Parse(args)
+	var group, title = fs.Arg(0), fs.Arg(1)
+	if username == "" || group == "" || title == "" {
+		return errors.New("usage: webmark publish [-off] -user name group title")
+	}
+	if err := loadConfig(fs, configPath, args); err != nil {
+		return err
+	}
+	end, err := beginCommand()
+	if err != nil {
+		return err
+	}
+	defer end()
+	found, err := GDB.Docs.SetPublic(username, group, title, !off)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("publish: document %s not found in index", path.Join(username, group, title))
+	}
+	var state = "public"
+	if off {
+		state = "private"
+	}
+	fmt.Printf("%s is now %s\n", path.Join(username, group, title), state)
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"webmark/repo"
+	"webmark/storage"
+)
+
+// 锁文件，本地存储放在数据目录下，否则放在 sqlite 数据库旁边
+const lockFileName = ".webmark.lock"
+
+// 数据锁：进程内是读写锁，同时用锁文件与其它进程(命令行工具)互斥
+// 服务端修改文档时持有共享锁，备份与命令行工具持有排它锁
+type dataLock struct {
+	mu      sync.RWMutex
+	fmu     sync.Mutex
+	readers int
+	file    *os.File // 没有锁文件时只在进程内互斥
+}
+
+func (l *dataLock) RLock() {
+	l.mu.RLock()
+	l.fmu.Lock()
+	defer l.fmu.Unlock()
+	if l.readers == 0 && l.file != nil {
+		if err := flock(l.file, false); err != nil {
+			slog.Error("data lock failed", "err", err)
+		}
+	}
+	l.readers++
+}
+
+func (l *dataLock) RUnlock() {
+	l.fmu.Lock()
+	l.readers--
+	if l.readers == 0 && l.file != nil {
+		if err := funlock(l.file); err != nil {
+			slog.Error("data unlock failed", "err", err)
+		}
+	}
+	l.fmu.Unlock()
+	l.mu.RUnlock()
+}
+
+func (l *dataLock) Lock() {
+	l.mu.Lock()
+	if l.file != nil {
+		if err := flock(l.file, true); err != nil {
+			slog.Error("data lock failed", "err", err)
+		}
+	}
+}
+
+func (l *dataLock) Unlock() {
+	if l.file != nil {
+		if err := funlock(l.file); err != nil {
+			slog.Error("data unlock failed", "err", err)
+		}
+	}
+	l.mu.Unlock()
+}
+
+// 锁文件路径，对象存储加 PostgreSQL 时没有共享的本地目录，返回空
+func lockPath() string {
+	if local, ok := Store.(*storage.Local); ok {
+		return filepath.Join(local.Root, lockFileName)
+	}
+	if Conf.Database.Driver == string(repo.SQLite) {
+		return Conf.Database.Path + ".lock"
+	}
+	return ""
+}
+
+func openLockFile() (*os.File, error) {
+	var name = lockPath()
+	if name == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// 服务启动时打开锁文件，之后的修改与命令行工具互斥
+func initDataLock() {
+	f, err := openLockFile()
+	if err != nil {
+		slog.Error("open data lock failed", "err", err)
+		return
+	}
+	if f == nil {
+		slog.Warn("no local directory for the data lock file, command line tools cannot run alongside the server")
+		return
+	}
+	snapshotLock.file = f
+}
+
+// 命令行工具修改数据前持有排它锁，服务正在修改时等待
+// 返回的函数释放锁
+func lockExclusive() (func(), error) {
+	f, err := openLockFile()
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return func() {}, nil
+	}
+	if err := flockTry(f); err != nil {
+		fmt.Fprintln(os.Stderr, "等待服务完成当前的修改...")
+		if err := flock(f, true); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return func() {
+		funlock(f)
+		f.Close()
+	}, nil
+}
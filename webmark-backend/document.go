@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"path"
+	"strings"
+	"webmark/storage"
+)
+
+// 文档与分组的读写，/wmapi 与 /api/v2 共用
+var (
+	errDocExists   = errors.New("document already exists")
+	errDocNotFound = errors.New("document not found")
+)
+
+// 分组名与文档名会作为目录名和文件名使用
+func validName(name string) bool {
+	return name != "" && len(name) <= 100 && !ignored(name) &&
+		!strings.ContainsAny(name, "/\\") && strings.TrimSpace(name) == name
+}
+
+// 保存文档并刷新索引
+// create 为 true 时只新建，文档已存在返回 errDocExists；否则只修改，文档不存在返回 errDocNotFound
+func saveMarkdown(username, group, title string, content []byte, create bool) error {
+	group_check(username, group)
+	var fname = path.Join(username, group, title+".md")
+	_, err := Store.Stat(fname)
+	var exists = !errors.Is(err, fs.ErrNotExist)
+	if create && exists {
+		return errDocExists
+	}
+	if !create && !exists {
+		return errDocNotFound
+	}
+	if err := storage.WriteFile(Store, fname, content); err != nil {
+		return err
+	}
+	// 刷索引
+	MakeIndex(username, group, title, string(content))
+	if create {
+		gitCommit(username, "new "+path.Join(group, title))
+		return nil
+	}
+	clean_files(group, username, title)
+	gitCommit(username, "update "+path.Join(group, title))
+	return nil
+}
+
+// 删除文档及其附件，文档不存在时清理残留后返回 errDocNotFound
+func deleteMarkdown(username, group, title string) error {
+	var fname = path.Join(username, group, title)
+	_, err := Store.Stat(fname + ".md")
+	var exists = !errors.Is(err, fs.ErrNotExist)
+	if err := Store.RemoveAll(fname); err != nil {
+		slog.Error("delete attachments failed", "path", fname, "err", err)
+	}
+	if !exists {
+		DeleteIndex(username, group, title)
+		return errDocNotFound
+	}
+	if err := Store.Remove(fname + ".md"); err != nil {
+		return err
+	}
+	DeleteIndex(username, group, title)
+	gitCommit(username, "delete "+path.Join(group, title))
+	return nil
+}
+
+// 删除分组下的所有文档
+func deleteGroup(username, group string) error {
+	if err := Store.RemoveAll(path.Join(username, group)); err != nil {
+		return err
+	}
+	// 删除索引
+	if err := GDB.Docs.DeleteGroup(username, group); err != nil {
+		return err
+	}
+	gitCommit(username, "delete group "+group)
+	return nil
+}
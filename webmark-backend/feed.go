@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"webmark/storage"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// 订阅源最多包含的文档数
+const feedLimit = 50
+
+// 摘要长度(字符)
+const feedSummaryLength = 200
+
+// 订阅源中的一篇文档
+type feedEntry struct {
+	Title     string
+	Link      string
+	Author    string
+	Category  string
+	Summary   string
+	Published time.Time
+	Updated   time.Time
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title     string       `xml:"title"`
+	ID        string       `xml:"id"`
+	Link      atomLink     `xml:"link"`
+	Published string       `xml:"published"`
+	Updated   string       `xml:"updated"`
+	Author    atomAuthor   `xml:"author"`
+	Category  atomCategory `xml:"category"`
+	Summary   atomText     `xml:"summary"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Category    string  `xml:"category"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// 公开文档的订阅源，不需要登录
+// /wmapi/feed/atom、/wmapi/feed/rss，?user= 只看某个用户，再加 &group= 只看某个分组
+func feed(w http.ResponseWriter, r *http.Request) {
+	var format = strings.TrimPrefix(r.URL.Path, "/wmapi/feed/")
+	if format != "atom" && format != "rss" {
+		http.NotFound(w, r)
+		return
+	}
+	var username, group = r.URL.Query().Get("user"), r.URL.Query().Get("group")
+	if group != "" && username == "" {
+		ErrorResponseWithStatus(w, r, http.StatusBadRequest, "group requires user")
+		return
+	}
+	docs, err := GDB.Docs.Feed(username, group, feedLimit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "feed query failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	var site = requestScheme(r) + "://" + requestHost(r) + BasePath
+	var updated = time.Unix(0, 0)
+	var entries = make([]*feedEntry, 0, len(docs))
+	for _, doc := range docs {
+		var e = &feedEntry{
+			Title:     doc.Title,
+			Link:      site + "/public-doc?" + url.Values{"username": {doc.Username}, "groupname": {doc.Groupname}, "title": {doc.Title}}.Encode(),
+			Author:    doc.Username,
+			Category:  doc.Groupname,
+			Summary:   feedSummary(path.Join(doc.Username, doc.Groupname, doc.Title+".md")),
+			Published: time.Unix(doc.Published, 0).UTC(),
+			Updated:   time.Unix(doc.Updated, 0).UTC(),
+		}
+		if e.Updated.After(updated) {
+			updated = e.Updated
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		updated = time.Now().UTC()
+	}
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && len(entries) > 0 && !updated.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Last-Modified", updated.Format(http.TimeFormat))
+
+	var title = "webmark 公开文档"
+	switch {
+	case group != "":
+		title = username + "/" + group + " - " + title
+	case username != "":
+		title = username + " - " + title
+	}
+	var self = site + r.URL.RequestURI()
+	var out any
+	if format == "atom" {
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		out = atomOf(title, site, self, updated, entries)
+	} else {
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		out = rssOf(title, site, updated, entries)
+	}
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		slog.ErrorContext(r.Context(), "feed encode failed", "err", err)
+	}
+}
+
+func atomOf(title, site, self string, updated time.Time, entries []*feedEntry) *atomFeed {
+	var f = &atomFeed{
+		Title:   title,
+		ID:      self,
+		Updated: updated.Format(time.RFC3339),
+		Links:   []atomLink{{Href: self, Rel: "self", Type: "application/atom+xml"}, {Href: site + "/"}},
+		Entries: make([]atomEntry, 0, len(entries)),
+	}
+	for _, e := range entries {
+		f.Entries = append(f.Entries, atomEntry{
+			Title:     e.Title,
+			ID:        e.Link,
+			Link:      atomLink{Href: e.Link},
+			Published: e.Published.Format(time.RFC3339),
+			Updated:   e.Updated.Format(time.RFC3339),
+			Author:    atomAuthor{Name: e.Author},
+			Category:  atomCategory{Term: e.Category},
+			Summary:   atomText{Type: "text", Body: e.Summary},
+		})
+	}
+	return f
+}
+
+func rssOf(title, site string, updated time.Time, entries []*feedEntry) *rssFeed {
+	var c = rssChannel{
+		Title:         title,
+		Link:          site + "/",
+		Description:   title,
+		LastBuildDate: updated.Format(time.RFC1123Z),
+		Items:         make([]rssItem, 0, len(entries)),
+	}
+	for _, e := range entries {
+		c.Items = append(c.Items, rssItem{
+			Title:       e.Title,
+			Link:        e.Link,
+			GUID:        rssGUID{IsPermaLink: true, Value: e.Link},
+			PubDate:     e.Updated.Format(time.RFC1123Z),
+			Category:    e.Category,
+			Description: e.Summary,
+		})
+	}
+	return &rssFeed{Version: "2.0", Channel: c}
+}
+
+// 摘要只需要文本，按前端一样开启 GFM(表格、删除线、任务列表、自动链接)
+// 未开启 html.WithUnsafe，文档中的原始 HTML 标签不会输出
+var summaryMarkdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// 块级元素之间补一个空格，避免相邻段落的文字连在一起
+var textBlocks = map[atom.Atom]bool{
+	atom.P: true, atom.Li: true, atom.Td: true, atom.Th: true, atom.Br: true, atom.Blockquote: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+}
+
+var spaces = regexp.MustCompile(`\s+`)
+
+// 读取文档，取开头的纯文本作为摘要
+func feedSummary(key string) string {
+	b, err := storage.ReadFile(Store, key)
+	if err != nil {
+		return ""
+	}
+	return markdownText(string(b), feedSummaryLength)
+}
+
+// Markdown 渲染为 HTML 后提取纯文本，代码块、公式块、图片不计入，超过 n 个字符时截断
+func markdownText(src string, n int) string {
+	var buf bytes.Buffer
+	if err := summaryMarkdown.Convert([]byte(src), &buf); err != nil {
+		return ""
+	}
+	doc, err := html.Parse(&buf)
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	htmlText(doc, &b)
+	var text = strings.TrimSpace(spaces.ReplaceAllString(b.String(), " "))
+	if utf8.RuneCountInString(text) <= n {
+		return text
+	}
+	return string([]rune(text)[:n]) + "…"
+}
+
+func htmlText(node *html.Node, b *strings.Builder) {
+	switch node.Type {
+	case html.TextNode:
+		b.WriteString(node.Data)
+		return
+	case html.ElementNode:
+		switch node.DataAtom {
+		case atom.Pre, atom.Img, atom.Script, atom.Style:
+			return
+		}
+		if node.DataAtom == atom.P && displayMath(node) {
+			return
+		}
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		htmlText(c, b)
+	}
+	if textBlocks[node.DataAtom] {
+		b.WriteByte(' ')
+	}
+}
+
+// 公式块：goldmark 不解析公式，$$ 包围的块会渲染成普通段落
+func displayMath(p *html.Node) bool {
+	var b strings.Builder
+	for c := p.FirstChild; c != nil; c = c.NextSibling {
+		htmlText(c, &b)
+	}
+	var text = strings.TrimSpace(b.String())
+	return len(text) >= 4 && strings.HasPrefix(text, "$$") && strings.HasSuffix(text, "$$")
+}
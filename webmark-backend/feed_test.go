@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarkdownText(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"headings and paragraphs", "# 标题\n\n第一段\n\n第二段", "标题 第一段 第二段"},
+		{"emphasis and links", "**粗体** _斜体_ `代码` [链接](https://example.com) ~~删除~~", "粗体 斜体 代码 链接 删除"},
+		{"image", "前 ![图片说明](a.png) 后", "前 后"},
+		{"fenced code", "说明\n\n```go\nfunc main() {}\n```\n\n结束", "说明 结束"},
+		{"indented code", "说明\n\n    code line\n\n结束", "说明 结束"},
+		{"display math", "公式\n\n$$\nx^2 + y^2\n$$\n\n结束", "公式 结束"},
+		{"lists and quotes", "- 一\n- [x] 二\n\n> 引用\n\n1. 三", "一 二 引用 三"},
+		{"table", "| a | b |\n|---|---|\n| 1 | 2 |", "a b 1 2"},
+		{"raw html", "<div>块</div>\n\n文字 <b>加粗</b> &amp; 实体", "文字 加粗 & 实体"},
+		// 单词内的下划线不是强调
+		{"intraword underscores", "调用 snake_case_name 与 a_b", "调用 snake_case_name 与 a_b"},
+		{"thematic break", "上\n\n---\n\n下", "上 下"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := markdownText(tt.src, 200); got != tt.want {
+				t.Errorf("markdownText = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkdownTextTruncate(t *testing.T) {
+	got := markdownText(strings.Repeat("字", 10), 4)
+	if got != "字字字字…" {
+		t.Fatalf("markdownText = %q", got)
+	}
+}
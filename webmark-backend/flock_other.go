@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// 不支持文件锁的平台只在进程内互斥
+func flock(f *os.File, exclusive bool) error { return nil }
+
+func flockTry(f *os.File) error { return nil }
+
+func funlock(f *os.File) error { return nil }
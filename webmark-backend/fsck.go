@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+	"webmark/storage"
+)
+
+// 数据目录与数据库不一致的问题
+type fsckIssue struct {
+	Kind   string
+	Target string
+	Detail string
+	repair func() error // 修复方法
+}
+
+// 检查数据目录与数据库的一致性
+func fsck() ([]*fsckIssue, error) {
+	var issues = make([]*fsckIssue, 0)
+	var add = func(kind, target, detail string, repair func() error) {
+		issues = append(issues, &fsckIssue{Kind: kind, Target: target, Detail: detail, repair: repair})
+	}
+
+	// 磁盘上的分组与文档
+	users, err := reconcileUsers()
+	if err != nil {
+		return nil, err
+	}
+	var diskGroups = make(map[string]struct{})
+	var diskDocs = make(map[string]struct{})
+	for _, username := range users {
+		groups, err := Store.List(username)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, group := range groups {
+			if !group.IsDir || ignored(group.Name) {
+				continue
+			}
+			diskGroups[path.Join(username, group.Name)] = struct{}{}
+			files, err := Store.List(path.Join(username, group.Name))
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range files {
+				if !file.IsDir && !ignored(file.Name) && strings.HasSuffix(file.Name, ".md") {
+					diskDocs[path.Join(username, group.Name, strings.TrimSuffix(file.Name, ".md"))] = struct{}{}
+				}
+			}
+		}
+	}
+
+	// 分组
+	var dbGroups = make(map[string]struct{})
+	rows, err := GDB.Query(`select username, groupname from docs_group`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var username, groupname string
+		if err := rows.Scan(&username, &groupname); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		dbGroups[path.Join(username, groupname)] = struct{}{}
+		if _, ok := diskGroups[path.Join(username, groupname)]; !ok {
+			add("missing-group-dir", path.Join(username, groupname), "docs_group 有记录但目录不存在", func() error {
+				return GDB.Docs.DeleteGroup(username, groupname)
+			})
+		}
+	}
+	rows.Close()
+	for key := range diskGroups {
+		if _, ok := dbGroups[key]; !ok {
+			username, groupname, _ := strings.Cut(key, "/")
+			add("unregistered-group", key, "目录存在但 docs_group 没有记录", func() error {
+				group_check(username, groupname)
+				return nil
+			})
+		}
+	}
+
+	// 文档
+	refs, err := GDB.Docs.List("")
+	if err != nil {
+		return nil, err
+	}
+	var dbDocs = make(map[string]struct{})
+	for _, ref := range refs {
+		var key = path.Join(ref.Username, ref.Groupname, ref.Title)
+		dbDocs[key] = struct{}{}
+		if _, ok := diskDocs[key]; !ok {
+			add("missing-file", key, "docs_info 有记录但文件不存在", func() error {
+				return GDB.Docs.Delete(ref.Username, ref.Groupname, ref.Title)
+			})
+		}
+	}
+	for key := range diskDocs {
+		if _, ok := dbDocs[key]; !ok {
+			add("unindexed-file", key, "文件存在但 docs_info 没有记录", fsckReindex(key))
+		}
+	}
+	unindexed, err := GDB.Docs.Unindexed()
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range unindexed {
+		var key = path.Join(ref.Username, ref.Groupname, ref.Title)
+		if _, ok := diskDocs[key]; ok {
+			add("missing-index", key, "docs_info 有记录但没有全文索引", fsckReindex(key))
+		}
+	}
+	orphans, err := GDB.Docs.OrphanIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, doc_id := range orphans {
+		add("orphan-index", fmt.Sprint(doc_id), "全文索引没有对应的 docs_info", func() error {
+			return GDB.Docs.RemoveIndex(doc_id)
+		})
+	}
+
+	// 会话、登录记录与凭据
+	var now = time.Now().Unix()
+	err = fsckRows(`select session_id from session_info where username not in (select username from user_info)`, func(session_id string) {
+		add("orphan-session", session_id[:min(8, len(session_id))], "会话对应的用户不存在", fsckExec(`delete from session_info where session_id = ?`, session_id))
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = fsckRows(`select session_id from session_info where username in (select username from user_info) and (expire < ? or last_seen < ?)`, func(session_id string) {
+		add("expired-session", session_id[:min(8, len(session_id))], "会话已过期", fsckExec(`delete from session_info where session_id = ?`, session_id))
+	}, now, now-int64(SessionIdleTimeout/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	err = fsckRows(`select username from login_record where last_time < ?`, func(username string) {
+		add("stale-login-record", username, "登录失败记录已超过锁定时长", fsckExec(`delete from login_record where username = ?`, username))
+	}, now-int64(LoginLockout/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range []string{"user_totp", "totp_recovery", "webauthn_credential"} {
+		err = fsckRows(`select distinct username from `+table+` where username not in (select username from user_info)`, func(username string) {
+			add("orphan-credential", table+"/"+username, "凭据对应的用户不存在", fsckExec(`delete from `+table+` where username = ?`, username))
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return issues, nil
+}
+
+// 从文件重建索引，key 为 用户/分组/标题
+func fsckReindex(key string) func() error {
+	return func() error {
+		parts := strings.SplitN(key, "/", 3)
+		content, err := storage.ReadFile(Store, key+".md")
+		if err != nil {
+			return err
+		}
+		group_check(parts[0], parts[1])
+		return GDB.Docs.Index(parts[0], parts[1], parts[2], contentHash(content), splitWord(parts[2]), splitWord(string(content)))
+	}
+}
+
+func fsckExec(query string, args ...any) func() error {
+	return func() error {
+		_, err := GDB.Exec(query, args...)
+		return err
+	}
+}
+
+// 查询单列结果，先读完再处理，避免修复时与未关闭的查询冲突
+func fsckRows(query string, fn func(string), args ...any) error {
+	rows, err := GDB.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	var values = make([]string, 0)
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return err
+		}
+		values = append(values, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, v := range values {
+		fn(v)
+	}
+	return nil
+}
+
+// webmark fsck [-repair]
+func cmd_fsck(args []string) error {
+	var configPath string
+	var repair bool
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	configFlags(fs, &configPath)
+	fs.BoolVar(&repair, "repair", false, "修复发现的问题")
+	fs.Parse(args)
+	if err := loadConfig(fs, configPath, args); err != nil {
+		return err
+	}
+	end, err := beginCommand()
+	if err != nil {
+		return err
+	}
+	defer end()
+	issues, err := fsck()
+	if err != nil {
+		return err
+	}
+	var failed = 0
+	for _, issue := range issues {
+		var status = ""
+		if repair {
+			status = " (repaired)"
+			if err := issue.repair(); err != nil {
+				status = " (repair failed: " + err.Error() + ")"
+				failed++
+			}
+		}
+		fmt.Printf("[%s] %s: %s%s\n", issue.Kind, issue.Target, issue.Detail, status)
+	}
+	switch {
+	case len(issues) == 0:
+		fmt.Println("fsck: no problems found")
+	case !repair:
+		return fmt.Errorf("fsck: %d problems found, run with -repair to fix", len(issues))
+	case failed > 0:
+		return fmt.Errorf("fsck: %d of %d problems could not be repaired", failed, len(issues))
+	default:
+		fmt.Printf("fsck: %d problems repaired\n", len(issues))
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 构造各类不一致，每项返回预期的 kind 与 target
+type fsckSeed struct {
+	kind, target string
+	seed         func(t *testing.T)
+}
+
+func fsckExecT(t *testing.T, query string, args ...any) {
+	t.Helper()
+	if _, err := GDB.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fsckSeeds() []fsckSeed {
+	var now = time.Now().Unix()
+	return []fsckSeed{
+		{"missing-group-dir", "root/ghost", func(t *testing.T) {
+			if _, err := GDB.Groups.Ensure("root", "ghost", now); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"unregistered-group", "root/stray", func(t *testing.T) {
+			if err := Store.MkdirAll("root/stray"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"missing-file", "root/notes/world", func(t *testing.T) {
+			if err := Store.Remove("root/notes/world.md"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"unindexed-file", "root/notes/direct", func(t *testing.T) {
+			if err := Store.Write("root/notes/direct.md", strings.NewReader("direct")); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"missing-index", "root/notes/hello", func(t *testing.T) {
+			fsckExecT(t, `delete from docs where rowid = (select doc_id from docs_info where title = 'hello')`)
+		}},
+		// 目标为 doc_id，不比较
+		{"orphan-index", "", func(t *testing.T) {
+			// 只删除 docs_info 与文件，全文索引留下
+			fsckExecT(t, `delete from docs_info where title = 'legacy'`)
+			if err := Store.Remove("root/old/legacy.md"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"orphan-session", "aaaaaaaa", func(t *testing.T) {
+			fsckExecT(t, `insert into session_info(session_id, username, expire, create_at, last_seen) values (?, 'ghost', ?, ?, ?)`,
+				strings.Repeat("a", 64), now+3600, now, now)
+		}},
+		{"expired-session", "bbbbbbbb", func(t *testing.T) {
+			fsckExecT(t, `insert into session_info(session_id, username, expire, create_at, last_seen) values (?, 'root', ?, ?, ?)`,
+				strings.Repeat("b", 64), now-10, now-3600, now-3600)
+		}},
+		{"stale-login-record", "root", func(t *testing.T) {
+			fsckExecT(t, `insert into login_record(username, last_time, login_count) values ('root', 0, 3)`)
+		}},
+		{"orphan-credential", "user_totp/ghost", func(t *testing.T) {
+			fsckExecT(t, `insert into user_totp(username, secret, enabled, last_step, create_at) values ('ghost', 'x', 1, 0, ?)`, now)
+		}},
+		{"orphan-credential", "totp_recovery/ghost", func(t *testing.T) {
+			fsckExecT(t, `insert into totp_recovery(username, code_hash) values ('ghost', 'x')`)
+		}},
+		{"orphan-credential", "webauthn_credential/ghost", func(t *testing.T) {
+			fsckExecT(t, `insert into webauthn_credential(credential_id, username, user_handle, public_key, name, create_at) values ('cred', 'ghost', 'h', x'00', 'key', ?)`, now)
+		}},
+	}
+}
+
+// 与 newReconcileServer 相同的文档，数据一致
+func newFsckServer(t *testing.T) {
+	t.Helper()
+	newReconcileServer(t)
+	issues, err := fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 0 {
+		t.Fatalf("fsck on consistent data = %v", fsckKinds(issues))
+	}
+}
+
+func fsckKinds(issues []*fsckIssue) []string {
+	var kinds = make([]string, 0, len(issues))
+	for _, issue := range issues {
+		kinds = append(kinds, issue.Kind+" "+issue.Target)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// 修复全部问题后再次检查应当没有问题
+func fsckRepair(t *testing.T, issues []*fsckIssue) {
+	t.Helper()
+	for _, issue := range issues {
+		if err := issue.repair(); err != nil {
+			t.Errorf("repair %s %s: %v", issue.Kind, issue.Target, err)
+		}
+	}
+	after, err := fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 0 {
+		t.Errorf("fsck after repair = %v", fsckKinds(after))
+	}
+}
+
+func TestFsck(t *testing.T) {
+	for _, tc := range fsckSeeds() {
+		t.Run(strings.TrimSpace(tc.kind+" "+tc.target), func(t *testing.T) {
+			newFsckServer(t)
+			tc.seed(t)
+			issues, err := fsck()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(issues) != 1 || issues[0].Kind != tc.kind || (tc.target != "" && issues[0].Target != tc.target) {
+				t.Fatalf("issues = %v", fsckKinds(issues))
+			}
+			fsckRepair(t, issues)
+		})
+	}
+}
+
+// 所有问题同时出现时一次修复
+func TestFsckRepairAll(t *testing.T) {
+	newFsckServer(t)
+	seeds := fsckSeeds()
+	for _, s := range seeds {
+		s.seed(t)
+	}
+	issues, err := fsck()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != len(seeds) {
+		t.Fatalf("issues = %v", fsckKinds(issues))
+	}
+	fsckRepair(t, issues)
+
+	// 修复后文件与索引一致
+	if got := searchIndex(t, "notes", "direct"); strings.Join(got, ",") != "direct" {
+		t.Errorf("search repaired unindexed file = %v", got)
+	}
+	if got := searchIndex(t, "notes", "apple"); strings.Join(got, ",") != "hello" {
+		t.Errorf("search repaired missing index = %v", got)
+	}
+	report, err := reconcile(context.Background(), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Indexed != 0 || report.Removed != 0 || report.RemovedGroups != 0 {
+		t.Errorf("reconcile after repair = %s", report)
+	}
+}
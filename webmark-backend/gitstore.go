@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"webmark/storage"
+)
+
+// 每个用户的文档目录作为 git 版本库
+var GitEnabled = false
+
+// git 可执行文件
+var GitBinary = "git"
+
+// 同一用户的提交与推送串行执行
+var gitLocks sync.Map
+
+func gitLock(username string) *sync.Mutex {
+	mu, _ := gitLocks.LoadOrStore(username, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+// 用户版本库所在目录
+func gitDir(username string) string {
+	return filepath.Join(Store.(*storage.Local).Root, username)
+}
+
+// 执行 git 命令，author 不为空时作为提交者
+func gitRun(dir, author string, args ...string) ([]byte, error) {
+	cmd := exec.Command(GitBinary, args...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	if author != "" {
+		var email = author + "@webmark"
+		cmd.Env = append(cmd.Env,
+			"GIT_AUTHOR_NAME="+author, "GIT_AUTHOR_EMAIL="+email,
+			"GIT_COMMITTER_NAME="+author, "GIT_COMMITTER_EMAIL="+email)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			return out, fmt.Errorf("git %s: %w: %s", args[0], err, bytes.TrimSpace(ee.Stderr))
+		}
+		return out, fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return out, nil
+}
+
+// 用户目录不是版本库时初始化，已有文件作为第一次提交
+func gitInit(username string) error {
+	if !GitEnabled {
+		return nil
+	}
+	var dir = gitDir(username)
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return nil
+	}
+	mu := gitLock(username)
+	mu.Lock()
+	defer mu.Unlock()
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	slog.Info("git init repository", "user", username)
+	if _, err := gitRun(dir, "", "init", "-q", "-b", "main"); err != nil {
+		return err
+	}
+	// 推送时直接更新工作区，工作区有未提交的修改时拒绝推送
+	if _, err := gitRun(dir, "", "config", "receive.denyCurrentBranch", "updateInstead"); err != nil {
+		return err
+	}
+	// 忽略写入中的临时文件
+	if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte(".tmp-*\n"), 0644); err != nil {
+		return err
+	}
+	return gitCommitLocked(username, "import")
+}
+
+// 提交用户目录下的所有修改，没有修改时跳过
+func gitCommit(username, message string) {
+	if !GitEnabled {
+		return
+	}
+	if err := gitInit(username); err != nil {
+		slog.Error("git init failed", "user", username, "err", err)
+		return
+	}
+	mu := gitLock(username)
+	mu.Lock()
+	defer mu.Unlock()
+	if err := gitCommitLocked(username, message); err != nil {
+		slog.Error("git commit failed", "user", username, "err", err)
+	}
+}
+
+func gitCommitLocked(username, message string) error {
+	var dir = gitDir(username)
+	if _, err := gitRun(dir, "", "add", "-A"); err != nil {
+		return err
+	}
+	out, err := gitRun(dir, "", "status", "--porcelain")
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return nil
+	}
+	_, err = gitRun(dir, username, "commit", "-q", "-m", message)
+	return err
+}
+
+// 启动时为已有用户初始化版本库，并提交停机期间的修改
+func gitInitAll() {
+	users, err := Store.List("")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("git init failed", "err", err)
+		return
+	}
+	for _, user := range users {
+		if !user.IsDir || ignored(user.Name) {
+			continue
+		}
+		if err := gitInit(user.Name); err != nil {
+			slog.Error("git init failed", "user", user.Name, "err", err)
+			continue
+		}
+		gitCommit(user.Name, "sync")
+	}
+}
+
+// 推送后根据提交差异刷新索引，调用方持有 snapshotLock 读锁
+func gitIndexLocked(username, before, after string) {
+	if before == after {
+		return
+	}
+	var args = []string{"diff", "--name-status", "--no-renames", "-z", before, after}
+	if before == "" {
+		// 推送前还没有提交
+		args = []string{"show", "--pretty=format:", "--name-status", "--no-renames", "-z", after}
+	}
+	out, err := gitRun(gitDir(username), "", args...)
+	if err != nil {
+		slog.Error("git index failed", "user", username, "err", err)
+		return
+	}
+	var groups = make(map[string]struct{})
+	var fields = strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		var status, name = fields[i], fields[i+1]
+		parts := strings.Split(name, "/")
+		if len(parts) != 2 || ignored(parts[0]) || ignored(parts[1]) || !strings.HasSuffix(parts[1], ".md") {
+			continue
+		}
+		var group, title = parts[0], strings.TrimSuffix(parts[1], ".md")
+		groups[group] = struct{}{}
+		if status == "D" {
+			slog.Info("git remove index", "path", path.Join(username, name))
+			DeleteIndex(username, group, title)
+			continue
+		}
+		content, err := storage.ReadFile(Store, path.Join(username, name))
+		if err != nil {
+			slog.Error("git index failed", "user", username, "err", err)
+			continue
+		}
+		slog.Info("git refresh index", "path", path.Join(username, name))
+		group_check(username, group)
+		MakeIndex(username, group, title, string(content))
+	}
+	// 分组目录整个被删除
+	for group := range groups {
+		if _, err := Store.Stat(path.Join(username, group)); errors.Is(err, fs.ErrNotExist) {
+			slog.Info("git remove group", "path", path.Join(username, group))
+			if err := GDB.Docs.DeleteGroup(username, group); err != nil {
+				slog.Error("git index failed", "user", username, "err", err)
+			}
+		}
+	}
+}
+
+// 当前提交，还没有提交时为空
+func gitHead(username string) string {
+	out, err := gitRun(gitDir(username), "", "rev-parse", "-q", "--verify", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// git smart HTTP，使用登录密码或访问令牌(Basic 认证)，只能访问自己的版本库
+// /wmapi/git/username.git/...
+func git_http(w http.ResponseWriter, r *http.Request) {
+	if !GitEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	username, ok := basicAuth(w, r)
+	if !ok {
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/wmapi/git/")
+	repo, rest, _ := strings.Cut(rest, "/")
+	if strings.TrimSuffix(repo, ".git") != username {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	user_check(username)
+	if err := gitInit(username); err != nil {
+		slog.ErrorContext(r.Context(), "git init failed", "user", username, "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	bin, err := exec.LookPath(GitBinary)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "git binary not found", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	root, err := filepath.Abs(Store.(*storage.Local).Root)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// http-backend 会在 GIT_PROJECT_ROOT/用户名 下查找 .git
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = "/wmapi/git/" + username + "/" + rest
+	handler := &cgi.Handler{
+		Path: bin,
+		Root: "/wmapi/git",
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + root,
+			"GIT_HTTP_EXPORT_ALL=1",
+			"REMOTE_USER=" + username,
+		},
+	}
+	if rest != "git-receive-pack" {
+		handler.ServeHTTP(w, r2)
+		return
+	}
+	// 推送：与备份互斥，写入的文件与刷新的索引都在同一个快照里
+	// 先取 snapshotLock 再取版本库锁，与网页端、WebDAV 的加锁顺序一致
+	snapshotLock.RLock()
+	defer snapshotLock.RUnlock()
+	// 与网页端的提交互斥，完成后刷新变化的文档索引
+	mu := gitLock(username)
+	mu.Lock()
+	defer mu.Unlock()
+	var before = gitHead(username)
+	handler.ServeHTTP(w, r2)
+	gitIndexLocked(username, before, gitHead(username))
+}
@@ -3,11 +3,21 @@ module webmark
 go 1.22
 
 require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/fsnotify/fsnotify v1.8.0
+	github.com/go-asn1-ber/asn1-ber v1.5.5
 	github.com/go-ego/gse v0.80.2
-	golang.org/x/crypto v0.15.0
+	github.com/go-ldap/ldap/v3 v3.4.8
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.32
+	github.com/yuin/goldmark v1.8.2
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.23.0
 )
 
 require (
-	github.com/mattn/go-sqlite3 v1.14.32 // indirect
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/google/uuid v1.6.0 // indirect
 	github.com/vcaesar/cedar v0.20.1 // indirect
+	golang.org/x/sys v0.18.0 // indirect
 )
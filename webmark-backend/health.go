@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+	"webmark/repo"
+	"webmark/storage"
+)
+
+var startTime = time.Now()
+
+// 探针请求很频繁，不写访问日志
+var probePaths = map[string]bool{"/healthz": true, "/readyz": true}
+
+// 单项检查结果
+type readyCheck struct {
+	Status     string  `json:"status"` // ok 或 fail
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// 进程存活即返回 200，不检查依赖
+func healthz(w http.ResponseWriter, r *http.Request) {
+	apiJSON(w, http.StatusOK, map[string]any{
+		"status":         "ok",
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+	})
+}
+
+// 数据库、数据目录、全文索引、迁移都正常时返回 200，否则 503
+// 开始关闭后也返回 503，负载均衡可以提前摘除
+func readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+	var checks = map[string]*readyCheck{
+		"database":   runCheck(func() error { return GDB.PingContext(ctx) }),
+		"storage":    runCheck(checkStorage),
+		"fts":        runCheck(GDB.Docs.Ping),
+		"migrations": runCheck(checkMigrations),
+	}
+	var status, code = "ok", http.StatusOK
+	for _, c := range checks {
+		if c.Status != "ok" {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	if bgCtx.Err() != nil {
+		status, code = "shutting_down", http.StatusServiceUnavailable
+	}
+	apiJSON(w, code, map[string]any{"status": status, "checks": checks})
+}
+
+func runCheck(fn func() error) *readyCheck {
+	var start = time.Now()
+	var c = &readyCheck{Status: "ok"}
+	if err := fn(); err != nil {
+		c.Status, c.Error = "fail", err.Error()
+	}
+	c.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	return c
+}
+
+// 本地存储写入并删除一个临时文件，对象存储列出根目录
+func checkStorage() error {
+	local, ok := Store.(*storage.Local)
+	if !ok {
+		_, err := Store.List("")
+		return err
+	}
+	f, err := os.CreateTemp(local.Root, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString("ok")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// 只读查询当前版本，不像 MigrateStatus 那样建表
+func checkMigrations() error {
+	var current int
+	if err := GDB.QueryRow(`select coalesce(max(version), 0) from schema_version`).Scan(&current); err != nil {
+		return err
+	}
+	if latest := repo.LatestVersion(); current != latest {
+		return fmt.Errorf("database version %d, binary supports %d", current, latest)
+	}
+	return nil
+}
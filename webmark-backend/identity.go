@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"webmark/idp"
+	"webmark/repo"
+)
+
+// 登录时依次尝试的认证器，本地账户始终在第一位
+var Authenticators = []idp.PasswordAuthenticator{localAuthenticator{}}
+
+// OpenID Connect 登录，未配置时为 nil
+var OIDCProvider *idp.OIDC
+
+// 外部分组到角色的映射
+var RoleMapping = idp.RoleMap{}
+
+// OIDC 登录状态有效期
+const OIDCStateExpires = 10 * time.Minute
+
+// 记录登录状态的 cookie，回调时必须与 state 一致，防止把别人发起的登录带入当前浏览器
+const OIDCStateCookie = "oidc_state"
+
+// 本地账户，校验 user_info 中的密码
+type localAuthenticator struct{}
+
+func (localAuthenticator) Name() string {
+	return "local"
+}
+
+func (localAuthenticator) Authenticate(username, password string) (*idp.Identity, error) {
+	user, err := GDB.Users.Get(username)
+	if err != nil || user.Password == "" || !Verify(user.Password, password) {
+		return nil, idp.ErrInvalidCredentials
+	}
+	return &idp.Identity{Username: username, Source: "local"}, nil
+}
+
+// 用户名密码认证
+// 已存在的用户只能通过其来源的认证器登录，避免外部账户顶替同名本地账户
+func authenticate(username, password string) (*idp.Identity, error) {
+	user, err := GDB.Users.Get(username)
+	var exists = err == nil
+	for _, a := range Authenticators {
+		if exists && a.Name() != user.Source {
+			continue
+		}
+		id, err := a.Authenticate(username, password)
+		if err == nil {
+			return id, nil
+		}
+		if !errors.Is(err, idp.ErrInvalidCredentials) {
+			slog.Error("authenticate failed", "source", a.Name(), "err", err)
+		}
+	}
+	return nil, idp.ErrInvalidCredentials
+}
+
+// 用户名会作为目录名使用
+func validUsername(name string) bool {
+	return name != "" && name != "." && name != ".." && len(name) <= 100 &&
+		!strings.ContainsAny(name, "/\\") && strings.TrimSpace(name) == name
+}
+
+// 外部账户首次登录时自动创建用户，之后每次登录按分组刷新角色
+func provisionUser(id *idp.Identity) error {
+	if !validUsername(id.Username) {
+		return errors.New("invalid username")
+	}
+	var role = RoleMapping.Role(id.Groups, "user")
+	user, err := GDB.Users.Get(id.Username)
+	if err == nil {
+		if user.Source != id.Source {
+			return errors.New("user exists with source " + user.Source)
+		}
+		if err := GDB.Users.SetRole(id.Username, role); err != nil {
+			return err
+		}
+	} else if errors.Is(err, repo.ErrNotFound) {
+		// 外部账户不保存密码，本地密码登录会被拒绝
+		err = GDB.Users.Create(&repo.User{Username: id.Username, Source: id.Source, Role: role})
+		if err != nil {
+			return err
+		}
+		slog.Info("provision user", "user", id.Username, "source", id.Source, "role", role)
+	} else {
+		return err
+	}
+	user_check(id.Username)
+	return nil
+}
+
+// 是否管理员，root 始终是管理员
+func isAdmin(username string) bool {
+	if username == "root" {
+		return true
+	}
+	user, err := GDB.Users.Get(username)
+	return err == nil && user.Role == "admin"
+}
+
+// 清理过期的 OIDC 登录状态
+func oidcStateClear() {
+	err := GDB.Sessions.ExpireOIDCStates(time.Now().Unix())
+	if err != nil {
+		slog.Error("oidc state clear failed", "err", err)
+	}
+}
+
+// 跳转到身份源登录
+// /oidc-login
+func oidc_login(w http.ResponseWriter, r *http.Request) {
+	if OIDCProvider == nil {
+		ErrorResponseWithMsg(w, r, "未配置单点登录")
+		return
+	}
+	var state, nonce = Uuid(), Uuid()
+	err := GDB.Sessions.CreateOIDCState(state, nonce, time.Now().Add(OIDCStateExpires).Unix())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc state failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	u, err := OIDCProvider.AuthCodeURL(r.Context(), state, nonce)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc login failed", "err", err)
+		ErrorResponseWithMsg(w, r, "单点登录不可用")
+		return
+	}
+	setCookie(w, r, OIDCStateCookie, state, time.Now().Add(OIDCStateExpires), true)
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// 身份源回调，换取身份后创建会话并回到首页
+// 开启了两步验证的用户发放登录票据，回到登录页输入验证码
+// /oidc-callback
+func oidc_callback(w http.ResponseWriter, r *http.Request) {
+	if OIDCProvider == nil {
+		ErrorResponseWithMsg(w, r, "未配置单点登录")
+		return
+	}
+	var q = r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		slog.WarnContext(r.Context(), "oidc callback error", "error", e, "description", q.Get("error_description"))
+		ErrorResponseWithMsg(w, r, "单点登录失败")
+		return
+	}
+	var state = q.Get("state")
+	cookie, err := r.Cookie(OIDCStateCookie)
+	clearCookie(w, r, OIDCStateCookie, true)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		slog.WarnContext(r.Context(), "oidc state cookie mismatch")
+		ErrorResponseWithMsg(w, r, "登录已过期，请重新登录")
+		return
+	}
+	// state 只能使用一次
+	nonce, expire, err := GDB.Sessions.TakeOIDCState(state)
+	if errors.Is(err, repo.ErrNotFound) || (err == nil && expire < time.Now().Unix()) {
+		ErrorResponseWithMsg(w, r, "登录已过期，请重新登录")
+		return
+	}
+	if err != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	id, err := OIDCProvider.Exchange(r.Context(), q.Get("code"), nonce)
+	if err != nil {
+		slog.WarnContext(r.Context(), "oidc exchange failed", "err", err)
+		ErrorResponseWithMsg(w, r, "单点登录失败")
+		return
+	}
+	if err := provisionUser(id); err != nil {
+		slog.ErrorContext(r.Context(), "oidc provision failed", "user", id.Username, "err", err)
+		ErrorResponseWithMsg(w, r, "单点登录失败")
+		return
+	}
+	if totpEnabled(id.Username) {
+		ticket, err := newLoginTicket(id.Username)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "login ticket failed", "err", err)
+			ErrorResponse(w, r)
+			return
+		}
+		// 票据放在片段中，不会出现在访问日志与 Referer 里
+		http.Redirect(w, r, basePath("/login#ticket="+url.QueryEscape(ticket)), http.StatusFound)
+		return
+	}
+	if err := createSession(w, r, id.Username); err != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	http.Redirect(w, r, basePath("/"), http.StatusFound)
+}
@@ -0,0 +1,56 @@
+// 外部身份源：LDAP 与 OpenID Connect
+package idp
+
+import (
+	"errors"
+	"strings"
+)
+
+// 用户名或密码错误
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// 外部身份源认证通过后的用户信息
+type Identity struct {
+	Username string
+	Groups   []string
+	Source   string // 身份来源，如 ldap、oidc
+}
+
+// 用户名密码方式的认证器
+type PasswordAuthenticator interface {
+	// 认证器名称，同时作为用户来源记录
+	Name() string
+	// 认证用户，用户名或密码错误时返回 ErrInvalidCredentials
+	Authenticate(username, password string) (*Identity, error)
+}
+
+// 分组到角色的映射，格式 group=role,group2=role2
+type RoleMap map[string]string
+
+func ParseRoleMap(s string) RoleMap {
+	var m = make(RoleMap)
+	for _, pair := range strings.Split(s, ",") {
+		group, role, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || group == "" || role == "" {
+			continue
+		}
+		m[strings.ToLower(strings.TrimSpace(group))] = strings.TrimSpace(role)
+	}
+	return m
+}
+
+// 根据分组得到角色，命中多个时 admin 优先，未命中返回 def
+func (m RoleMap) Role(groups []string, def string) string {
+	var role = def
+	for _, g := range groups {
+		r, ok := m[strings.ToLower(g)]
+		if !ok {
+			continue
+		}
+		if r == "admin" {
+			return r
+		}
+		role = r
+	}
+	return role
+}
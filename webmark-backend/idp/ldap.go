@@ -0,0 +1,124 @@
+package idp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+type LDAPConfig struct {
+	URL          string // ldap://host:389 或 ldaps://host:636
+	StartTLS     bool   // ldap:// 连接后升级为 TLS
+	BindDN       string // 查询用户使用的服务账号，为空时匿名查询
+	BindPassword string
+	BaseDN       string // 用户查询的根节点
+	UserFilter   string // 用户过滤条件，%s 替换为转义后的用户名
+	GroupAttr    string // 用户条目上记录所属分组的属性
+}
+
+// LDAP 绑定认证
+type LDAP struct {
+	Config LDAPConfig
+}
+
+func NewLDAP(c LDAPConfig) *LDAP {
+	if c.UserFilter == "" {
+		c.UserFilter = "(uid=%s)"
+	}
+	if c.GroupAttr == "" {
+		c.GroupAttr = "memberOf"
+	}
+	return &LDAP{Config: c}
+}
+
+func (l *LDAP) Name() string {
+	return "ldap"
+}
+
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(l.Config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if l.Config.StartTLS {
+		host := strings.TrimPrefix(l.Config.URL, "ldap://")
+		host, _, _ = strings.Cut(host, ":")
+		if err := conn.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// 先用服务账号查到用户DN，再用用户DN和密码绑定
+func (l *LDAP) Authenticate(username, password string) (*Identity, error) {
+	// 空密码绑定在LDAP中是匿名绑定，必须拒绝
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return nil, fmt.Errorf("ldap dial: %w", err)
+	}
+	defer conn.Close()
+
+	if l.Config.BindDN != "" {
+		if err := conn.Bind(l.Config.BindDN, l.Config.BindPassword); err != nil {
+			return nil, fmt.Errorf("ldap service bind: %w", err)
+		}
+	}
+	req := ldap.NewSearchRequest(
+		l.Config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
+		fmt.Sprintf(l.Config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{"dn", l.Config.GroupAttr}, nil,
+	)
+	res, err := conn.Search(req)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("ldap search: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := res.Entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("ldap bind: %w", err)
+	}
+	var groups = make([]string, 0)
+	for _, g := range entry.GetAttributeValues(l.Config.GroupAttr) {
+		groups = append(groups, groupName(g))
+	}
+	return &Identity{Username: username, Groups: groups, Source: l.Name()}, nil
+}
+
+// 分组DN取第一段的值，如 cn=admins,ou=groups,dc=example 得到 admins
+func groupName(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return dn
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
+
+// 检查配置
+func (c LDAPConfig) Validate() error {
+	if !strings.HasPrefix(c.URL, "ldap://") && !strings.HasPrefix(c.URL, "ldaps://") {
+		return errors.New("ldap url must start with ldap:// or ldaps://")
+	}
+	if c.BaseDN == "" {
+		return errors.New("ldap base dn is required")
+	}
+	if c.UserFilter != "" && strings.Count(c.UserFilter, "%s") != 1 {
+		return errors.New("ldap user filter must contain one %s")
+	}
+	return nil
+}
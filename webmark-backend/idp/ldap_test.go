@@ -0,0 +1,188 @@
+package idp
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	testServiceDN = "cn=svc,dc=example,dc=org"
+	testAliceDN   = "uid=alice,ou=people,dc=example,dc=org"
+)
+
+// 测试用的 LDAP 服务，只实现绑定与按 uid 的等值查询
+type testDirectory struct {
+	ln        net.Listener
+	passwords map[string]string   // dn -> 密码
+	entries   map[string]string   // uid -> dn
+	groups    map[string][]string // dn -> memberOf
+
+	mu    sync.Mutex
+	binds []string // 收到的绑定 dn
+}
+
+func newTestDirectory(t *testing.T) *testDirectory {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &testDirectory{
+		ln:        ln,
+		passwords: map[string]string{testServiceDN: "svc-secret", testAliceDN: "alice-secret"},
+		entries:   map[string]string{"alice": testAliceDN},
+		groups:    map[string][]string{testAliceDN: {"cn=admins,ou=groups,dc=example,dc=org", "cn=staff,ou=groups,dc=example,dc=org"}},
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+func (d *testDirectory) url() string {
+	return "ldap://" + d.ln.Addr().String()
+}
+
+func (d *testDirectory) bound() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.binds...)
+}
+
+func (d *testDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id, _ := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			d.mu.Lock()
+			d.binds = append(d.binds, dn)
+			d.mu.Unlock()
+			code := ldap.LDAPResultSuccess
+			if want, ok := d.passwords[dn]; !ok || want != password {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			conn.Write(ldapMessage(id, ldapResult(ldap.ApplicationBindResponse, code)))
+		case ldap.ApplicationSearchRequest:
+			filter := op.Children[6]
+			if filter.Tag == ldap.FilterEqualityMatch && filter.Children[0].Data.String() == "uid" {
+				if dn, ok := d.entries[filter.Children[1].Data.String()]; ok {
+					conn.Write(ldapMessage(id, d.entry(dn)))
+				}
+			}
+			conn.Write(ldapMessage(id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)))
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func (d *testDirectory) entry(dn string) *ber.Packet {
+	e := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	e.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+	attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "memberOf", "Type"))
+	vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+	for _, g := range d.groups[dn] {
+		vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, g, "Value"))
+	}
+	attr.AppendChild(vals)
+	attrs.AppendChild(attr)
+	e.AppendChild(attrs)
+	return e
+}
+
+func ldapMessage(id int64, op *ber.Packet) []byte {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	p.AppendChild(op)
+	return p.Bytes()
+}
+
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return op
+}
+
+func testLDAP(d *testDirectory, bindPassword string) *LDAP {
+	return NewLDAP(LDAPConfig{URL: d.url(), BindDN: testServiceDN, BindPassword: bindPassword, BaseDN: "dc=example,dc=org"})
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	d := newTestDirectory(t)
+	id, err := testLDAP(d, "svc-secret").Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if id.Username != "alice" || id.Source != "ldap" || strings.Join(id.Groups, ",") != "admins,staff" {
+		t.Fatalf("identity = %+v", id)
+	}
+	if got := strings.Join(d.bound(), ";"); got != testServiceDN+";"+testAliceDN {
+		t.Fatalf("binds = %s", got)
+	}
+}
+
+func TestLDAPAuthenticateRejected(t *testing.T) {
+	for _, tt := range []struct {
+		name, username, password string
+	}{
+		{"wrong password", "alice", "wrong"},
+		{"unknown user", "bob", "alice-secret"},
+		{"filter injection", "*", "alice-secret"},
+		{"empty password", "alice", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDirectory(t)
+			_, err := testLDAP(d, "svc-secret").Authenticate(tt.username, tt.password)
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("err = %v, want ErrInvalidCredentials", err)
+			}
+			for _, dn := range d.bound() {
+				if dn != testServiceDN && tt.password == "" {
+					t.Fatalf("empty password bound as %s", dn)
+				}
+			}
+		})
+	}
+}
+
+func TestLDAPServiceBindFailed(t *testing.T) {
+	d := newTestDirectory(t)
+	_, err := testLDAP(d, "wrong").Authenticate("alice", "alice-secret")
+	if err == nil || errors.Is(err, ErrInvalidCredentials) || !strings.Contains(err.Error(), "service bind") {
+		t.Fatalf("err = %v, want service bind error", err)
+	}
+}
+
+func TestGroupName(t *testing.T) {
+	if got := groupName("cn=admins,ou=groups,dc=example,dc=org"); got != "admins" {
+		t.Fatalf("groupName = %s", got)
+	}
+	if got := groupName("not a dn"); got != "not a dn" {
+		t.Fatalf("groupName = %s", got)
+	}
+}
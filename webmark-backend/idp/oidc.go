@@ -0,0 +1,337 @@
+package idp
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type OIDCConfig struct {
+	Issuer        string // 发行方地址，用于获取 /.well-known/openid-configuration
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string   // 回调地址，需指向 /wmapi/oidc-callback
+	Scopes        []string // 默认 openid profile email
+	UsernameClaim string   // 用户名字段，默认 preferred_username
+	GroupsClaim   string   // 分组字段，默认 groups
+}
+
+// 检查配置
+func (c OIDCConfig) Validate() error {
+	if c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+		return errors.New("oidc issuer, client id and redirect url are required")
+	}
+	if _, err := url.Parse(c.RedirectURL); err != nil {
+		return fmt.Errorf("oidc redirect url: %w", err)
+	}
+	return nil
+}
+
+// OpenID Connect 授权码登录
+type OIDC struct {
+	Config OIDCConfig
+	Client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	keysAt    time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+func NewOIDC(c OIDCConfig) *OIDC {
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "profile", "email"}
+	}
+	if c.UsernameClaim == "" {
+		c.UsernameClaim = "preferred_username"
+	}
+	if c.GroupsClaim == "" {
+		c.GroupsClaim = "groups"
+	}
+	return &OIDC{Config: c, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (o *OIDC) Name() string {
+	return "oidc"
+}
+
+func (o *OIDC) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := o.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", u, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+// 懒加载发现文档，身份源暂时不可用时不影响服务启动
+func (o *OIDC) discover(ctx context.Context) (*oidcDiscovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+	var d oidcDiscovery
+	u := strings.TrimSuffix(o.Config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := o.getJSON(ctx, u, &d); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if d.Issuer != o.Config.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer mismatch %s", d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksURI == "" {
+		return nil, errors.New("oidc discovery: missing endpoints")
+	}
+	o.discovery = &d
+	return o.discovery, nil
+}
+
+// 跳转到身份源的授权地址
+func (o *OIDC) AuthCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	d, err := o.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", o.Config.ClientID)
+	v.Set("redirect_uri", o.Config.RedirectURL)
+	v.Set("scope", strings.Join(o.Config.Scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// 用授权码换取并校验 ID Token
+func (o *OIDC) Exchange(ctx context.Context, code, nonce string) (*Identity, error) {
+	d, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.Config.RedirectURL)
+	req, err := http.NewRequestWithContext(ctx, "POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.Config.ClientID), url.QueryEscape(o.Config.ClientSecret))
+	res, err := o.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc token: %w", err)
+	}
+	defer res.Body.Close()
+	var tr struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("oidc token: %w", err)
+	}
+	if res.StatusCode != http.StatusOK || tr.IDToken == "" {
+		return nil, fmt.Errorf("oidc token: %s %s", res.Status, tr.Error)
+	}
+	claims, err := o.verify(ctx, tr.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("oidc: nonce mismatch")
+	}
+	username, _ := claims[o.Config.UsernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("oidc: claim %s missing", o.Config.UsernameClaim)
+	}
+	var groups = make([]string, 0)
+	switch g := claims[o.Config.GroupsClaim].(type) {
+	case string:
+		groups = append(groups, g)
+	case []any:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	return &Identity{Username: username, Groups: groups, Source: o.Name()}, nil
+}
+
+// 校验 JWT 签名和标准声明
+func (o *OIDC) verify(ctx context.Context, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(hb, &header) != nil {
+		return nil, errors.New("oidc: malformed id token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("oidc: malformed id token signature")
+	}
+	key, err := o.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch header.Alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig) != nil {
+			return nil, errors.New("oidc: bad id token signature")
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return nil, errors.New("oidc: bad id token signature")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, h[:], r, s) {
+			return nil, errors.New("oidc: bad id token signature")
+		}
+	default:
+		return nil, fmt.Errorf("oidc: unsupported alg %s", header.Alg)
+	}
+
+	pb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("oidc: malformed id token payload")
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(pb, &claims); err != nil {
+		return nil, errors.New("oidc: malformed id token payload")
+	}
+	if iss, _ := claims["iss"].(string); iss != o.Config.Issuer {
+		return nil, errors.New("oidc: issuer mismatch")
+	}
+	var audOk bool
+	switch aud := claims["aud"].(type) {
+	case string:
+		audOk = aud == o.Config.ClientID
+	case []any:
+		for _, a := range aud {
+			if a == o.Config.ClientID {
+				audOk = true
+			}
+		}
+	}
+	// 有授权方时必须是本应用
+	if azp, ok := claims["azp"].(string); ok && azp != o.Config.ClientID {
+		audOk = false
+	}
+	if !audOk {
+		return nil, errors.New("oidc: audience mismatch")
+	}
+	// 允许一分钟时钟偏差
+	now := float64(time.Now().Unix())
+	exp, _ := claims["exp"].(float64)
+	if exp+60 < now {
+		return nil, errors.New("oidc: id token expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && iat-60 > now {
+		return nil, errors.New("oidc: id token issued in the future")
+	}
+	return claims, nil
+}
+
+// 取签名公钥，遇到未知 kid 时刷新 JWKS(最多每分钟一次)
+func (o *OIDC) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	d, err := o.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if k, ok := o.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(o.keysAt) < time.Minute && o.keys != nil {
+		return nil, fmt.Errorf("oidc: unknown key %s", kid)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(ctx, d.JwksURI, &jwks); err != nil {
+		return nil, fmt.Errorf("oidc jwks: %w", err)
+	}
+	o.keys = make(map[string]crypto.PublicKey)
+	o.keysAt = time.Now()
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil || len(e) > 4 {
+				continue
+			}
+			o.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil || k.Crv != "P-256" {
+				continue
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				continue
+			}
+			o.keys[k.Kid] = pub
+		}
+	}
+	if k, ok := o.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("oidc: unknown key %s", kid)
+}
@@ -0,0 +1,205 @@
+package idp
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testClientID = "webmark"
+
+// 测试用的身份源：发现文档、JWKS 与令牌端点
+type testIssuer struct {
+	srv    *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+	token  string // 令牌端点返回的 id_token
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := &testIssuer{rsaKey: rsaKey, ecKey: ecKey}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 is.srv.URL,
+			"authorization_endpoint": is.srv.URL + "/authorize",
+			"token_endpoint":         is.srv.URL + "/token",
+			"jwks_uri":               is.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		enc := base64.RawURLEncoding
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": enc.EncodeToString(rsaKey.N.Bytes()), "e": enc.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": enc.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))), "y": enc.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": enc.EncodeToString(rsaKey.N.Bytes()), "e": "AQAB"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != testClientID || secret != "secret" || r.FormValue("code") != "good-code" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": is.token})
+	})
+	is.srv = httptest.NewServer(mux)
+	t.Cleanup(is.srv.Close)
+	return is
+}
+
+func (is *testIssuer) provider() *OIDC {
+	return NewOIDC(OIDCConfig{Issuer: is.srv.URL, ClientID: testClientID, ClientSecret: "secret", RedirectURL: "https://notes.example.com/wmapi/oidc-callback"})
+}
+
+func (is *testIssuer) claims(nonce string) map[string]any {
+	now := time.Now().Unix()
+	return map[string]any{
+		"iss":                is.srv.URL,
+		"aud":                testClientID,
+		"sub":                "1001",
+		"nonce":              nonce,
+		"iat":                now,
+		"exp":                now + 300,
+		"preferred_username": "alice",
+		"groups":             []string{"admins", "staff"},
+	}
+}
+
+// 签发 JWT，key 为 nil 时不签名
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	enc := base64.RawURLEncoding
+	hb, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	pb, _ := json.Marshal(claims)
+	signing := enc.EncodeToString(hb) + "." + enc.EncodeToString(pb)
+	if key == nil {
+		return signing + "."
+	}
+	h := sha256.Sum256([]byte(signing))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signing + "." + enc.EncodeToString(sig)
+}
+
+func TestOIDCExchange(t *testing.T) {
+	is := newTestIssuer(t)
+	for _, tt := range []struct {
+		alg, kid string
+		key      crypto.Signer
+	}{
+		{"RS256", "rsa", is.rsaKey},
+		{"ES256", "ec", is.ecKey},
+	} {
+		t.Run(tt.alg, func(t *testing.T) {
+			is.token = signJWT(t, tt.alg, tt.kid, tt.key, is.claims("n-1"))
+			id, err := is.provider().Exchange(context.Background(), "good-code", "n-1")
+			if err != nil {
+				t.Fatalf("Exchange: %v", err)
+			}
+			if id.Username != "alice" || id.Source != "oidc" || strings.Join(id.Groups, ",") != "admins,staff" {
+				t.Fatalf("identity = %+v", id)
+			}
+		})
+	}
+}
+
+func TestOIDCExchangeRejected(t *testing.T) {
+	is := newTestIssuer(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(k string, v any) map[string]any {
+		c := is.claims("n-1")
+		c[k] = v
+		return c
+	}
+	tests := []struct {
+		name  string
+		token string
+		code  string
+		want  string
+	}{
+		{"bad code", signJWT(t, "RS256", "rsa", is.rsaKey, is.claims("n-1")), "bad-code", "invalid_grant"},
+		{"nonce mismatch", signJWT(t, "RS256", "rsa", is.rsaKey, is.claims("n-2")), "good-code", "nonce mismatch"},
+		{"issuer mismatch", signJWT(t, "RS256", "rsa", is.rsaKey, with("iss", "https://evil.example.com")), "good-code", "issuer mismatch"},
+		{"audience mismatch", signJWT(t, "RS256", "rsa", is.rsaKey, with("aud", "other")), "good-code", "audience mismatch"},
+		{"azp mismatch", signJWT(t, "RS256", "rsa", is.rsaKey, with("azp", "other")), "good-code", "audience mismatch"},
+		{"expired", signJWT(t, "RS256", "rsa", is.rsaKey, with("exp", time.Now().Add(-time.Hour).Unix())), "good-code", "expired"},
+		{"issued in the future", signJWT(t, "RS256", "rsa", is.rsaKey, with("iat", time.Now().Add(time.Hour).Unix())), "good-code", "future"},
+		{"missing username", signJWT(t, "RS256", "rsa", is.rsaKey, with("preferred_username", "")), "good-code", "claim preferred_username missing"},
+		{"wrong key", signJWT(t, "RS256", "rsa", otherKey, is.claims("n-1")), "good-code", "bad id token signature"},
+		{"key type mismatch", signJWT(t, "ES256", "rsa", is.ecKey, is.claims("n-1")), "good-code", "bad id token signature"},
+		{"unknown kid", signJWT(t, "RS256", "other", is.rsaKey, is.claims("n-1")), "good-code", "unknown key"},
+		{"encryption key", signJWT(t, "RS256", "enc", is.rsaKey, is.claims("n-1")), "good-code", "unknown key"},
+		{"alg none", signJWT(t, "none", "rsa", nil, is.claims("n-1")), "good-code", "unsupported alg"},
+		{"malformed", "not-a-jwt", "good-code", "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is.token = tt.token
+			// 每次新建，避免未知 kid 的刷新间隔影响后续用例
+			_, err := is.provider().Exchange(context.Background(), tt.code, "n-1")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCAuthCodeURL(t *testing.T) {
+	is := newTestIssuer(t)
+	u, err := is.provider().AuthCodeURL(context.Background(), "s-1", "n-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{is.srv.URL + "/authorize?", "state=s-1", "nonce=n-1", "client_id=webmark", "response_type=code"} {
+		if !strings.Contains(u, want) {
+			t.Errorf("%s does not contain %s", u, want)
+		}
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	is := newTestIssuer(t)
+	o := NewOIDC(OIDCConfig{Issuer: is.srv.URL + "/", ClientID: testClientID, RedirectURL: "https://notes.example.com/cb"})
+	if _, err := o.AuthCodeURL(context.Background(), "s", "n"); err == nil || !strings.Contains(err.Error(), "issuer mismatch") {
+		t.Fatalf("err = %v", err)
+	}
+}
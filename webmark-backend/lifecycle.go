@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 关闭时等待请求和后台任务结束的最长时间
+var ShutdownTimeout = 30 * time.Second
+
+// 后台任务(定时任务、索引)共用的上下文，收到退出信号后取消
+var bgCtx, bgCancel = context.WithCancel(context.Background())
+var bgMu sync.Mutex
+var bgWG sync.WaitGroup
+
+// 启动后台任务，关闭时会等待其结束
+// 已经开始关闭时返回 false
+func goBackground(fn func(ctx context.Context)) bool {
+	bgMu.Lock()
+	defer bgMu.Unlock()
+	if bgCtx.Err() != nil {
+		return false
+	}
+	bgWG.Add(1)
+	go func() {
+		defer bgWG.Done()
+		fn(bgCtx)
+	}()
+	return true
+}
+
+// 通知后台任务退出并等待，超时后放弃等待
+func stopBackground(ctx context.Context) error {
+	bgMu.Lock()
+	bgCancel()
+	bgMu.Unlock()
+	var done = make(chan struct{})
+	go func() {
+		bgWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 合并 WAL 后关闭数据库
+func closeDB() {
+	if GDB == nil {
+		return
+	}
+	if err := GDB.Checkpoint(); err != nil {
+		slog.Error("wal checkpoint failed", "err", err)
+	}
+	if err := GDB.Close(); err != nil {
+		slog.Error("close db failed", "err", err)
+	}
+}
+
+// 启动服务，收到 SIGINT/SIGTERM 后停止接收新请求，
+// 等待处理中的请求和后台任务结束，最后关闭数据库
+// 等待超时时仍有请求或任务在写库，不关闭数据库直接退出，由下次启动恢复 WAL
+// server 设置了 TLSConfig 时使用 HTTPS；redirect 不为空时同时监听 HTTP 跳转
+func serve(server, redirect *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	var errc = make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			errc <- server.ListenAndServeTLS("", "")
+			return
+		}
+		errc <- server.ListenAndServe()
+	}()
+	if redirect != nil {
+		go func() {
+			if err := redirect.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("redirect listener failed", "addr", redirect.Addr, "err", err)
+			}
+		}()
+	}
+	select {
+	case err := <-errc:
+		stopBackground(context.Background())
+		closeDB()
+		return err
+	case <-ctx.Done():
+	}
+	// 再次收到信号时直接退出
+	stop()
+	slog.Info("shutdown signal received, shutting down")
+	sctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if redirect != nil {
+		redirect.Close()
+	}
+	var drained = true
+	if err := server.Shutdown(sctx); err != nil {
+		slog.Error("http shutdown failed", "err", err)
+		drained = false
+	}
+	if err := stopBackground(sctx); err != nil {
+		slog.Error("background shutdown failed", "err", err)
+		drained = false
+	}
+	if !drained {
+		slog.Error("shutdown timed out, exiting without closing database", "timeout", ShutdownTimeout)
+		return errors.New("shutdown timed out")
+	}
+	closeDB()
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	slog.Info("shutdown complete")
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"webmark/config"
+)
+
+// 访问日志，每个请求一行
+var AccessLog = false
+
+// 请求ID的请求头与响应头
+const requestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// 请求ID，没有时为空
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// 日志中出现这些字段时只输出占位符
+var redactKeys = map[string]bool{
+	"password":      true,
+	"session_id":    true,
+	"token":         true,
+	"ticket":        true,
+	"secret":        true,
+	"code":          true,
+	"cookie":        true,
+	"authorization": true,
+	"csrf_token":    true,
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if redactKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	return a
+}
+
+// 带上 context 中的请求ID
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		rec.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// 按配置设置默认日志，log 包的输出也会转到这里
+func setupLogging(c config.Log) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return fmt.Errorf("log.level: %w", err)
+	}
+	var opts = &slog.HandlerOptions{Level: level, ReplaceAttr: redact, AddSource: level <= slog.LevelDebug}
+	var h slog.Handler
+	switch c.Format {
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		h = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	AccessLog = c.Access
+	return nil
+}
+
+// 客户端传入的请求ID只接受较短的可见字符，否则重新生成
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b = make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 为每个请求分配ID，写入响应头与日志，并输出访问日志
+func request_log(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start = time.Now()
+		// 处理函数可能改写 URL，先记下原始路径
+		var path = r.URL.Path
+		var id = r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if !AccessLog || probePaths[strings.TrimPrefix(path, BasePath)] {
+			return
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		slog.LogAttrs(ctx, slog.LevelInfo, "access",
+			slog.String("method", r.Method),
+			slog.String("path", path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote", clientIP(r)),
+			slog.String("user_agent", r.UserAgent()),
+		)
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"archive/zip"
+	"context"
 	"crypto/rand"
 	"embed"
 	"encoding/json"
@@ -11,32 +12,48 @@ import (
 	"io"
 	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
+	"path"
 	"strings"
 	"time"
-	"webmark/utils"
-
-	"database/sql"
+	"webmark/config"
+	"webmark/idp"
+	"webmark/repo"
+	"webmark/storage"
 
 	"github.com/go-ego/gse"
-	_ "github.com/mattn/go-sqlite3" // 只注册驱动
 	"golang.org/x/crypto/bcrypt"
 )
 
 // 数据目录
 var DATA_DIR = "markdown"
 
+// 文档与附件存储，默认为 DATA_DIR 下的本地文件
+var Store storage.Storage = storage.NewLocal(DATA_DIR)
+
 // 会话持久化保存目录
 var SESSIONS_DIR = "sessions"
 
 // 会话过期时间默认一个月
 var SessionExpires = 30 * 24 * time.Hour
 
+// 会话闲置超时，超过该时间未使用需重新登录
+var SessionIdleTimeout = 7 * 24 * time.Hour
+
 // 数据库连接
-var GDB *sql.DB
+var GDB *repo.DB
+
+// 生效的配置
+var Conf = config.Default()
+
+// 登录失败超过该次数后锁定
+var LoginMaxFailures = 3
+
+// 定时任务间隔
+var JobInterval = 1 * time.Hour
 
 var trim = "\"\n\t `1234567890|～~!@#$%^&*()_-+=,.<>/?':;；：[]{}\\！，￥…（）—《》。？【】、”“"
 
@@ -99,62 +116,37 @@ type LoginRecord struct {
 	Count    int   // 尝试次数
 }
 
-// 一天超时清理
-const loginRecordTimeOut = 60 * 60 * 24
+// 锁定时长，默认一天后清理
+var LoginLockout = 24 * time.Hour
 
-// const loginRecordTimeOut = 30
+// 是否因多次登录失败被锁定
+func loginLocked(username string) bool {
+	count, err := GDB.Users.Failures(username)
+	return err == nil && count > LoginMaxFailures
+}
 
 func loginErr(username string) {
 	//认证失败
-	var last_time, login_count int64
-	err := GDB.QueryRow(`select last_time, login_count from login_record where username = ?`, username).Scan(&last_time, &login_count)
-	if err != nil || login_count == 0 {
-		// 插入
-		_, err := GDB.Exec(`insert into login_record(username, last_time, login_count) values (?, ?, ?)`, username, time.Now().Unix(), 1)
-		if err != nil {
-			log.Println(err)
-		}
+	loginFailures.Inc()
+	count, err := GDB.Users.RecordFailure(username, time.Now().Unix())
+	if err != nil {
+		slog.Error("login record failed", "err", err)
 		return
-	} else {
-		login_count += 1
-		_, err = GDB.Exec(`update login_record set last_time = ?, login_count = ? where username = ?`, time.Now().Unix(), login_count, username)
-		if err != nil {
-			log.Println(err)
-		}
+	}
+	if count == LoginMaxFailures+1 {
+		loginLockouts.Inc()
 	}
 }
 
 // 登录记录清除
 func loginRecordClear() {
-
-	rows, err := GDB.Query(`select username, last_time, login_count from login_record`)
+	names, err := GDB.Users.ClearLockouts(LoginMaxFailures, time.Now().Add(-LoginLockout).Unix())
 	if err != nil {
+		slog.Error("login record clear failed", "err", err)
 		return
 	}
-
-	defer rows.Close()
-
-	var deletes = make([]string, 0)
-
-	for rows.Next() {
-		var username string
-		var last_time int64
-		var login_count int
-		err := rows.Scan(&username, &last_time, &login_count)
-		if err != nil {
-			continue
-		}
-		if login_count > 3 && time.Now().Unix()-last_time > loginRecordTimeOut {
-			// 删除
-			deletes = append(deletes, username)
-		}
-	}
-	for _, username := range deletes {
-		log.Println("delete", username)
-		_, err = GDB.Exec(`delete from login_record where username = ?`, username)
-		if err != nil {
-			log.Println(err)
-		}
+	for _, username := range names {
+		slog.Info("login record cleared", "user", username)
 	}
 }
 
@@ -171,67 +163,90 @@ func login(w http.ResponseWriter, r *http.Request) {
 			ErrorResponse(w, r)
 			return
 		}
-		// 假设认证通过
 		username := ul.Username
-		var password string
-		err := GDB.QueryRow(`select password from user_info where username = ?`, username).Scan(&password)
+		// 验证用户是不是在恶意尝试
+		if loginLocked(username) {
+			ErrorResponseWithMsg(w, r, "fack off")
+			return
+		}
+		id, err := authenticate(username, ul.Password)
 		if err != nil {
-			// 用户不存在
+			// 用户不存在或密码错误
 			loginErr(username)
 			ErrorResponse(w, r)
 			return
 		}
-		if password == "" {
-			// 用户不存在
-			loginErr(username)
-			ErrorResponse(w, r)
-		} else {
-			// 验证用户是不是在恶意尝试
-			var last_time int64
-			var login_count int
-			err := GDB.QueryRow(`select last_time, login_count from login_record where username = ?`, username).Scan(&last_time, &login_count)
-			if err == nil && login_count > 3 {
-				ErrorResponseWithMsg(w, r, "fack off")
+		// 认证通过
+		if id.Source != "local" {
+			// 外部账户即时创建
+			if err := provisionUser(id); err != nil {
+				slog.ErrorContext(r.Context(), "provision user failed", "user", username, "err", err)
+				ErrorResponse(w, r)
 				return
 			}
-			if Verify(password, ul.Password) {
-				// 认证通过
-				var session_id = Uuid()
-				// 会话过期时间
-				var expires = time.Now().Add(SessionExpires)
-
-				_, err := GDB.Exec(`insert into session_info(session_id, username, expire) values (?, ?, ?)`, session_id, username, expires.Unix())
-				if err != nil {
-					ErrorResponse(w, r)
-					return
-				}
-				cookie_session_id := http.Cookie{Name: "session_id", Value: session_id, Expires: expires, Path: "/"}
-				http.SetCookie(w, &cookie_session_id)
-				cookie_username := http.Cookie{Name: "username", Value: username, Expires: expires, Path: "/"}
-				http.SetCookie(w, &cookie_username)
-				SuccessResponse(w, r, "success")
-			} else {
-				loginErr(username)
+		}
+		if totpEnabled(username) {
+			// 开启了两步验证，先发放登录票据，验证码通过后再创建会话
+			ticket, err := newLoginTicket(username)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "login ticket failed", "err", err)
 				ErrorResponse(w, r)
+				return
 			}
+			SuccessResponse(w, r, map[string]any{"totp": true, "ticket": ticket})
+			return
 		}
+		if err := createSession(w, r, username); err != nil {
+			ErrorResponse(w, r)
+			return
+		}
+		SuccessResponse(w, r, "success")
 
 	} else {
 		ErrorResponse(w, r)
 	}
 }
 
+// 创建会话并写入cookie
+// 数据库只保存会话ID的哈希，数据库泄露也无法冒用登录
+func createSession(w http.ResponseWriter, r *http.Request, username string) error {
+	var session_id = Uuid()
+	// 会话过期时间
+	var now = time.Now()
+	var expires = now.Add(SessionExpires)
+
+	err := GDB.Sessions.Create(&repo.Session{
+		ID:        hashSessionId(session_id),
+		Username:  username,
+		Expire:    expires.Unix(),
+		CreateAt:  now.Unix(),
+		LastSeen:  now.Unix(),
+		IP:        clientIP(r),
+		UserAgent: truncate(r.UserAgent(), 255),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "create session failed", "err", err)
+		return err
+	}
+	setCookie(w, r, "session_id", session_id, expires, true)
+	setCookie(w, r, "username", username, expires, false)
+	setCookie(w, r, CsrfCookieName, Uuid(), expires, false)
+	return nil
+}
+
 // 登出
 func logout(w http.ResponseWriter, r *http.Request) {
 	var suc, session = Auth(w, r)
 	if !suc {
 		return
 	}
-	_, err := GDB.Exec(`delete from session_info where session_id = ?`, session.SessionId)
-	if err != nil {
+	if err := GDB.Sessions.Delete(session.SessionId); err != nil {
 		ErrorResponse(w, r)
 		return
 	}
+	clearCookie(w, r, "session_id", true)
+	clearCookie(w, r, "username", false)
+	clearCookie(w, r, CsrfCookieName, false)
 	SuccessResponse(w, r, "logout")
 }
 
@@ -247,38 +262,14 @@ func group_list(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := GDB.Query(`select groupname from docs_group where username = ? order by create_at desc`, session.Name)
+	groups, err := GDB.Groups.List(session.Name)
 	if err != nil {
 		ErrorResponse(w, r)
 		return
 	}
-	defer rows.Close()
-	var res = make([]*GroupInfo, 0)
-	for rows.Next() {
-		var g GroupInfo
-		err := rows.Scan(&g.Groupname)
-		if err != nil {
-			continue
-		}
-		res = append(res, &g)
-	}
-	grows, err := GDB.Query(`select groupname, count(1) as gcount from docs_info where username = ? group by groupname`, session.Name)
-	if err != nil {
-		ErrorResponse(w, r)
-		return
-	}
-	defer grows.Close()
-	for grows.Next() {
-		var g GroupInfo
-		err := grows.Scan(&g.Groupname, &g.Gcount)
-		if err != nil {
-			continue
-		}
-		for i, v := range res {
-			if v.Groupname == g.Groupname {
-				res[i].Gcount = g.Gcount
-			}
-		}
+	var res = make([]*GroupInfo, 0, len(groups))
+	for _, g := range groups {
+		res = append(res, &GroupInfo{Groupname: g.Name, Gcount: g.Docs})
 	}
 	SuccessResponse(w, r, res)
 }
@@ -337,35 +328,38 @@ func user_password_update(w http.ResponseWriter, r *http.Request) {
 	var oldp = cp.Old
 	var newp = cp.New
 
-	var passwd string
-	err := GDB.QueryRow(`select password from user_info where username = ?`, session.Name).Scan(&passwd)
+	user, err := GDB.Users.Get(session.Name)
 	if err != nil {
-		log.Println("select user error", err)
+		slog.ErrorContext(r.Context(), "select user failed", "err", err)
 		ErrorResponse(w, r)
 		return
 	}
-	if Verify(passwd, oldp) {
-		passwd = Genpass(newp)
-		_, err := GDB.Exec(`update user_info set password = ? where username = ?`, passwd, session.Name)
+	if Verify(user.Password, oldp) {
+		err := GDB.Users.SetPassword(session.Name, Genpass(newp))
 		if err != nil {
-			log.Println("update user error", err)
+			slog.ErrorContext(r.Context(), "update user failed", "err", err)
 			ErrorResponse(w, r)
 			return
 		}
+		// 修改密码后其他设备全部下线
+		err = GDB.Sessions.DeleteUser(session.Name, session.SessionId)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "revoke sessions failed", "err", err)
+		}
 		SuccessResponse(w, r, true)
 	} else {
 		ErrorResponse(w, r)
 	}
 }
 
-// 添加用户，仅root账户可以
+// 添加用户，仅管理员可以
 // /new_user
 func new_user(w http.ResponseWriter, r *http.Request) {
 	var suc, session = Auth(w, r)
 	if !suc {
 		return
 	}
-	if session.Name != "root" {
+	if !isAdmin(session.Name) {
 		return
 	}
 	if r.Method != "POST" {
@@ -395,30 +389,22 @@ func new_markdown(w http.ResponseWriter, r *http.Request) {
 	parts := GetPathList(r.URL.Path, "/wmapi/new-markdown/")
 	var groupname = parts[0]
 	var markdownname = parts[1]
-	group_check(session.Name, groupname)
-	var fname = DATA_DIR + "/" + session.Name + "/" + groupname + "/" + markdownname + ".md"
-	_, err := os.Stat(fname)
-	// 检查错误类型
-	if !os.IsNotExist(err) {
-		// 文件存在
-		ErrorResponseWithMsg(w, r, "文件已经存在！")
-		return
-	}
-	file, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	fb, err := io.ReadAll(r.Body)
 	if err != nil {
-		fmt.Println(err)
 		ErrorResponseWithMsg(w, r, "权限错误")
 		return
 	}
-	fb, err := io.ReadAll(r.Body)
+	err = saveMarkdown(session.Name, groupname, markdownname, fb, true)
+	if errors.Is(err, errDocExists) {
+		// 文件存在
+		ErrorResponseWithMsg(w, r, "文件已经存在！")
+		return
+	}
 	if err != nil {
+		slog.ErrorContext(r.Context(), "write markdown failed", "err", err)
 		ErrorResponseWithMsg(w, r, "权限错误")
 		return
 	}
-	file.Write(fb)
-	file.Close()
-	// 刷索引
-	MakeIndex(session.Name, groupname, markdownname, string(fb))
 	SuccessResponse(w, r, true)
 }
 
@@ -432,31 +418,22 @@ func update_markdown(w http.ResponseWriter, r *http.Request) {
 	parts := GetPathList(r.URL.Path, "/wmapi/update-markdown/")
 	var groupname = parts[0]
 	var markdownname = parts[1]
-	group_check(session.Name, groupname)
-	var fname = DATA_DIR + "/" + session.Name + "/" + groupname + "/" + markdownname + ".md"
-	_, err := os.Stat(fname)
-	// 检查错误类型
-	if os.IsNotExist(err) {
-		// 文件不存在
-		ErrorResponseWithMsg(w, r, "文件不存在！")
-		return
-	}
-	file, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	fb, err := io.ReadAll(r.Body)
 	if err != nil {
-		fmt.Println(err)
 		ErrorResponse(w, r)
 		return
 	}
-	fb, err := io.ReadAll(r.Body)
+	err = saveMarkdown(session.Name, groupname, markdownname, fb, false)
+	if errors.Is(err, errDocNotFound) {
+		// 文件不存在
+		ErrorResponseWithMsg(w, r, "文件不存在！")
+		return
+	}
 	if err != nil {
+		slog.ErrorContext(r.Context(), "write markdown failed", "err", err)
 		ErrorResponse(w, r)
 		return
 	}
-	file.Write(fb)
-	file.Close()
-	// 刷索引
-	MakeIndex(session.Name, groupname, markdownname, string(fb))
-	clean_files(groupname, session.Name, markdownname)
 	SuccessResponse(w, r, true)
 }
 
@@ -470,10 +447,11 @@ func del_markdown(w http.ResponseWriter, r *http.Request) {
 	parts := GetPathList(r.URL.Path, "/wmapi/del-markdown/")
 	var groupname = parts[0]
 	var markdownname = parts[1]
-	var fname = DATA_DIR + "/" + session.Name + "/" + groupname + "/" + markdownname
-	os.RemoveAll(fname)
-	os.Remove(fname + ".md")
-	DeleteIndex(session.Name, groupname, markdownname)
+	if err := deleteMarkdown(session.Name, groupname, markdownname); err != nil && !errors.Is(err, errDocNotFound) {
+		slog.ErrorContext(r.Context(), "delete markdown failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
 	SuccessResponse(w, r, true)
 }
 
@@ -490,42 +468,8 @@ func del_group(w http.ResponseWriter, r *http.Request) {
 		ErrorResponse(w, r)
 		return
 	}
-	var fname = DATA_DIR + "/" + session.Name + "/" + groupname
-	os.RemoveAll(fname)
-	// 删除索引
-	_, err := GDB.Exec(`delete from docs_group where username = ? and groupname = ?`, session.Name, groupname)
-	if err != nil {
-		log.Println("delete group error", err)
-		ErrorResponse(w, r)
-		return
-	}
-	rows, err := GDB.Query(`select doc_id from docs_info where username = ? and groupname = ?`, session.Name, groupname)
-	if err != nil {
-		log.Println("delete docs_info error", err)
-		ErrorResponse(w, r)
-		return
-	}
-	defer rows.Close()
-	var doc_ids = make([]int, 0)
-	for rows.Next() {
-		var doc_id int
-		err := rows.Scan(&doc_id)
-		if err != nil {
-			continue
-		}
-		doc_ids = append(doc_ids, doc_id)
-	}
-	for _, doc_id := range doc_ids {
-		_, err := GDB.Exec(`delete from docs where rowid = ?`, doc_id)
-		if err != nil {
-			log.Println("delete docs error", err)
-			ErrorResponse(w, r)
-			return
-		}
-	}
-	_, err = GDB.Exec(`delete from docs_info where username = ? and groupname = ?`, session.Name, groupname)
-	if err != nil {
-		log.Println("delete docs_info error", err)
+	if err := deleteGroup(session.Name, groupname); err != nil {
+		slog.ErrorContext(r.Context(), "delete group failed", "err", err)
 		ErrorResponse(w, r)
 		return
 	}
@@ -534,84 +478,87 @@ func del_group(w http.ResponseWriter, r *http.Request) {
 
 // 用户检测，不存在就创建目录
 func user_check(name string) {
-	var user_dir = DATA_DIR + "/" + name
-	if _, err := os.Stat(user_dir); os.IsNotExist(err) {
-		err := os.MkdirAll(user_dir, 0755)
-		if err != nil {
-			return
-		}
+	if err := Store.MkdirAll(name); err != nil {
+		slog.Error("user_check failed", "user", name, "err", err)
+	}
+	if err := gitInit(name); err != nil {
+		slog.Error("git init failed", "user", name, "err", err)
 	}
 }
 
 // 分组检测
 func group_check(username string, group string) {
 	user_check(username)
-	var user_dir = DATA_DIR + "/" + username + "/" + group
-	if _, err := os.Stat(user_dir); os.IsNotExist(err) {
-		err := os.MkdirAll(user_dir, 0755)
-		if err != nil {
-			return
-		}
-	}
-	// 创建数据库记录
-	var count int
-	err := GDB.QueryRow(`select count(1) from docs_group where username = ? and groupname = ?`, username, group).Scan(&count)
-	if err != nil {
-		log.Println("group_check error", err)
+	if err := Store.MkdirAll(path.Join(username, group)); err != nil {
+		slog.Error("group_check failed", "user", username, "group", group, "err", err)
 		return
 	}
-	if count == 0 {
-		_, err := GDB.Exec(`insert into docs_group (username, groupname, create_at) values (?, ?, ?)`, username, group, time.Now().Unix())
-		if err != nil {
-			log.Println("group_check error", err)
-			return
-		}
+	// 创建数据库记录
+	if _, err := GDB.Groups.Ensure(username, group, time.Now().Unix()); err != nil {
+		slog.Error("group_check failed", "user", username, "group", group, "err", err)
 	}
 }
 
 // 压缩文件夹
-func ZipDir(src_dir string, dst_writer io.Writer) {
+// 出错时不写入 zip 的目录区，已写出的内容不是完整的压缩包，调用方需要丢弃
+func ZipDir(src_dir string, dst_writer io.Writer) error {
 	// 打开：zip文件
 	archive := zip.NewWriter(dst_writer)
-	defer archive.Close()
 
 	// 遍历路径信息
-	filepath.Walk(src_dir, func(path string, info os.FileInfo, _ error) error {
-
-		path = strings.ReplaceAll(path, `\`, `/`)
-		// 如果是源路径，提前进行下一个遍历
-		if path == src_dir {
+	err := storage.Walk(Store, src_dir, func(key string, info storage.FileInfo) error {
+		// 获取：文件头信息
+		header := &zip.FileHeader{
+			Name:     strings.TrimPrefix(key, src_dir+"/"),
+			Modified: info.ModTime,
+		}
+		// 对象存储中的目录没有修改时间
+		if header.Modified.IsZero() {
+			header.Modified = time.Now()
+		}
+		// 隐藏文件(版本库、写入中的临时文件)不导出
+		if ignored(info.Name) {
+			if info.IsDir {
+				return fs.SkipDir
+			}
 			return nil
 		}
-
-		// 获取：文件头信息
-		header, _ := zip.FileInfoHeader(info)
-
-		header.Name = strings.TrimPrefix(path, src_dir+"/")
-
 		// 判断：文件是不是文件夹
-		if info.IsDir() {
+		if info.IsDir {
 			header.Name += `/`
-		} else {
-			// 设置：zip的文件压缩算法
-			header.Method = zip.Deflate
+			_, err := archive.CreateHeader(header)
+			return err
 		}
-
+		// 设置：zip的文件压缩算法
+		header.Method = zip.Deflate
 		// 创建：压缩包头部信息
-		writer, _ := archive.CreateHeader(header)
-		if !info.IsDir() {
-			file, _ := os.Open(path)
-			defer file.Close()
-			io.Copy(writer, file)
+		writer, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
 		}
-		return nil
+		return zipCopy(writer, key)
 	})
+	if err != nil {
+		return fmt.Errorf("zip %s: %w", src_dir, err)
+	}
+	return archive.Close()
+}
+
+func zipCopy(writer io.Writer, key string) error {
+	file, err := Store.Open(key)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(writer, file)
+	return err
 }
 
 // 文档导出
 // /export
 // /export/groupname
 // /export/groupname/markdownname
+// 压缩包边生成边发送，中途出错时中断连接，客户端不会收到残缺但能打开的压缩包
 func export(w http.ResponseWriter, r *http.Request) {
 	var suc, session = Auth(w, r)
 	if !suc {
@@ -619,70 +566,81 @@ func export(w http.ResponseWriter, r *http.Request) {
 	}
 	user_check(session.Name)
 	var username = session.Name
-	if r.URL.Path == "/wmapi/export/" {
+	var restname = strings.TrimPrefix(r.URL.Path, "/wmapi/export/")
+	var rts = strings.Split(restname, "/")
+	var src, fname string
+	switch {
+	case restname == "":
 		// 导出整个用户的文档
-		var fname = username + ".zip"
-		w.Header().Add("Content-Disposition", "attachment; filename="+fname)
-		w.Header().Add("Content-Type", "application/octet-stream")
-		ZipDir(DATA_DIR+"/"+username, w)
+		src, fname = username, username+".zip"
+	case len(rts) == 1:
+		// 导出某个组的文档
+		src, fname = path.Join(username, rts[0]), rts[0]+".zip"
+	case len(rts) == 2:
+		src, fname = path.Join(username, rts[0], rts[1])+".md", rts[1]+".zip"
+	default:
+		ErrorResponseWithStatus(w, r, http.StatusNotFound, "不存在")
+		return
+	}
+	if _, err := Store.Stat(src); err != nil {
+		ErrorResponseWithStatus(w, r, http.StatusNotFound, "不存在")
+		return
+	}
+	w.Header().Add("Content-Disposition", "attachment; filename="+fname)
+	w.Header().Add("Content-Type", "application/octet-stream")
+	var err error
+	if len(rts) == 2 {
+		err = zipDoc(path.Join(username, rts[0]), rts[1], w)
 	} else {
-		var restname = strings.TrimPrefix(r.URL.Path, "/wmapi/export/")
-		var rts = strings.Split(restname, "/")
-		if len(rts) == 1 {
-			// 导出某个组的文档
-			var fname = rts[0] + ".zip"
-			w.Header().Add("Content-Disposition", "attachment; filename="+fname)
-			w.Header().Add("Content-Type", "application/octet-stream")
-			ZipDir(DATA_DIR+"/"+username+"/"+rts[0], w)
-		} else if len(rts) == 2 {
-			var fname = rts[1] + ".zip"
-			var mdinfo = DATA_DIR + "/" + username + "/" + rts[0] + "/" + rts[1]
-			w.Header().Add("Content-Disposition", "attachment; filename="+fname)
-			w.Header().Add("Content-Type", "application/octet-stream")
-			archive := zip.NewWriter(w)
-			defer archive.Close()
-			finfo, err := os.Stat(mdinfo + ".md")
-			if os.IsNotExist(err) {
-				return
-			}
-			header, _ := zip.FileInfoHeader(finfo)
-			header.Name = rts[1] + ".md"
-			header.Method = zip.Deflate
-			writer, _ := archive.CreateHeader(header)
-			file, _ := os.Open(mdinfo + ".md")
-			defer file.Close()
-			io.Copy(writer, file)
-			// 判断是否有附件信息
-			dirinfo, err := os.Stat(mdinfo)
-			if os.IsNotExist(err) {
-				return
-			}
-			header, _ = zip.FileInfoHeader(dirinfo)
-			header.Name = rts[1]
-			archive.CreateHeader(header)
-			// 遍历文件夹
-			f, err := os.Open(mdinfo)
-			if err != nil {
-				fmt.Println("打开目录时出错：", err)
-				return
+		err = ZipDir(src, w)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "export failed", "path", src, "err", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// 压缩单篇文档及其附件目录
+func zipDoc(group_dir, markdownname string, dst_writer io.Writer) error {
+	archive := zip.NewWriter(dst_writer)
+	var mdinfo = path.Join(group_dir, markdownname)
+	finfo, err := Store.Stat(mdinfo + ".md")
+	if err != nil {
+		return err
+	}
+	header := &zip.FileHeader{Name: markdownname + ".md", Method: zip.Deflate, Modified: finfo.ModTime}
+	writer, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	if err := zipCopy(writer, mdinfo+".md"); err != nil {
+		return err
+	}
+	// 判断是否有附件信息
+	if dirinfo, err := Store.Stat(mdinfo); err == nil && dirinfo.IsDir {
+		if _, err := archive.CreateHeader(&zip.FileHeader{Name: markdownname + "/", Modified: finfo.ModTime}); err != nil {
+			return err
+		}
+		// 遍历文件夹
+		files, err := Store.List(mdinfo)
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			if fi.IsDir {
+				continue
 			}
-			defer f.Close()
-			files, err := f.Readdir(-1)
+			header := &zip.FileHeader{Name: markdownname + "/" + fi.Name, Method: zip.Deflate, Modified: fi.ModTime}
+			writer, err := archive.CreateHeader(header)
 			if err != nil {
-				fmt.Println("读取目录时出错：", err)
-				return
+				return err
 			}
-			for _, fi := range files {
-				header, _ := zip.FileInfoHeader(fi)
-				header.Name = rts[1] + "/" + fi.Name()
-				header.Method = zip.Deflate
-				writer, _ := archive.CreateHeader(header)
-				file, _ := os.Open(mdinfo + "/" + fi.Name())
-				io.Copy(writer, file)
-				file.Close()
+			if err := zipCopy(writer, path.Join(mdinfo, fi.Name)); err != nil {
+				return err
 			}
 		}
 	}
+	return archive.Close()
 }
 
 /*
@@ -699,42 +657,26 @@ func upload(w http.ResponseWriter, r *http.Request) {
 	var groupname = parts[0]
 	var markdownname = parts[1]
 
-	var work_dir = DATA_DIR + "/" + session.Name + "/" + groupname + "/" + markdownname
-	// 文件夹不存在就创建
-	if _, err := os.Stat(work_dir); os.IsNotExist(err) {
-		err := os.MkdirAll(work_dir, 0755)
-		if err != nil {
-			ErrorResponse(w, r)
-			return
-		}
-	}
+	var work_dir = path.Join(session.Name, groupname, markdownname)
 
 	// 从请求中获取文件
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		log.Println(err)
+		slog.WarnContext(r.Context(), "upload read failed", "err", err)
 		ErrorResponse(w, r)
 		return
 	}
 	defer file.Close()
 
-	// 创建一个新文件
-	newFile, err := os.Create(work_dir + "/" + header.Filename)
-	if err != nil {
-		log.Println(err)
-		ErrorResponse(w, r)
-		return
-	}
-	defer newFile.Close()
-
-	// 将上传的文件内容复制到新文件中
-	_, err = io.Copy(newFile, file)
+	// 将上传的文件内容写入存储，目录不存在会自动创建
+	err = Store.Write(path.Join(work_dir, header.Filename), file)
 	if err != nil {
-		log.Println(err)
+		slog.ErrorContext(r.Context(), "upload write failed", "err", err)
 		ErrorResponse(w, r)
 		return
 	}
 
+	gitCommit(session.Name, "upload "+path.Join(groupname, markdownname, header.Filename))
 	// 返回上传成功的信息
 	SuccessResponse(w, r, true)
 }
@@ -743,26 +685,24 @@ func upload(w http.ResponseWriter, r *http.Request) {
 清理多余文件
 */
 func clean_files(groupname, username, markdown string) bool {
-	var _path = DATA_DIR + "/" + username + "/" + groupname + "/" + markdown
+	var _path = path.Join(username, groupname, markdown)
 	// 读文件
 	var _md_path = _path + ".md"
 	// 提取出所有文件相关地址
-	_bytes, err := os.ReadFile(_md_path)
+	_bytes, err := storage.ReadFile(Store, _md_path)
 	if err != nil {
 		return false
 	}
 	var _content = string(_bytes)
 	// 读出文件出中所有的文件
-	if _sub_fs, err := os.ReadDir(_path); os.IsNotExist(err) {
-		return true
-	} else if err != nil {
+	if _sub_fs, err := Store.List(_path); err != nil {
 		return true
 	} else {
 		// 删除不在文章中存在的文件
 		for _, _fs := range _sub_fs {
-			if !_fs.IsDir() {
-				if !strings.Contains(_content, markdown+"/"+_fs.Name()) {
-					os.Remove(_path + "/" + _fs.Name())
+			if !_fs.IsDir {
+				if !strings.Contains(_content, markdown+"/"+_fs.Name) {
+					Store.Remove(path.Join(_path, _fs.Name))
 				}
 			}
 		}
@@ -796,6 +736,17 @@ func ErrorResponseWithMsg(w http.ResponseWriter, r *http.Request, msg string) {
 	w.Write(j)
 }
 
+func ErrorResponseWithStatus(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	var res = ResponseBase{
+		Ok:  false,
+		Msg: msg,
+	}
+	j, _ := json.Marshal(res)
+	w.Header().Add("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+}
+
 func SuccessResponse(w http.ResponseWriter, r *http.Request, data any) {
 	var res = ResponseBase{
 		Ok:   true,
@@ -817,44 +768,47 @@ func Groupname(r *http.Request) string {
 
 func Auth(w http.ResponseWriter, r *http.Request) (bool, *UserSession) {
 	// 需要权限控制的
-	var cookie, err = r.Cookie("session_id")
-	if err != nil {
+	var session = checkSession(w, r)
+	if session == nil {
 		ErrorResponse(w, r)
 		return false, nil
-	} else {
-		var session_id = cookie.Value
-		var username string
-		var expire int64
-		err = GDB.QueryRow(`select username, expire from session_info where session_id = ?`, session_id).Scan(&username, &expire)
+	}
+	return true, session
+}
+
+// 校验会话 cookie，未登录或会话失效时返回 nil
+func checkSession(w http.ResponseWriter, r *http.Request) *UserSession {
+	var cookie, err = r.Cookie("session_id")
+	if err != nil {
+		return nil
+	}
+	var session_id = hashSessionId(cookie.Value)
+	se, err := GDB.Sessions.Get(session_id)
+	if err != nil {
+		slog.DebugContext(r.Context(), "session not found", "err", err)
+		return nil
+	}
+	// 校验session是否过期或长时间未使用
+	var now = time.Now()
+	if se.Expire < now.Unix() || se.LastSeen+int64(SessionIdleTimeout/time.Second) < now.Unix() {
+		err = GDB.Sessions.Delete(session_id)
 		if err != nil {
-			log.Println(err)
-			ErrorResponse(w, r)
-			return false, nil
-		}
-		// 校验session是否过期
-		if expire < time.Now().Unix() {
-			_, err = GDB.Exec(`delete from session_info where session_id = ?`, session_id)
-			if err != nil {
-				ErrorResponse(w, r)
-				return false, nil
-			}
-			return false, nil
-		}
-		if username == "" {
-			// 用户未登录
-			ErrorResponse(w, r)
-			return false, nil
-		} else {
-			// 用户已登录
-			return true, &UserSession{
-				Expires:   expire,
-				Name:      username,
-				SessionId: session_id,
-			}
+			slog.ErrorContext(r.Context(), "delete expired session failed", "err", err)
 		}
-
+		return nil
+	}
+	if se.Username == "" {
+		// 用户未登录
+		return nil
+	}
+	// 用户已登录，刷新最后活跃时间(滑动续期)
+	touchSession(session_id, se.LastSeen, r)
+	ensureCsrfCookie(w, r, time.Unix(se.Expire, 0))
+	return &UserSession{
+		Expires:   se.Expire,
+		Name:      se.Username,
+		SessionId: session_id,
 	}
-
 }
 
 // 搜索
@@ -873,48 +827,13 @@ func search_detail(w http.ResponseWriter, r *http.Request) {
 	if !suc {
 		return
 	}
-	sps := splitWord(input.Query)
-	sqls := `select di.title from docs d, docs_info di where di.doc_id = d.rowid and di.username = ? and di.groupname = ?`
-	q := strings.Join(sps, " AND ")
-	if len(sps) > 0 {
-		sqls += " AND d.docs MATCH ? order by di.create_at DESC"
-		rows, err := GDB.Query(sqls, session.Name, input.Group, q)
-		if err != nil {
-			ErrorResponse(w, r)
-			return
-		}
-		defer rows.Close()
-		var res = make([]string, 0)
-		for rows.Next() {
-			var title string
-			err := rows.Scan(&title)
-			if err != nil {
-				ErrorResponse(w, r)
-				return
-			}
-			res = append(res, title)
-		}
-		SuccessResponse(w, r, res)
-	} else {
-		sqls += " order by di.create_at DESC"
-		rows, err := GDB.Query(sqls, session.Name, input.Group)
-		if err != nil {
-			ErrorResponse(w, r)
-			return
-		}
-		defer rows.Close()
-		var res = make([]string, 0)
-		for rows.Next() {
-			var title string
-			err := rows.Scan(&title)
-			if err != nil {
-				ErrorResponse(w, r)
-				return
-			}
-			res = append(res, title)
-		}
-		SuccessResponse(w, r, res)
+	res, err := GDB.Docs.Search(session.Name, input.Group, splitWord(input.Query))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "search failed", "err", err)
+		ErrorResponse(w, r)
+		return
 	}
+	SuccessResponse(w, r, res)
 }
 
 // 分词
@@ -944,200 +863,61 @@ func splitWord(content string) []string {
 
 // 建索引&刷新索引
 func MakeIndex(user, group, title, content string) {
-	// 判断文本是否存在
-	var doc_id int
-	err := GDB.QueryRow(`select doc_id from docs_info where groupname = ? and username = ? and title = ?`, group, user, title).Scan(&doc_id)
-	if err != nil && doc_id == 0 {
-		// 插入文档描述
-		_, err = GDB.Exec(`insert into docs_info(groupname, title, username, create_at) values (?, ?, ?, ?)`, group, title, user, time.Now().Unix())
-		if err != nil {
-			log.Println("MakeIndex insert error", err)
-			return
-		}
-		err = GDB.QueryRow(`select doc_id from docs_info where groupname = ? and username = ? and title = ?`, group, user, title).Scan(&doc_id)
-		if err != nil {
-			log.Println("MakeIndex query error", err)
-			return
-		}
-		// 新增索引
-		// 分词
-		tt := splitWord(title)
-		tc := splitWord(content)
-		_, err = GDB.Exec(`insert into docs(rowid, title, content) values (?, ?, ?)`, doc_id, strings.Join(tt, " "), strings.Join(tc, " "))
-		if err != nil {
-			log.Println("MakeIndex insert error", err)
-			return
-		}
-	} else {
-		// 修改时间
-		_, err = GDB.Exec(`update docs_info set create_at = ? where doc_id = ?`, time.Now().Unix(), doc_id)
-		if err != nil {
-			log.Println("MakeIndex update error", err)
-			return
-		}
-		// 删除索引
-		_, err = GDB.Exec(`delete from docs where rowid = ?`, doc_id)
-		if err != nil {
-			log.Println("MakeIndex delete error", err)
-			return
-		}
-		// 新增索引
-		tt := splitWord(title)
-		tc := splitWord(content)
-		_, err = GDB.Exec(`insert into docs(rowid, title, content) values (?, ?, ?)`, doc_id, strings.Join(tt, " "), strings.Join(tc, " "))
-		if err != nil {
-			log.Println("MakeIndex insert error", err)
-			return
-		}
+	defer func(start time.Time) { indexDuration.Observe(time.Since(start).Seconds()) }(time.Now())
+	if err := GDB.Docs.Index(user, group, title, contentHash([]byte(content)), splitWord(title), splitWord(content)); err != nil {
+		slog.Error("index failed", "user", user, "group", group, "title", title, "err", err)
 	}
 }
 
 // 删除索引
 func DeleteIndex(user, group, title string) {
-	var doc_id int
-	err := GDB.QueryRow(`select doc_id from docs_info where groupname = ? and username = ? and title = ?`, group, user, title).Scan(&doc_id)
-	if err != nil {
-		log.Println("DeleteIndex query error", err)
-		return
-	}
-	if doc_id != 0 {
-		// 删除索引
-		_, err = GDB.Exec(`delete from docs where rowid = ?`, doc_id)
-		if err != nil {
-			log.Println("DeleteIndex delete error", err)
-			return
-		}
-		// 删除文档描述
-		_, err = GDB.Exec(`delete from docs_info where doc_id = ?`, doc_id)
-		if err != nil {
-			log.Println("DeleteIndex delete error", err)
-			return
-		}
+	if err := GDB.Docs.Delete(user, group, title); err != nil {
+		slog.Error("delete index failed", "user", user, "group", group, "title", title, "err", err)
 	}
 }
 
 func AddUser(name string, password string) error {
-	// 添加用户
-	// 判断用户是否存在
-	var count int
-	err := GDB.QueryRow(`select count(1) from user_info where username = ?`, name).Scan(&count)
-	if err != nil {
-		log.Println("AddUser query error", err)
-		return err
-	}
-	if count > 0 {
-		return errors.New("user exists")
-	}
-
-	ep := Genpass(password)
-	// 插入数据库
-	_, err = GDB.Exec(`insert into user_info (username, password) values (?, ?)`, name, ep)
-	if err != nil {
-		return err
+	// 添加用户，已存在时返回 repo.ErrExists
+	err := GDB.Users.Create(&repo.User{Username: name, Password: Genpass(password)})
+	if err != nil && !errors.Is(err, repo.ErrExists) {
+		slog.Error("add user failed", "user", name, "err", err)
 	}
-	return nil
+	return err
 }
 
 func init_work() {
 	err := AddUser("root", "root")
 	if err == nil {
-		log.Println("初始化用户名: root")
-		log.Println("初始化密码: root")
+		slog.Warn("initial user root created with password root, change it after login")
 	}
 }
 
-// 自动扫描已有文件夹创建索引
-func createIndex(username string) {
-	log.Println("开始创建索引...")
-	defer log.Println("创建索引完成")
-	// 扫描用户文件夹
-	log.Println("开始处理用户: ", username)
-	// 扫描用户组
-	groups, err := utils.ListImmediateSubDirectories(filepath.Join(DATA_DIR, username))
-	if err != nil {
-		log.Println("createIndex error: ", err)
-		return
-	}
-	for _, group := range groups {
-		log.Println("开始处理用户组: ", group.Name())
-		// 判断组是否存在
-		group_check(username, group.Name())
-		// 列出所有md文件
-		files, err := utils.ListImmediateSubFiles(filepath.Join(DATA_DIR, username, group.Name()))
-		if err != nil {
-			log.Println("列出所有md文件失败: ", err)
-			continue
-		}
-		for _, file := range files {
-			log.Println("开始处理文件: ", file.Name())
-			if !strings.HasSuffix(file.Name(), ".md") {
-				continue
-			}
-			title := strings.TrimSuffix(file.Name(), ".md")
-			var count int
-			err := GDB.QueryRow(`select count(1) from docs_info where groupname = ? and username = ? and title = ?`, group.Name(), username, title).Scan(&count)
-			if err != nil {
-				log.Println("createIndex error: ", err)
-				continue
-			}
-			if count == 0 {
-				// 创建索引
-				content, err := os.ReadFile(filepath.Join(DATA_DIR, username, group.Name(), file.Name()))
-				if err != nil {
-					log.Println("createIndex error: ", err)
-					continue
-				}
-				log.Println("开始创建索引: ", title)
-				MakeIndex(username, group.Name(), title, string(content))
-			}
-		}
-	}
-
-}
-
 func SessionClear() {
 	// 把超时的session踢出去
-	rows, err := GDB.Query(`select session_id, username, expire from session_info`)
-	if err != nil {
-		log.Println("session job error: ", err)
-		return
-	}
-	defer rows.Close()
-
-	var sessionids = make([]string, 0)
-	for rows.Next() {
-		var session_id, username string
-		var expire int64
-		err := rows.Scan(&session_id, &username, &expire)
-		if err != nil {
-			log.Println("session loop error: ", err)
-			continue
-		}
-		if expire < time.Now().Unix() {
-			// session 超时
-			sessionids = append(sessionids, session_id)
-		}
-	}
-	for _, session_id := range sessionids {
-		_, err = GDB.Exec(`delete from session_info where session_id = ?`, session_id)
-		if err != nil {
-			log.Println("session delete error: ", err)
-			continue
-		}
+	var now = time.Now()
+	if err := GDB.Sessions.Expire(now.Unix(), now.Add(-SessionIdleTimeout).Unix()); err != nil {
+		slog.Error("session job failed", "err", err)
 	}
 }
 
 // 定时任务
-func Job() {
-	var dur = 1 * time.Hour
-	// var dur = 1 * time.Second
+func Job(ctx context.Context) {
+	var dur = JobInterval
 	t := time.NewTimer(dur)
+	defer t.Stop()
 	for {
-		<-t.C
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
 		t.Reset(dur)
 		SessionClear()
 		// 检查恶意登录
 		loginRecordClear()
+		loginTicketClear()
+		webauthnChallengeClear()
+		oidcStateClear()
 	}
 }
 
@@ -1201,17 +981,17 @@ func (fs StaticEntry) Open(name string) (http.File, error) {
 
 func auth_static(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if IsStatic(r.URL.Path) {
+		if r.URL.Path == "/" || strings.HasSuffix(r.URL.Path, "/index.html") || spaRoutes[r.URL.Path] {
+			serve_index(w, r)
+		} else if IsStatic(r.URL.Path) {
 			http.StripPrefix("/", next).ServeHTTP(w, r)
 		} else {
 			// 登录的
-			log.Println(r.URL.Path)
 			if suc, se := Auth(w, r); suc {
-				log.Println(r.URL.Path)
 				s := strings.TrimPrefix(r.URL.Path, "/wmapi/markdown")
 				p := "/" + se.Name + "/" + s
 				r.URL.Path = p
-				log.Println(r.URL.Path)
+				slog.DebugContext(r.Context(), "markdown file", "path", r.URL.Path)
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -1220,76 +1000,14 @@ func auth_static(next http.Handler) http.Handler {
 }
 
 func createTable() error {
-
-	_, err := GDB.Exec(`CREATE TABLE IF NOT EXISTS user_info (
-		username  varchar(100),
-		password varchar(100)
-		)`)
+	st, err := GDB.Migrate(false)
 	if err != nil {
-		log.Println("createTable error", err)
+		slog.Error("migrate failed", "err", err)
 		return err
 	}
-
-	_, err = GDB.Exec(`CREATE TABLE IF NOT EXISTS session_info (session_id varchar (100), username varchar (100), expire INTEGER)`)
-	if err != nil {
-		log.Println("createTable error", err)
-		return err
-	}
-
-	_, err = GDB.Exec(`CREATE TABLE IF NOT EXISTS login_record (username varchar (100), last_time INTEGER, login_count INTEGER)`)
-	if err != nil {
-		log.Println("createTable error", err)
-		return err
-	}
-
-	_, err = GDB.Exec(`CREATE TABLE IF NOT EXISTS docs_group(groupname varchar(100), username varchar(100), create_at INTEGER)`)
-	if err != nil {
-		log.Println("createTable error", err)
-		return err
-	}
-
-	_, err = GDB.Exec(`CREATE TABLE IF NOT EXISTS docs_info(doc_id INTEGER PRIMARY KEY AUTOINCREMENT, groupname varchar(100), title varchar(100), username  varchar(100), create_at INTEGER, is_public INTEGER DEFAULT 0)`)
-
-	if err != nil {
-		log.Println("createTable error", err)
-		return err
-	}
-
-	// 迁移：检查并添加 is_public 字段（如果不存在）
-	_, err = GDB.Exec(`ALTER TABLE docs_info ADD COLUMN is_public INTEGER DEFAULT 0`)
-	if err != nil {
-		// 如果字段已存在，忽略错误
-		log.Println("migrate is_public column:", err)
-	}
-
-	// 迁移：检查并添加 view_count 字段（如果不存在）
-	_, err = GDB.Exec(`ALTER TABLE docs_info ADD COLUMN view_count INTEGER DEFAULT 0`)
-	if err != nil {
-		// 如果字段已存在，忽略错误
-		log.Println("migrate view_count column:", err)
+	for _, m := range st.Pending {
+		slog.Info("migrate", "version", m.Version, "name", m.Name)
 	}
-
-	_, err = GDB.Exec(`CREATE INDEX IF NOT EXISTS docs_username ON docs_info(username)`)
-
-	if err != nil {
-		log.Println("createTable error", err)
-		return err
-	}
-
-	_, err = GDB.Exec(`CREATE INDEX IF NOT EXISTS docs_groupname ON docs_info(groupname)`)
-
-	if err != nil {
-		log.Println("createTable error", err)
-		return err
-	}
-
-	_, err = GDB.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS docs USING fts5(title, content)`)
-
-	if err != nil {
-		log.Println("createTable error", err)
-		return err
-	}
-
 	return nil
 }
 
@@ -1298,36 +1016,29 @@ func updateIndex(w http.ResponseWriter, r *http.Request) {
 	if !suc {
 		return
 	}
-	go createIndex(session.Name)
+	var username = session.Name
+	// 对比文件与索引，只刷新有变化的文档
+	if !goBackground(func(ctx context.Context) {
+		if _, err := reconcile(ctx, username, false); err != nil {
+			slog.Error("update index failed", "user", username, "err", err)
+		}
+	}) {
+		ErrorResponseWithStatus(w, r, http.StatusServiceUnavailable, "服务正在关闭")
+		return
+	}
 	SuccessResponse(w, r, true)
 }
 
 // 公开文档列表
-type PublicDoc struct {
-	Groupname  string `json:"groupname"`
-	Title      string `json:"title"`
-	Username   string `json:"username"`
-	ViewCount  int    `json:"view_count"`
-}
+type PublicDoc = repo.PublicDoc
 
 // 获取公开文档列表
 func public_list(w http.ResponseWriter, r *http.Request) {
-	rows, err := GDB.Query(`select groupname, title, username, view_count from docs_info where is_public = 1 ORDER BY view_count DESC`)
+	res, err := GDB.Docs.PublicList()
 	if err != nil {
 		ErrorResponse(w, r)
 		return
 	}
-	defer rows.Close()
-
-	var res = make([]*PublicDoc, 0)
-	for rows.Next() {
-		var doc PublicDoc
-		err := rows.Scan(&doc.Groupname, &doc.Title, &doc.Username, &doc.ViewCount)
-		if err != nil {
-			continue
-		}
-		res = append(res, &doc)
-	}
 	SuccessResponse(w, r, res)
 }
 
@@ -1355,56 +1066,14 @@ func public_search(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 使用倒排索引搜索
-	if len(sps) > 0 {
-		q := strings.Join(sps, " AND ")
-		sqls := `SELECT di.groupname, di.title, di.username, di.view_count
-			FROM docs d, docs_info di
-			WHERE di.doc_id = d.rowid AND di.is_public = 1 AND d.docs MATCH ?
-			ORDER BY di.view_count DESC`
-		rows, err := GDB.Query(sqls, q)
-		if err != nil {
-			log.Println("public_search error:", err)
-			ErrorResponse(w, r)
-			return
-		}
-		defer rows.Close()
-
-		var res = make([]*PublicDoc, 0)
-		for rows.Next() {
-			var doc PublicDoc
-			err := rows.Scan(&doc.Groupname, &doc.Title, &doc.Username, &doc.ViewCount)
-			if err != nil {
-				continue
-			}
-			res = append(res, &doc)
-		}
-		SuccessResponse(w, r, res)
-	} else {
-		// 没有分词结果，使用模糊匹配
-		rows, err := GDB.Query(`
-			SELECT di.groupname, di.title, di.username, di.view_count
-			FROM docs_info di
-			WHERE di.is_public = 1 AND (di.title LIKE ? OR di.groupname LIKE ?)
-			ORDER BY di.view_count DESC
-		`, "%"+query+"%", "%"+query+"%")
-		if err != nil {
-			ErrorResponse(w, r)
-			return
-		}
-		defer rows.Close()
-
-		var res = make([]*PublicDoc, 0)
-		for rows.Next() {
-			var doc PublicDoc
-			err := rows.Scan(&doc.Groupname, &doc.Title, &doc.Username, &doc.ViewCount)
-			if err != nil {
-				continue
-			}
-			res = append(res, &doc)
-		}
-		SuccessResponse(w, r, res)
+	// 有分词结果时使用倒排索引搜索，否则模糊匹配
+	res, err := GDB.Docs.PublicSearch(sps, query)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "public search failed", "err", err)
+		ErrorResponse(w, r)
+		return
 	}
+	SuccessResponse(w, r, res)
 }
 
 // 获取公开文档内容
@@ -1426,7 +1095,7 @@ func public_markdown(w http.ResponseWriter, r *http.Request) {
 	if strings.HasSuffix(filename, ".md") {
 		// .md 文件需要验证文档是否公开
 		var title = strings.TrimSuffix(filename, ".md")
-		err = GDB.QueryRow(`SELECT username FROM docs_info WHERE groupname = ? AND title = ? AND is_public = 1`, groupname, title).Scan(&username)
+		username, err = GDB.Docs.PublicOwner("", groupname, title)
 		if err != nil {
 			// 尝试用 username/groupname/title 格式
 			parts2 := strings.SplitN(groupname, "/", 2)
@@ -1434,7 +1103,7 @@ func public_markdown(w http.ResponseWriter, r *http.Request) {
 				var username2, groupname2 string
 				username2 = parts2[0]
 				groupname2 = parts2[1]
-				err = GDB.QueryRow(`SELECT username FROM docs_info WHERE username = ? AND groupname = ? AND title = ? AND is_public = 1`, username2, groupname2, title).Scan(&username)
+				username, err = GDB.Docs.PublicOwner(username2, groupname2, title)
 				if err == nil {
 					groupname = groupname2
 				}
@@ -1445,36 +1114,33 @@ func public_markdown(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		// .md 文件路径
-		var fname = DATA_DIR + "/" + username + "/" + groupname + "/" + strings.TrimSuffix(filename, ".md") + ".md"
-		file, err := os.Open(fname)
+		var fname = path.Join(username, groupname, strings.TrimSuffix(filename, ".md")+".md")
+		content, err := storage.ReadFile(Store, fname)
 		if err != nil {
-			log.Println("open file error:", err)
+			slog.ErrorContext(r.Context(), "read public markdown failed", "err", err)
 			ErrorResponseWithMsg(w, r, "文档读取失败")
 			return
 		}
-		defer file.Close()
-		content, err := io.ReadAll(file)
-		if err != nil {
-			ErrorResponse(w, r)
-			return
-		}
 
 		// 增加点击量
-		GDB.Exec(`UPDATE docs_info SET view_count = view_count + 1 WHERE groupname = ? AND title = ? AND is_public = 1`, groupname, title)
+		if err := GDB.Docs.AddView(username, groupname, title); err != nil {
+			slog.ErrorContext(r.Context(), "update view count failed", "err", err)
+		}
 
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.Write(content)
 	} else {
 		// 图片或其他文件，需要验证该分组下是否有公开文档
-		err = GDB.QueryRow(`SELECT username FROM docs_info WHERE groupname = ? AND title = ? AND is_public = 1`, groupname, parts[1]).Scan(&username)
+		username, err = GDB.Docs.PublicOwner("", groupname, parts[1])
 		if err != nil || username == "" {
 			ErrorResponseWithMsg(w, r, "文件不存在或未公开")
 			return
 		}
 		// 文件路径
-		var fname = DATA_DIR + "/" + username + "/" + parts[0] + "/" + parts[1] + "/" + parts[2]
-		log.Println("public file path:", fname)
-		http.ServeFile(w, r, fname)
+		var fname = path.Join(username, parts[0], parts[1], parts[2])
+		slog.DebugContext(r.Context(), "public file", "path", fname)
+		r.URL.Path = "/" + fname
+		http.FileServer(storage.FileSystem(Store)).ServeHTTP(w, r)
 	}
 }
 
@@ -1502,10 +1168,9 @@ func update_public(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := GDB.Exec(`UPDATE docs_info SET is_public = ? WHERE username = ? AND groupname = ? AND title = ?`,
-		req.IsPublic, session.Name, groupname, markdownname)
+	_, err := GDB.Docs.SetPublic(session.Name, groupname, markdownname, req.IsPublic == 1)
 	if err != nil {
-		log.Println("update public error:", err)
+		slog.ErrorContext(r.Context(), "update public failed", "err", err)
 		ErrorResponse(w, r)
 		return
 	}
@@ -1530,26 +1195,220 @@ func get_public_status(w http.ResponseWriter, r *http.Request) {
 	var markdownname = parts[1]
 
 	var isPublic int
-	var viewCount int
-	err := GDB.QueryRow(`SELECT is_public, view_count FROM docs_info WHERE username = ? AND groupname = ? AND title = ?`,
-		session.Name, groupname, markdownname).Scan(&isPublic, &viewCount)
-	if err != nil {
-		isPublic = 0
-		viewCount = 0
+	public, viewCount, err := GDB.Docs.PublicStatus(session.Name, groupname, markdownname)
+	if err == nil && public {
+		isPublic = 1
 	}
 
 	SuccessResponse(w, r, map[string]int{"is_public": isPublic, "view_count": viewCount})
 }
 
+// 数据库迁移命令
+func migrate(cmd string) error {
+	var st *repo.MigrateStatus
+	var err error
+	switch cmd {
+	case "status":
+		st, err = GDB.MigrateStatus()
+	case "dry-run":
+		st, err = GDB.Migrate(true)
+	case "up":
+		st, err = GDB.Migrate(false)
+	default:
+		return fmt.Errorf("unknown migrate command %q", cmd)
+	}
+	if st != nil {
+		fmt.Printf("current: %d\nlatest: %d\n", st.Current, st.Latest)
+		var label = "pending"
+		if cmd == "up" && err == nil {
+			label = "applied"
+		}
+		for _, m := range st.Pending {
+			fmt.Printf("%s: %d %s\n", label, m.Version, m.Name)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case "dry-run":
+		fmt.Println("dry-run ok, nothing applied")
+	case "up":
+		fmt.Println("migrated to", st.Latest)
+	}
+	return nil
+}
+
+// 将配置应用到各个全局变量
+func applyConfig(c *config.Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	DATA_DIR = c.Server.DataDir
+	switch c.Storage.Type {
+	case "s3":
+		s3, err := storage.NewS3(storage.S3Config{
+			Endpoint:  c.Storage.S3Endpoint,
+			Region:    c.Storage.S3Region,
+			Bucket:    c.Storage.S3Bucket,
+			AccessKey: c.Storage.S3AccessKey,
+			SecretKey: c.Storage.S3SecretKey,
+			Prefix:    c.Storage.S3Prefix,
+			PathStyle: c.Storage.S3PathStyle,
+		})
+		if err != nil {
+			return err
+		}
+		Store = s3
+	default:
+		Store = storage.NewLocal(DATA_DIR)
+	}
+	SESSIONS_DIR = c.Server.SessionsDir
+	BasePath = strings.TrimSuffix(c.Server.BasePath, "/")
+	proxies, err := parseTrustedProxies(c.Server.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	TrustedProxies = proxies
+	SessionExpires = c.Session.Expires.Duration
+	SessionIdleTimeout = c.Session.IdleTimeout.Duration
+	LoginMaxFailures = c.Login.MaxFailures
+	LoginLockout = c.Login.Lockout.Duration
+	JobInterval = c.Job.Interval.Duration
+	WatchEnabled = c.Watch.Enabled
+	WatchDebounce = c.Watch.Debounce.Duration
+	GitEnabled = c.Git.Enabled
+	GitBinary = c.Git.Binary
+	WebDAVEnabled = c.WebDAV.Enabled
+	if err := setupLogging(c.Log); err != nil {
+		return err
+	}
+	MetricsEnabled = c.Metrics.Enabled
+	MetricsToken = c.Metrics.Token
+	ShutdownTimeout = c.Server.ShutdownTimeout.Duration
+	WebAuthnRPID = c.WebAuthn.RPID
+	WebAuthnOrigin = c.WebAuthn.Origin
+	RoleMapping = idp.ParseRoleMap(c.Auth.RoleMap)
+	if c.LDAP.URL != "" {
+		ldapConf := idp.LDAPConfig{
+			URL:          c.LDAP.URL,
+			StartTLS:     c.LDAP.StartTLS,
+			BindDN:       c.LDAP.BindDN,
+			BindPassword: c.LDAP.BindPassword,
+			BaseDN:       c.LDAP.BaseDN,
+			UserFilter:   c.LDAP.UserFilter,
+			GroupAttr:    c.LDAP.GroupAttr,
+		}
+		if err := ldapConf.Validate(); err != nil {
+			return err
+		}
+		Authenticators = append(Authenticators, idp.NewLDAP(ldapConf))
+	}
+	if c.OIDC.Issuer != "" {
+		oidcConf := idp.OIDCConfig{
+			Issuer:        c.OIDC.Issuer,
+			ClientID:      c.OIDC.ClientID,
+			ClientSecret:  c.OIDC.ClientSecret,
+			RedirectURL:   c.OIDC.RedirectURL,
+			Scopes:        c.OIDC.Scopes,
+			UsernameClaim: c.OIDC.UsernameClaim,
+			GroupsClaim:   c.OIDC.GroupsClaim,
+		}
+		if err := oidcConf.Validate(); err != nil {
+			return err
+		}
+		OIDCProvider = idp.NewOIDC(oidcConf)
+	}
+	return nil
+}
+
+// 在 mux 上注册所有路由，返回加上中间件的处理器
+func newHandler(mux *http.ServeMux) http.Handler {
+	webroot, _ := fs.Sub(staticFiles, "page")
+	multiDir := StaticEntry{StaticFs: http.FS(webroot), MarkdownFs: storage.FileSystem(Store)}
+	mux.Handle("/", method(auth_static(http.FileServer(multiDir)).ServeHTTP, "GET", "HEAD"))
+	// http.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir("page/"))))
+	// http.Handle("/markdown/", auth_markdown(http.FileServer(http.Dir(DATA_DIR+"/"))))
+	mux.HandleFunc("/wmapi/upload/", method(snapshot_guard(upload), "POST"))
+	mux.HandleFunc("/wmapi/login", method(login, "POST"))
+	mux.HandleFunc("/wmapi/logout", method(logout, "POST"))
+	mux.HandleFunc("/wmapi/group-list", method(group_list, "GET"))
+	mux.HandleFunc("/wmapi/new-group", method(snapshot_guard(new_group), "POST"))
+	mux.HandleFunc("/wmapi/new-markdown/", method(snapshot_guard(new_markdown), "POST"))
+	mux.HandleFunc("/wmapi/update-markdown/", method(snapshot_guard(update_markdown), "POST"))
+	mux.HandleFunc("/wmapi/del-markdown/", method(snapshot_guard(del_markdown), "DELETE"))
+	mux.HandleFunc("/wmapi/del-group/", method(snapshot_guard(del_group), "DELETE"))
+	mux.HandleFunc("/wmapi/user-password-update", method(user_password_update, "POST"))
+	mux.HandleFunc("/wmapi/new-user", method(new_user, "POST"))
+	mux.HandleFunc("/wmapi/export/", method(export, "GET"))
+	mux.HandleFunc("/wmapi/search-detail", method(search_detail, "POST"))
+	// 刷新索引
+	mux.HandleFunc("/wmapi/update-index", method(updateIndex, "POST"))
+	// 公开文档相关
+	mux.HandleFunc("/wmapi/public-list", method(public_list, "GET", "POST"))
+	mux.HandleFunc("/wmapi/public-search", method(public_search, "POST"))
+	mux.HandleFunc("/wmapi/public-markdown/", method(public_markdown, "GET"))
+	mux.HandleFunc("/wmapi/update-public/", method(update_public, "POST"))
+	mux.HandleFunc("/wmapi/get-public/", method(get_public_status, "GET"))
+	mux.HandleFunc("/wmapi/feed/", method(feed, "GET", "HEAD"))
+	// 两步验证
+	mux.HandleFunc("/wmapi/totp-status", method(totp_status, "GET"))
+	mux.HandleFunc("/wmapi/totp-setup", method(totp_setup, "POST"))
+	mux.HandleFunc("/wmapi/totp-enable", method(totp_enable, "POST"))
+	mux.HandleFunc("/wmapi/totp-disable", method(totp_disable, "POST"))
+	mux.HandleFunc("/wmapi/totp-login", method(totp_login, "POST"))
+	mux.HandleFunc("/wmapi/totp-reset", method(totp_reset, "POST"))
+	// 通行密钥
+	mux.HandleFunc("/wmapi/webauthn-register-begin", method(webauthn_register_begin, "POST"))
+	mux.HandleFunc("/wmapi/webauthn-register-finish", method(webauthn_register_finish, "POST"))
+	mux.HandleFunc("/wmapi/webauthn-login-begin", method(webauthn_login_begin, "POST"))
+	mux.HandleFunc("/wmapi/webauthn-login-finish", method(webauthn_login_finish, "POST"))
+	mux.HandleFunc("/wmapi/webauthn-list", method(webauthn_list, "GET"))
+	mux.HandleFunc("/wmapi/webauthn-delete", method(webauthn_delete, "POST"))
+	// 单点登录
+	mux.HandleFunc("/wmapi/oidc-login", method(oidc_login, "GET"))
+	mux.HandleFunc("/wmapi/oidc-callback", method(oidc_callback, "GET"))
+	// 会话管理
+	mux.HandleFunc("/wmapi/session-list", method(session_list, "GET"))
+	mux.HandleFunc("/wmapi/session-revoke", method(session_revoke, "POST"))
+
+	mux.HandleFunc("/wmapi/backup", method(backup, "GET"))
+	mux.HandleFunc("/wmapi/reconcile", method(reconcile_start, "POST"))
+	mux.HandleFunc("/wmapi/reconcile-status", method(reconcile_status, "GET"))
+	// git smart HTTP
+	mux.HandleFunc("/wmapi/git/", method(git_http, "GET", "POST"))
+	// WebDAV
+	mux.HandleFunc(davPrefix+"/", webdav_handler)
+
+	mux.HandleFunc("/wmapi/token-list", method(token_list, "GET"))
+	mux.HandleFunc("/wmapi/token-create", method(token_create, "POST"))
+	mux.HandleFunc("/wmapi/token-delete", method(token_delete, "POST"))
+	// REST API v2
+	registerApiV2(mux)
+	mux.HandleFunc("/metrics", method(metrics, "GET"))
+	mux.HandleFunc("/healthz", method(healthz, "GET", "HEAD"))
+	mux.HandleFunc("/readyz", method(readyz, "GET", "HEAD"))
+	return request_log(base_path(metrics_middleware(mux, csrf_protect(mux))))
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	var bind, passwd string
-	var genpass bool
+	// 子命令
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+	var passwd, configPath, migrateCmd string
+	var genpass, printConfig bool
 	flag.BoolVar(&genpass, "genpass", false, "生成hash密码")
 	flag.StringVar(&passwd, "gen-password", "markdown", "需要加密的密码")
-	flag.StringVar(&DATA_DIR, "data", "markdown", "文档存储目录")
-	flag.StringVar(&bind, "bind", "127.0.0.1:11990", "绑定host与端口信息")
-	flag.StringVar(&SESSIONS_DIR, "sessions", "sessions", "会话持久化目录")
+	flag.BoolVar(&printConfig, "print-config", false, "输出生效的配置后退出")
+	flag.StringVar(&migrateCmd, "migrate", "", "数据库迁移：status 查看状态，dry-run 试运行后回滚，up 执行迁移")
+	configFlags(flag.CommandLine, &configPath)
 	flag.Parse()
 
 	if genpass {
@@ -1558,48 +1417,58 @@ func main() {
 		return
 	}
 
-	db, err := sql.Open("sqlite3", "./webmark.db?_journal_mode=WAL") // 文件不存在会自动创建
-	if err != nil {
+	if err := loadConfig(flag.CommandLine, configPath, os.Args[1:]); err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	if printConfig {
+		Conf.Print(os.Stdout)
+		return
+	}
 
-	if err = db.Ping(); err != nil {
+	if err := openDB(); err != nil {
 		log.Fatal(err)
 	}
-	GDB = db
 
-	createTable()
+	if migrateCmd != "" {
+		err := migrate(migrateCmd)
+		closeDB()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// 数据库比程序新时拒绝启动
+	if err := createTable(); err != nil {
+		log.Fatal(err)
+	}
 
-	log.Println("浏览器地址：http://" + bind)
+	var scheme = "http"
+	if Conf.TLS.Enabled {
+		scheme = "https"
+	}
+	slog.Info("listening", "url", scheme+"://"+Conf.Server.Bind+BasePath+"/")
+	initDataLock()
 	init_work()
-	go Job()
-	webroot, _ := fs.Sub(staticFiles, "page")
-	multiDir := StaticEntry{StaticFs: http.FS(webroot), MarkdownFs: http.Dir(DATA_DIR + "/")}
-	http.Handle("/", auth_static(http.FileServer(multiDir)))
-	// http.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir("page/"))))
-	// http.Handle("/markdown/", auth_markdown(http.FileServer(http.Dir(DATA_DIR+"/"))))
-	http.HandleFunc("/wmapi/upload/", upload)
-	http.HandleFunc("/wmapi/login", login)
-	http.HandleFunc("/wmapi/logout", logout)
-	http.HandleFunc("/wmapi/group-list", group_list)
-	http.HandleFunc("/wmapi/new-group", new_group)
-	http.HandleFunc("/wmapi/new-markdown/", new_markdown)
-	http.HandleFunc("/wmapi/update-markdown/", update_markdown)
-	http.HandleFunc("/wmapi/del-markdown/", del_markdown)
-	http.HandleFunc("/wmapi/del-group/", del_group)
-	http.HandleFunc("/wmapi/user-password-update", user_password_update)
-	http.HandleFunc("/wmapi/new-user", new_user)
-	http.HandleFunc("/wmapi/export/", export)
-	http.HandleFunc("/wmapi/search-detail", search_detail)
-	// 刷新索引
-	http.HandleFunc("/wmapi/update-index", updateIndex)
-	// 公开文档相关
-	http.HandleFunc("/wmapi/public-list", public_list)
-	http.HandleFunc("/wmapi/public-search", public_search)
-	http.HandleFunc("/wmapi/public-markdown/", public_markdown)
-	http.HandleFunc("/wmapi/update-public/", update_public)
-	http.HandleFunc("/wmapi/get-public/", get_public_status)
-	server := http.Server{Addr: bind}
-	server.ListenAndServe()
+	if GitEnabled {
+		gitInitAll()
+	}
+	goBackground(Job)
+	if WatchEnabled {
+		goBackground(watchData)
+	}
+	server := http.Server{Addr: Conf.Server.Bind, Handler: newHandler(http.DefaultServeMux)}
+	var redirect *http.Server
+	if Conf.TLS.Enabled {
+		tlsConfig, err := tlsServerConfig(Conf.TLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig = tlsConfig
+		if Conf.TLS.RedirectBind != "" {
+			redirect = &http.Server{Addr: Conf.TLS.RedirectBind, Handler: http.HandlerFunc(https_redirect)}
+		}
+	}
+	if err := serve(&server, redirect); err != nil {
+		log.Fatal(err)
+	}
 }
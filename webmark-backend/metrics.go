@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"webmark/storage"
+)
+
+// Prometheus 指标，文本格式 0.0.4，默认关闭
+var MetricsEnabled = false
+
+// 不为空时抓取需要带上 Authorization: Bearer <token>
+// 为空时任何人都能抓取，按用户统计的指标只输出合计，不暴露用户名
+var MetricsToken = ""
+
+// 存储占用需要遍历所有文件，缓存一段时间
+var storageUsageTTL = time.Minute
+
+var (
+	httpRequests = newCounter("webmark_http_requests_total", "HTTP 请求数", "route", "method", "code")
+	httpDuration = newHistogram("webmark_http_request_duration_seconds", "HTTP 请求耗时",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "route")
+	loginFailures = newCounter("webmark_login_failures_total", "登录失败次数(密码、验证码、Basic 认证)")
+	loginLockouts = newCounter("webmark_login_lockouts_total", "失败次数达到上限被锁定的次数")
+	indexDuration = newHistogram("webmark_index_duration_seconds", "单篇文档建立索引的耗时",
+		[]float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1})
+)
+
+// 数据目录监听中等待处理的路径数
+var indexQueueDepth atomic.Int64
+
+// 带标签的计数器
+type counter struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64 // 标签值以 \x00 连接
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	return &counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counter) Inc(values ...string) {
+	c.mu.Lock()
+	c.values[strings.Join(values, "\x00")]++
+	c.mu.Unlock()
+}
+
+func (c *counter) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelString(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+// 带标签的直方图
+type histogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	values     map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64 // 与 buckets 对应，不累加
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	return &histogram{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+}
+
+func (h *histogram) Observe(v float64, values ...string) {
+	var key = strings.Join(values, "\x00")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *histogram) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var keys = make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += hv.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, key, "le", formatFloat(b)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, key, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelString(h.labels, key, "", ""), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, key, "", ""), hv.count)
+	}
+}
+
+// 抓取时计算的值
+type gaugeValue struct {
+	labels []string // 与 writeGauge 的 labels 对应
+	value  float64
+}
+
+func writeGauge(w *bufio.Writer, name, help string, labels []string, values []gaugeValue) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, v := range values {
+		fmt.Fprintf(w, "%s%s %s\n", name, labelString(labels, strings.Join(v.labels, "\x00"), "", ""), formatFloat(v.value))
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	var keys = make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// {a="1",b="2"}，extra 不为空时追加(直方图的 le)
+func labelString(names []string, key, extra, extraValue string) string {
+	var pairs = make([]string, 0, len(names)+1)
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\x00") {
+			if i < len(names) {
+				pairs = append(pairs, names[i]+"="+strconv.Quote(v))
+			}
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra+"="+strconv.Quote(extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// 记录状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// 请求方法标签，客户端可以发送任意方法名，未知的统一记为 other
+func metricMethod(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "PATCH", "OPTIONS",
+		"PROPFIND", "PROPPATCH", "MKCOL", "MOVE", "COPY", "LOCK", "UNLOCK":
+		return method
+	}
+	return "other"
+}
+
+// 按路由统计请求数与耗时，路由取注册时的模式，避免路径参数导致标签过多
+func metrics_middleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start = time.Now()
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		httpRequests.Inc(route, metricMethod(r.Method), strconv.Itoa(rec.status))
+		httpDuration.Observe(time.Since(start).Seconds(), route)
+	})
+}
+
+// 各用户的存储占用
+var storageUsage struct {
+	sync.Mutex
+	at    time.Time
+	bytes map[string]int64
+}
+
+func userStorageBytes() map[string]int64 {
+	storageUsage.Lock()
+	defer storageUsage.Unlock()
+	if storageUsage.bytes != nil && time.Since(storageUsage.at) < storageUsageTTL {
+		return storageUsage.bytes
+	}
+	var usage = make(map[string]int64)
+	err := storage.Walk(Store, "", func(key string, info storage.FileInfo) error {
+		username, _, _ := strings.Cut(key, "/")
+		if ignored(info.Name) {
+			// 版本库、锁文件与临时文件不计入
+			if info.IsDir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir {
+			usage[username] += info.Size
+		} else if _, ok := usage[username]; !ok {
+			usage[username] = 0
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("metrics storage walk failed", "err", err)
+	}
+	storageUsage.at, storageUsage.bytes = time.Now(), usage
+	return usage
+}
+
+// 按用户统计的数量
+func countByUser(query string, args ...any) ([]gaugeValue, error) {
+	rows, err := GDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res = make([]gaugeValue, 0)
+	for rows.Next() {
+		var username string
+		var n float64
+		if err := rows.Scan(&username, &n); err != nil {
+			return nil, err
+		}
+		res = append(res, gaugeValue{labels: []string{username}, value: n})
+	}
+	return res, rows.Err()
+}
+
+func countOne(query string, args ...any) float64 {
+	var n float64
+	if err := GDB.QueryRow(query, args...).Scan(&n); err != nil {
+		slog.Error("metrics query failed", "err", err)
+	}
+	return n
+}
+
+// /metrics
+func metrics(w http.ResponseWriter, r *http.Request) {
+	if !MetricsEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	if MetricsToken != "" {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(MetricsToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	httpRequests.write(bw)
+	httpDuration.write(bw)
+	loginFailures.write(bw)
+	loginLockouts.write(bw)
+	indexDuration.write(bw)
+
+	var now = time.Now()
+	active, err := GDB.Sessions.CountActive(now.Unix(), now.Add(-SessionIdleTimeout).Unix())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "metrics query failed", "err", err)
+	}
+	writeGauge(bw, "webmark_sessions_active", "未过期的登录会话", nil, []gaugeValue{{value: float64(active)}})
+	locked, err := GDB.Users.CountLocked(LoginMaxFailures)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "metrics query failed", "err", err)
+	}
+	writeGauge(bw, "webmark_login_locked_accounts", "当前被锁定的账户", nil, []gaugeValue{{value: float64(locked)}})
+	var perUser = MetricsToken != ""
+	if docs, err := countByUser(`select username, count(1) from docs_info group by username`); err == nil {
+		writeUserGauge(bw, "webmark_documents", "已索引的文档数", docs, perUser)
+	} else {
+		slog.ErrorContext(r.Context(), "metrics query failed", "err", err)
+	}
+	if groups, err := countByUser(`select username, count(1) from docs_group group by username`); err == nil {
+		writeUserGauge(bw, "webmark_groups", "分组数", groups, perUser)
+	} else {
+		slog.ErrorContext(r.Context(), "metrics query failed", "err", err)
+	}
+	writeGauge(bw, "webmark_public_documents", "公开的文档数", nil, []gaugeValue{{
+		value: countOne(`select count(1) from docs_info where is_public = 1`),
+	}})
+	writeGauge(bw, "webmark_public_views", "公开文档的累计访问次数", nil, []gaugeValue{{
+		value: countOne(`select coalesce(sum(view_count), 0) from docs_info where is_public = 1`),
+	}})
+	writeGauge(bw, "webmark_index_queue_depth", "数据目录监听中等待刷新索引的路径数", nil, []gaugeValue{{
+		value: float64(indexQueueDepth.Load()),
+	}})
+	var running float64
+	if getReconcileStatus().Running {
+		running = 1
+	}
+	writeGauge(bw, "webmark_reconcile_running", "是否正在对账", nil, []gaugeValue{{value: running}})
+
+	var usage = userStorageBytes()
+	var users = make([]string, 0, len(usage))
+	for username := range usage {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+	var bytes = make([]gaugeValue, 0, len(users))
+	for _, username := range users {
+		bytes = append(bytes, gaugeValue{labels: []string{username}, value: float64(usage[username])})
+	}
+	writeUserGauge(bw, "webmark_storage_bytes", "文档与附件占用的字节数", bytes, perUser)
+}
+
+// 按用户统计的指标，perUser 为 false 时只输出合计
+func writeUserGauge(w *bufio.Writer, name, help string, values []gaugeValue, perUser bool) {
+	if perUser {
+		writeGauge(w, name, help, []string{"user"}, values)
+		return
+	}
+	var total float64
+	for _, v := range values {
+		total += v.value
+	}
+	writeGauge(w, name, help, nil, []gaugeValue{{value: total}})
+}
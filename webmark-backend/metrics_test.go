@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricMethod(t *testing.T) {
+	var tests = []struct {
+		method string
+		want   string
+	}{
+		{"GET", "GET"},
+		{"PROPFIND", "PROPFIND"},
+		{"UNLOCK", "UNLOCK"},
+		{"get", "other"},
+		{"BREW", "other"},
+		{strings.Repeat("X", 100), "other"},
+	}
+	for _, tt := range tests {
+		if got := metricMethod(tt.method); got != tt.want {
+			t.Errorf("metricMethod(%q) = %q, want %q", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestMetricsMiddlewareMethod(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics-test", func(w http.ResponseWriter, r *http.Request) {})
+	h := metrics_middleware(mux, mux)
+	for _, m := range []string{"RANDOM1", "RANDOM2"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(m, "/metrics-test", nil))
+	}
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	httpRequests.write(bw)
+	bw.Flush()
+	if strings.Contains(buf.String(), "RANDOM") {
+		t.Fatalf("arbitrary method exported as a label:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `route="/metrics-test",method="other"`) {
+		t.Fatalf("missing other method label:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"webmark/repo"
+	"webmark/webauthn"
+)
+
+// 通行密钥依赖方ID，为空时取请求的主机名
+var WebAuthnRPID = ""
+
+// 通行密钥来源，为空时根据请求推断，如 https://notes.example.com
+var WebAuthnOrigin = ""
+
+// 注册/登录挑战有效期
+const WebAuthnChallengeExpires = 5 * time.Minute
+
+// 依赖方ID和来源
+func webauthnRP(r *http.Request) (string, string) {
+	var rpID = WebAuthnRPID
+	if rpID == "" {
+		rpID = requestHost(r)
+		if host, _, err := net.SplitHostPort(rpID); err == nil {
+			rpID = host
+		}
+	}
+	var origin = WebAuthnOrigin
+	if origin == "" {
+		origin = requestScheme(r) + "://" + requestHost(r)
+	}
+	return rpID, origin
+}
+
+func b64decode(s string) ([]byte, error) {
+	return webauthn.Encoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// 保存挑战，注册时同时记下发给认证器的用户句柄
+func newWebAuthnChallenge(username, handle, kind string) (string, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", err
+	}
+	err = GDB.WebAuthn.CreateChallenge(&repo.Challenge{
+		Challenge:  challenge,
+		Username:   username,
+		UserHandle: handle,
+		Kind:       kind,
+		Expire:     time.Now().Add(WebAuthnChallengeExpires).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// 取出挑战(一次性)
+func takeWebAuthnChallenge(clientDataJSON []byte, kind string) (*repo.Challenge, bool) {
+	var cd webauthn.ClientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil || cd.Challenge == "" {
+		return nil, false
+	}
+	c, err := GDB.WebAuthn.TakeChallenge(cd.Challenge, kind)
+	if err != nil || c.Expire < time.Now().Unix() {
+		return nil, false
+	}
+	return c, true
+}
+
+// 清理过期的挑战
+func webauthnChallengeClear() {
+	err := GDB.WebAuthn.ExpireChallenges(time.Now().Unix())
+	if err != nil {
+		slog.Error("webauthn challenge clear failed", "err", err)
+	}
+}
+
+// 浏览器 PublicKeyCredential.toJSON() 的格式
+type PasskeyCredential struct {
+	Id       string `json:"id"`
+	RawId    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+// 用户已注册的凭据
+func userCredentials(username string) []credentialDescriptor {
+	var res = make([]credentialDescriptor, 0)
+	creds, err := GDB.WebAuthn.Credentials(username)
+	if err != nil {
+		return res
+	}
+	for _, c := range creds {
+		res = append(res, credentialDescriptor{Type: "public-key", Id: c.ID})
+	}
+	return res
+}
+
+// 用户句柄，同一用户的多个凭据共用
+func userHandle(username string) string {
+	handle, err := GDB.WebAuthn.UserHandle(username)
+	if err != nil || handle == "" {
+		handle, _ = webauthn.NewChallenge()
+	}
+	return handle
+}
+
+// 开始注册通行密钥
+// /webauthn-register-begin
+func webauthn_register_begin(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	if r.Method != "POST" {
+		ErrorResponse(w, r)
+		return
+	}
+	var handle = userHandle(session.Name)
+	challenge, err := newWebAuthnChallenge(session.Name, handle, "register")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "webauthn challenge failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	rpID, _ := webauthnRP(r)
+	var params = make([]map[string]any, 0, len(webauthn.SupportedAlgs))
+	for _, alg := range webauthn.SupportedAlgs {
+		params = append(params, map[string]any{"type": "public-key", "alg": alg})
+	}
+	SuccessResponse(w, r, map[string]any{
+		"challenge": challenge,
+		"rp":        map[string]string{"id": rpID, "name": TotpIssuer},
+		"user": map[string]string{
+			"id":          handle,
+			"name":        session.Name,
+			"displayName": session.Name,
+		},
+		"pubKeyCredParams":   params,
+		"timeout":            WebAuthnChallengeExpires.Milliseconds(),
+		"attestation":        "none",
+		"excludeCredentials": userCredentials(session.Name),
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+	})
+}
+
+type PasskeyRegister struct {
+	Name       string            `json:"name"` // 凭据名称，便于区分设备
+	Credential PasskeyCredential `json:"credential"`
+}
+
+// 完成注册
+// /webauthn-register-finish
+func webauthn_register_finish(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	if r.Method != "POST" {
+		ErrorResponse(w, r)
+		return
+	}
+	var pr PasskeyRegister
+	if nil != ReadJson(r, &pr) {
+		ErrorResponse(w, r)
+		return
+	}
+	clientData, err1 := b64decode(pr.Credential.Response.ClientDataJSON)
+	attestation, err2 := b64decode(pr.Credential.Response.AttestationObject)
+	if err1 != nil || err2 != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	c, ok := takeWebAuthnChallenge(clientData, "register")
+	if !ok || c.Username != session.Name {
+		ErrorResponseWithMsg(w, r, "注册已过期，请重试")
+		return
+	}
+	rpID, origin := webauthnRP(r)
+	cred, err := webauthn.VerifyRegistration(rpID, origin, c.Challenge, clientData, attestation, false)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "webauthn register failed", "err", err)
+		ErrorResponseWithMsg(w, r, "通行密钥校验失败")
+		return
+	}
+	var name = strings.TrimSpace(pr.Name)
+	if name == "" {
+		name = "passkey"
+	}
+	err = GDB.WebAuthn.AddCredential(&repo.Credential{
+		ID:         webauthn.Encoding.EncodeToString(cred.ID),
+		Username:   session.Name,
+		UserHandle: c.UserHandle,
+		PublicKey:  cred.PublicKey,
+		SignCount:  cred.SignCount,
+		Name:       name,
+		CreateAt:   time.Now().Unix(),
+	})
+	if errors.Is(err, repo.ErrExists) {
+		ErrorResponseWithMsg(w, r, "通行密钥已存在")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "webauthn register failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	SuccessResponse(w, r, true)
+}
+
+type PasskeyLoginBegin struct {
+	Username string `json:"username"` // 可选，为空时由认证器选择可发现凭据
+}
+
+// 开始通行密钥登录
+// /webauthn-login-begin
+func webauthn_login_begin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		ErrorResponse(w, r)
+		return
+	}
+	var pl PasskeyLoginBegin
+	if nil != ReadJson(r, &pl) {
+		ErrorResponse(w, r)
+		return
+	}
+	challenge, err := newWebAuthnChallenge(pl.Username, "", "login")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "webauthn challenge failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	rpID, _ := webauthnRP(r)
+	var allow = make([]credentialDescriptor, 0)
+	if pl.Username != "" {
+		allow = userCredentials(pl.Username)
+	}
+	SuccessResponse(w, r, map[string]any{
+		"challenge":        challenge,
+		"rpId":             rpID,
+		"timeout":          WebAuthnChallengeExpires.Milliseconds(),
+		"allowCredentials": allow,
+		"userVerification": "preferred",
+	})
+}
+
+// 完成通行密钥登录，校验通过后创建会话；开启了两步验证时发放登录票据
+// /webauthn-login-finish
+func webauthn_login_finish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		ErrorResponse(w, r)
+		return
+	}
+	var pc PasskeyCredential
+	if nil != ReadJson(r, &pc) {
+		ErrorResponse(w, r)
+		return
+	}
+	clientData, err1 := b64decode(pc.Response.ClientDataJSON)
+	authData, err2 := b64decode(pc.Response.AuthenticatorData)
+	signature, err3 := b64decode(pc.Response.Signature)
+	rawId, err4 := b64decode(pc.RawId)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	c, ok := takeWebAuthnChallenge(clientData, "login")
+	if !ok {
+		ErrorResponseWithMsg(w, r, "登录已过期，请重试")
+		return
+	}
+	var credential_id = webauthn.Encoding.EncodeToString(rawId)
+	cred, err := GDB.WebAuthn.Credential(credential_id)
+	if err != nil {
+		ErrorResponseWithMsg(w, r, "通行密钥未注册")
+		return
+	}
+	var username, handle, sign_count = cred.Username, cred.UserHandle, cred.SignCount
+	if c.Username != "" && c.Username != username {
+		ErrorResponseWithMsg(w, r, "通行密钥未注册")
+		return
+	}
+	if pc.Response.UserHandle != "" && strings.TrimRight(pc.Response.UserHandle, "=") != handle {
+		ErrorResponseWithMsg(w, r, "通行密钥未注册")
+		return
+	}
+	// 与密码共用失败计数
+	if loginLocked(username) {
+		ErrorResponseWithMsg(w, r, "fack off")
+		return
+	}
+	rpID, origin := webauthnRP(r)
+	ad, err := webauthn.VerifyAssertion(rpID, origin, c.Challenge, cred.PublicKey, clientData, authData, signature, false)
+	if err != nil {
+		slog.WarnContext(r.Context(), "webauthn login failed", "user", username, "err", err)
+		loginErr(username)
+		ErrorResponseWithMsg(w, r, "通行密钥校验失败")
+		return
+	}
+	if !webauthn.SignCountValid(sign_count, ad.SignCount) {
+		slog.WarnContext(r.Context(), "webauthn sign count did not increase", "user", username, "credential", credential_id, "stored", sign_count, "received", ad.SignCount)
+		loginErr(username)
+		ErrorResponseWithMsg(w, r, "通行密钥校验失败")
+		return
+	}
+	// 并发使用同一个签名计数时只有一个能更新成功
+	updated, err := GDB.WebAuthn.UpdateSignCount(credential_id, sign_count, ad.SignCount, time.Now().Unix())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "webauthn update failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	if !updated {
+		slog.WarnContext(r.Context(), "webauthn sign count changed concurrently", "user", username, "credential", credential_id)
+		loginErr(username)
+		ErrorResponseWithMsg(w, r, "通行密钥校验失败")
+		return
+	}
+	if totpEnabled(username) {
+		// 认证器不一定校验了用户(UV)，与密码登录一样还需要验证码
+		ticket, err := newLoginTicket(username)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "login ticket failed", "err", err)
+			ErrorResponse(w, r)
+			return
+		}
+		SuccessResponse(w, r, map[string]any{"totp": true, "ticket": ticket})
+		return
+	}
+	if err := createSession(w, r, username); err != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	SuccessResponse(w, r, "success")
+}
+
+type PasskeyInfo struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	CreateAt int64  `json:"create_at"`
+	LastUsed int64  `json:"last_used"`
+}
+
+// 当前用户的通行密钥
+// /webauthn-list
+func webauthn_list(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	creds, err := GDB.WebAuthn.Credentials(session.Name)
+	if err != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	var res = make([]*PasskeyInfo, 0, len(creds))
+	for _, c := range creds {
+		res = append(res, &PasskeyInfo{Id: c.ID, Name: c.Name, CreateAt: c.CreateAt, LastUsed: c.LastUsed})
+	}
+	SuccessResponse(w, r, res)
+}
+
+type PasskeyDelete struct {
+	Id string `json:"id"`
+}
+
+// 删除通行密钥
+// /webauthn-delete
+func webauthn_delete(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	if r.Method != "POST" {
+		ErrorResponse(w, r)
+		return
+	}
+	var pd PasskeyDelete
+	if nil != ReadJson(r, &pd) {
+		ErrorResponse(w, r)
+		return
+	}
+	err := GDB.WebAuthn.DeleteCredential(session.Name, pd.Id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "webauthn delete failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	SuccessResponse(w, r, true)
+}
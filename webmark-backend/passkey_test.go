@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+	"time"
+
+	"webmark/repo"
+	"webmark/utils"
+	"webmark/webauthn"
+)
+
+// 已注册到 root 的软件认证器，ES256 密钥
+type testPasskey struct {
+	key       *ecdsa.PrivateKey
+	credID    []byte
+	signCount uint32
+}
+
+func newTestPasskey(t *testing.T) *testPasskey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPasskey{key: key, credID: []byte("test-credential")}
+	// COSE_Key {1: 2, 3: -7, -1: 1, -2: x, -3: y}
+	var cose bytes.Buffer
+	cose.Write([]byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21, 0x58, 0x20})
+	cose.Write(key.X.FillBytes(make([]byte, 32)))
+	cose.Write([]byte{0x22, 0x58, 0x20})
+	cose.Write(key.Y.FillBytes(make([]byte, 32)))
+	err = GDB.WebAuthn.AddCredential(&repo.Credential{
+		ID:         webauthn.Encoding.EncodeToString(p.credID),
+		Username:   "root",
+		UserHandle: "root-handle",
+		PublicKey:  cose.Bytes(),
+		Name:       "test",
+		CreateAt:   time.Now().Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// 调用 /wmapi 接口，返回 data 字段
+func postWmapi(t *testing.T, c *http.Client, u, path string, in any) (json.RawMessage, bool) {
+	t.Helper()
+	b, _ := json.Marshal(in)
+	res, err := c.Post(u+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var out struct {
+		Ok   bool            `json:"ok"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.Data, out.Ok
+}
+
+func hasCookie(jar http.CookieJar, u *url.URL, name string) bool {
+	for _, c := range jar.Cookies(u) {
+		if c.Name == name && c.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// 完整走一遍通行密钥登录，返回 webauthn-login-finish 的结果
+func (p *testPasskey) login(t *testing.T, c *http.Client, u string) (json.RawMessage, bool) {
+	t.Helper()
+	data, ok := postWmapi(t, c, u, "/wmapi/webauthn-login-begin", map[string]string{"username": "root"})
+	if !ok {
+		t.Fatalf("login begin: %s", data)
+	}
+	var begin struct {
+		Challenge string `json:"challenge"`
+		RpId      string `json:"rpId"`
+	}
+	if err := json.Unmarshal(data, &begin); err != nil {
+		t.Fatal(err)
+	}
+	cdj, _ := json.Marshal(map[string]string{"type": "webauthn.get", "challenge": begin.Challenge, "origin": u})
+	p.signCount++
+	rpHash := sha256.Sum256([]byte(begin.RpId))
+	var ad bytes.Buffer
+	ad.Write(rpHash[:])
+	ad.WriteByte(webauthn.FlagUserPresent)
+	binary.Write(&ad, binary.BigEndian, p.signCount)
+	cdHash := sha256.Sum256(cdj)
+	digest := sha256.Sum256(append(ad.Bytes(), cdHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, p.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id = webauthn.Encoding.EncodeToString(p.credID)
+	var pc = map[string]any{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    webauthn.Encoding.EncodeToString(cdj),
+			"authenticatorData": webauthn.Encoding.EncodeToString(ad.Bytes()),
+			"signature":         webauthn.Encoding.EncodeToString(sig),
+		},
+	}
+	return postWmapi(t, c, u, "/wmapi/webauthn-login-finish", pc)
+}
+
+func TestServerPasskeyLogin(t *testing.T) {
+	srv := newTestServer(t)
+	p := newTestPasskey(t)
+	u, _ := url.Parse(srv.URL)
+
+	c := &http.Client{}
+	c.Jar, _ = cookiejar.New(nil)
+	if data, ok := p.login(t, c, srv.URL); !ok {
+		t.Fatalf("passkey login: %s", data)
+	}
+	if !hasCookie(c.Jar, u, "session_id") {
+		t.Fatal("passkey login did not create a session")
+	}
+
+	// 开启两步验证后，通行密钥登录同样需要验证码
+	secret, err := utils.GenerateTotpSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := GDB.TOTP.Setup("root", secret, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if err := GDB.TOTP.Enable("root"); err != nil {
+		t.Fatal(err)
+	}
+	c = &http.Client{}
+	c.Jar, _ = cookiejar.New(nil)
+	data, ok := p.login(t, c, srv.URL)
+	if !ok {
+		t.Fatalf("passkey login with totp: %s", data)
+	}
+	var res struct {
+		TOTP   bool   `json:"totp"`
+		Ticket string `json:"ticket"`
+	}
+	if err := json.Unmarshal(data, &res); err != nil || !res.TOTP || res.Ticket == "" {
+		t.Fatalf("passkey login with totp = %s, want ticket", data)
+	}
+	if hasCookie(c.Jar, u, "session_id") {
+		t.Fatal("passkey login created a session before totp")
+	}
+	code, err := utils.TotpCode(secret, utils.TotpStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := postWmapi(t, c, srv.URL, "/wmapi/totp-login", map[string]string{"ticket": res.Ticket, "code": code}); !ok {
+		t.Fatalf("totp login: %s", data)
+	}
+	if !hasCookie(c.Jar, u, "session_id") {
+		t.Fatal("totp login did not create a session")
+	}
+}
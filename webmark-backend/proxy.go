@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// 挂载路径，如 /notes，根路径时为空；路由都注册在根路径下，请求进入时去掉前缀
+var BasePath = ""
+
+// 可信的反向代理，只有来自这些地址的 X-Forwarded-* 请求头才会被采用
+var TrustedProxies []*net.IPNet
+
+// 解析可信代理列表，支持单个IP与 CIDR
+func parseTrustedProxies(items []string) ([]*net.IPNet, error) {
+	var nets = make([]*net.IPNet, 0, len(items))
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("server.trusted_proxies: invalid address %q", item)
+			}
+			var bits = 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("server.trusted_proxies: %w", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func trustedIP(s string) bool {
+	ip := net.ParseIP(strings.TrimSpace(s))
+	if ip == nil {
+		return false
+	}
+	for _, n := range TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 请求是否直接来自可信代理
+func fromTrustedProxy(r *http.Request) bool {
+	if len(TrustedProxies) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return trustedIP(host)
+}
+
+// 多级代理时请求头可能有多个值，取最后一个(直接相连的可信代理写入)
+// 前面的值可能是客户端自己带上的，与 clientIP 一样不能采信
+func forwardedHeader(r *http.Request, name string) string {
+	if !fromTrustedProxy(r) {
+		return ""
+	}
+	var values = r.Header.Values(name)
+	if len(values) == 0 {
+		return ""
+	}
+	var v = values[len(values)-1]
+	if i := strings.LastIndex(v, ","); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.TrimSpace(v)
+}
+
+// 客户端看到的协议
+func requestScheme(r *http.Request) string {
+	if proto := strings.ToLower(forwardedHeader(r, "X-Forwarded-Proto")); proto == "https" || proto == "http" {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// 客户端访问的域名(含端口)
+func requestHost(r *http.Request) string {
+	if host := forwardedHeader(r, "X-Forwarded-Host"); host != "" {
+		return host
+	}
+	return r.Host
+}
+
+// 加上挂载路径，用于生成的链接、跳转与 cookie
+func basePath(p string) string {
+	return BasePath + p
+}
+
+// 去掉挂载路径，不在挂载路径下的请求返回 404
+func base_path(next http.Handler) http.Handler {
+	if BasePath == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == BasePath {
+			var target = BasePath + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		p, ok := strings.CutPrefix(r.URL.Path, BasePath+"/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/" + p
+		r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, BasePath)
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// 前端路由，直接打开(如订阅源中的链接)时返回首页
+var spaRoutes = map[string]bool{"/login": true, "/user-main": true, "/group-main": true, "/public-doc": true}
+
+// 首页注入挂载路径，前端据此拼接接口地址与路由，并声明公开文档的订阅源
+func serve_index(w http.ResponseWriter, r *http.Request) {
+	b, err := fs.ReadFile(staticFiles, "page/index.html")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var base = strconv.Quote(BasePath)
+	var inject = `<head><base href="` + BasePath + `/"><script>window.WEBMARK_BASE=` + base + `</script>` +
+		`<link rel="alternate" type="application/atom+xml" title="webmark" href="` + BasePath + `/wmapi/feed/atom">`
+	var page = strings.Replace(string(b), "<head>", inject, 1)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(page))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func withTrustedProxies(t *testing.T, items ...string) {
+	t.Helper()
+	nets, err := parseTrustedProxies(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := TrustedProxies
+	TrustedProxies = nets
+	t.Cleanup(func() { TrustedProxies = old })
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	withTrustedProxies(t, "10.0.0.0/8")
+	tests := []struct {
+		name       string
+		remote     string
+		headers    map[string][]string
+		host       string
+		scheme     string
+		clientAddr string
+	}{
+		{"direct", "203.0.113.5:1234", map[string][]string{"X-Forwarded-Host": {"evil.example.com"}, "X-Forwarded-Proto": {"https"}, "X-Forwarded-For": {"1.2.3.4"}},
+			"notes.example.com", "http", "203.0.113.5"},
+		{"trusted proxy", "10.0.0.2:1234", map[string][]string{"X-Forwarded-Host": {"public.example.com"}, "X-Forwarded-Proto": {"https"}, "X-Forwarded-For": {"198.51.100.7"}},
+			"public.example.com", "https", "198.51.100.7"},
+		// 客户端自带的值在前，代理追加的值在后
+		{"client supplied values", "10.0.0.2:1234", map[string][]string{"X-Forwarded-Host": {"evil.example.com, public.example.com"}, "X-Forwarded-Proto": {"http,https"}, "X-Forwarded-For": {"1.2.3.4, 198.51.100.7"}},
+			"public.example.com", "https", "198.51.100.7"},
+		{"repeated headers", "10.0.0.2:1234", map[string][]string{"X-Forwarded-Host": {"evil.example.com", "public.example.com"}, "X-Forwarded-For": {"1.2.3.4", "198.51.100.7, 10.0.0.3"}},
+			"public.example.com", "http", "198.51.100.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://notes.example.com/", nil)
+			r.RemoteAddr = tt.remote
+			for k, vs := range tt.headers {
+				for _, v := range vs {
+					r.Header.Add(k, v)
+				}
+			}
+			if got := requestHost(r); got != tt.host {
+				t.Errorf("requestHost = %s, want %s", got, tt.host)
+			}
+			if got := requestScheme(r); got != tt.scheme {
+				t.Errorf("requestScheme = %s, want %s", got, tt.scheme)
+			}
+			if got := clientIP(r); got != tt.clientAddr {
+				t.Errorf("clientIP = %s, want %s", got, tt.clientAddr)
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"webmark/storage"
+)
+
+// 同一时间只允许一个对账任务
+var errReconcileRunning = errors.New("reconcile is already running")
+
+var reconcileMu sync.Mutex
+
+// 最近一次对账的进度
+var reconcileStatus ReconcileReport
+var reconcileStatusMu sync.Mutex
+
+// 对账进度与结果
+type ReconcileReport struct {
+	Running       bool   `json:"running"`
+	Username      string `json:"username"` // 为空表示所有用户
+	Rebuild       bool   `json:"rebuild"`  // 是否清空索引后重建
+	StartAt       int64  `json:"start_at"`
+	EndAt         int64  `json:"end_at"`
+	Users         int    `json:"users"`          // 已处理的用户
+	Groups        int    `json:"groups"`         // 已处理的分组
+	Files         int    `json:"files"`          // 已扫描的文档
+	Indexed       int    `json:"indexed"`        // 新建或刷新索引的文档
+	Removed       int    `json:"removed"`        // 文件已不存在、删除索引的文档
+	RemovedGroups int    `json:"removed_groups"` // 目录已不存在、删除的分组
+	Errors        int    `json:"errors"`
+	Canceled      bool   `json:"canceled"`
+}
+
+func (r *ReconcileReport) String() string {
+	return fmt.Sprintf("users %d, groups %d, files %d, indexed %d, removed %d, removed groups %d, errors %d",
+		r.Users, r.Groups, r.Files, r.Indexed, r.Removed, r.RemovedGroups, r.Errors)
+}
+
+func setReconcileStatus(r *ReconcileReport) {
+	reconcileStatusMu.Lock()
+	reconcileStatus = *r
+	reconcileStatusMu.Unlock()
+}
+
+func getReconcileStatus() ReconcileReport {
+	reconcileStatusMu.Lock()
+	defer reconcileStatusMu.Unlock()
+	return reconcileStatus
+}
+
+// 文档内容哈希，与 docs_info.content_hash 比较
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// 对比数据目录与索引：
+// 新增或内容变化的文档刷新索引，文件已不存在的文档与目录已不存在的分组删除记录
+// username 为空时处理所有用户，rebuild 为 true 时先清空全文索引再全部重建
+func reconcile(ctx context.Context, username string, rebuild bool) (*ReconcileReport, error) {
+	if !reconcileMu.TryLock() {
+		return nil, errReconcileRunning
+	}
+	defer reconcileMu.Unlock()
+	// 与备份互斥，保证备份时数据库与文件一致
+	snapshotLock.RLock()
+	defer snapshotLock.RUnlock()
+
+	var report = &ReconcileReport{Running: true, Username: username, Rebuild: rebuild, StartAt: time.Now().Unix()}
+	setReconcileStatus(report)
+	defer func() {
+		report.Running = false
+		report.EndAt = time.Now().Unix()
+		setReconcileStatus(report)
+		slog.Info("reconcile finished", "report", report.String())
+	}()
+	slog.Info("reconcile started", "user", username, "rebuild", rebuild)
+	if rebuild {
+		if err := GDB.Docs.ResetIndex(username); err != nil {
+			report.Errors++
+			return report, err
+		}
+	}
+	var users = []string{username}
+	if username == "" {
+		var err error
+		if users, err = reconcileUsers(); err != nil {
+			report.Errors++
+			return report, err
+		}
+	}
+	for _, u := range users {
+		if ctx.Err() != nil {
+			// 服务关闭时停止，下次对账时补上
+			report.Canceled = true
+			return report, ctx.Err()
+		}
+		if err := reconcileUser(ctx, u, report); err != nil {
+			return report, err
+		}
+		report.Users++
+		setReconcileStatus(report)
+	}
+	return report, nil
+}
+
+// 数据目录中的用户，以及数据库中有记录的用户
+func reconcileUsers() ([]string, error) {
+	var set = make(map[string]struct{})
+	items, err := Store.List("")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, item := range items {
+		if item.IsDir && !ignored(item.Name) {
+			set[item.Name] = struct{}{}
+		}
+	}
+	owners, err := GDB.Groups.Owners()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range owners {
+		set[name] = struct{}{}
+	}
+	var users = make([]string, 0, len(set))
+	for name := range set {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func reconcileUser(ctx context.Context, username string, report *ReconcileReport) error {
+	slog.Info("reconcile user", "user", username)
+	// 已索引的文档，处理完磁盘上的文件后剩下的就是已删除的
+	refs, err := GDB.Docs.List(username)
+	if err != nil {
+		report.Errors++
+		return err
+	}
+	var indexed = make(map[string]string, len(refs))
+	for _, ref := range refs {
+		indexed[path.Join(ref.Groupname, ref.Title)] = ref.Hash
+	}
+	var dbGroups = make(map[string]struct{})
+	registered, err := GDB.Groups.List(username)
+	if err != nil {
+		report.Errors++
+		return err
+	}
+	for _, g := range registered {
+		dbGroups[g.Name] = struct{}{}
+	}
+
+	groups, err := Store.List(username)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		report.Errors++
+		return err
+	}
+	for _, group := range groups {
+		if !group.IsDir || ignored(group.Name) {
+			continue
+		}
+		delete(dbGroups, group.Name)
+		group_check(username, group.Name)
+		files, err := Store.List(path.Join(username, group.Name))
+		if err != nil {
+			slog.Error("reconcile failed", "user", username, "err", err)
+			report.Errors++
+			continue
+		}
+		for _, file := range files {
+			if ctx.Err() != nil {
+				report.Canceled = true
+				return ctx.Err()
+			}
+			if file.IsDir || ignored(file.Name) || !strings.HasSuffix(file.Name, ".md") {
+				continue
+			}
+			report.Files++
+			title := strings.TrimSuffix(file.Name, ".md")
+			key := path.Join(group.Name, title)
+			hash, ok := indexed[key]
+			delete(indexed, key)
+			content, err := storage.ReadFile(Store, path.Join(username, group.Name, file.Name))
+			if err != nil {
+				slog.Error("reconcile failed", "user", username, "err", err)
+				report.Errors++
+				continue
+			}
+			if ok && hash == contentHash(content) {
+				continue
+			}
+			slog.Info("reconcile refresh index", "path", path.Join(username, key))
+			MakeIndex(username, group.Name, title, string(content))
+			report.Indexed++
+			if report.Indexed%100 == 0 {
+				setReconcileStatus(report)
+			}
+		}
+		report.Groups++
+		setReconcileStatus(report)
+	}
+	// 文件已不存在
+	for key := range indexed {
+		group, title := path.Split(key)
+		group = strings.TrimSuffix(group, "/")
+		if _, ok := dbGroups[group]; ok {
+			// 整个分组一起删除
+			continue
+		}
+		slog.Info("reconcile remove index", "path", path.Join(username, key))
+		DeleteIndex(username, group, title)
+		report.Removed++
+	}
+	// 目录已不存在的分组
+	for group := range dbGroups {
+		slog.Info("reconcile remove group", "path", path.Join(username, group))
+		if err := GDB.Docs.DeleteGroup(username, group); err != nil {
+			slog.Error("reconcile failed", "user", username, "err", err)
+			report.Errors++
+			continue
+		}
+		for key := range indexed {
+			if strings.HasPrefix(key, group+"/") {
+				report.Removed++
+			}
+		}
+		report.RemovedGroups++
+	}
+	return nil
+}
+
+// 对账，仅管理员
+// /reconcile
+func reconcile_start(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	if !isAdmin(session.Name) {
+		ErrorResponseWithStatus(w, r, http.StatusForbidden, "仅管理员可以对账")
+		return
+	}
+	var input struct {
+		Username string `json:"username"` // 为空处理所有用户
+		Rebuild  bool   `json:"rebuild"`
+	}
+	if err := ReadJson(r, &input); err != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	if getReconcileStatus().Running {
+		ErrorResponseWithMsg(w, r, "正在对账，请稍后")
+		return
+	}
+	if !goBackground(func(ctx context.Context) {
+		if _, err := reconcile(ctx, input.Username, input.Rebuild); err != nil {
+			slog.ErrorContext(r.Context(), "reconcile failed", "err", err)
+		}
+	}) {
+		ErrorResponseWithStatus(w, r, http.StatusServiceUnavailable, "服务正在关闭")
+		return
+	}
+	SuccessResponse(w, r, true)
+}
+
+// 对账进度
+// /reconcile-status
+func reconcile_status(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	if !isAdmin(session.Name) {
+		ErrorResponseWithStatus(w, r, http.StatusForbidden, "仅管理员可以查看")
+		return
+	}
+	SuccessResponse(w, r, getReconcileStatus())
+}
+
+// webmark reindex [-user name] [-rebuild]
+func cmd_reindex(args []string) error {
+	var configPath, username string
+	var rebuild bool
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	configFlags(fs, &configPath)
+	fs.StringVar(&username, "user", "", "只处理该用户，默认所有用户")
+	fs.BoolVar(&rebuild, "rebuild", false, "清空全文索引后重建")
+	fs.Parse(args)
+	if err := loadConfig(fs, configPath, args); err != nil {
+		return err
+	}
+	end, err := beginCommand()
+	if err != nil {
+		return err
+	}
+	defer end()
+	report, err := reconcile(context.Background(), username, rebuild)
+	if report != nil {
+		fmt.Println(report)
+	}
+	return err
+}
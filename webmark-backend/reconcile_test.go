@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"webmark/repo"
+)
+
+// 通过接口创建文档，索引与文件一致：
+// root/notes/hello、root/notes/world、root/old/legacy
+func newReconcileServer(t *testing.T) {
+	t.Helper()
+	srv := newTestServer(t)
+	ctx := context.Background()
+	cl, _ := loginRoot(t, srv)
+	for _, doc := range []struct{ group, title, content string }{
+		{"notes", "hello", "hello apple"},
+		{"notes", "world", "world banana"},
+		{"old", "legacy", "legacy cherry"},
+	} {
+		if err := cl.CreateDocument(ctx, doc.group, doc.title, doc.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func searchIndex(t *testing.T, group, query string) []string {
+	t.Helper()
+	titles, err := GDB.Docs.Search("root", group, splitWord(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(titles)
+	return titles
+}
+
+// 已索引的文档，group/title
+func indexedDocs(t *testing.T) []string {
+	t.Helper()
+	refs, err := GDB.Docs.List("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys = make([]string, 0, len(refs))
+	for _, ref := range refs {
+		keys = append(keys, ref.Groupname+"/"+ref.Title)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestReconcile(t *testing.T) {
+	cases := []struct {
+		name string
+		// 绕过接口直接修改数据目录
+		change  func(t *testing.T)
+		want    ReconcileReport
+		indexed []string
+		check   func(t *testing.T)
+	}{
+		{
+			name:    "unchanged",
+			change:  func(t *testing.T) {},
+			want:    ReconcileReport{Users: 1, Groups: 2, Files: 3},
+			indexed: []string{"notes/hello", "notes/world", "old/legacy"},
+		},
+		{
+			name: "modified file",
+			change: func(t *testing.T) {
+				if err := Store.Write("root/notes/hello.md", strings.NewReader("hello durian")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:    ReconcileReport{Users: 1, Groups: 2, Files: 3, Indexed: 1},
+			indexed: []string{"notes/hello", "notes/world", "old/legacy"},
+			check: func(t *testing.T) {
+				if got := searchIndex(t, "notes", "durian"); !reflect.DeepEqual(got, []string{"hello"}) {
+					t.Errorf("search new content = %v", got)
+				}
+				if got := searchIndex(t, "notes", "apple"); len(got) != 0 {
+					t.Errorf("search old content = %v", got)
+				}
+				if hash, err := GDB.Docs.Hash("root", "notes", "hello"); err != nil || hash != contentHash([]byte("hello durian")) {
+					t.Errorf("hash = %s, %v", hash, err)
+				}
+			},
+		},
+		{
+			name: "new file",
+			change: func(t *testing.T) {
+				if err := Store.Write("root/notes/fresh.md", strings.NewReader("fresh elderberry")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:    ReconcileReport{Users: 1, Groups: 2, Files: 4, Indexed: 1},
+			indexed: []string{"notes/fresh", "notes/hello", "notes/world", "old/legacy"},
+			check: func(t *testing.T) {
+				if got := searchIndex(t, "notes", "elderberry"); !reflect.DeepEqual(got, []string{"fresh"}) {
+					t.Errorf("search = %v", got)
+				}
+			},
+		},
+		{
+			name: "deleted file",
+			change: func(t *testing.T) {
+				if err := Store.Remove("root/notes/world.md"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:    ReconcileReport{Users: 1, Groups: 2, Files: 2, Removed: 1},
+			indexed: []string{"notes/hello", "old/legacy"},
+			check: func(t *testing.T) {
+				if got := searchIndex(t, "notes", "banana"); len(got) != 0 {
+					t.Errorf("search deleted = %v", got)
+				}
+				if _, err := GDB.Docs.Hash("root", "notes", "world"); !errors.Is(err, repo.ErrNotFound) {
+					t.Errorf("hash of deleted = %v", err)
+				}
+			},
+		},
+		{
+			name: "deleted group directory",
+			change: func(t *testing.T) {
+				if err := Store.RemoveAll("root/old"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:    ReconcileReport{Users: 1, Groups: 1, Files: 2, Removed: 1, RemovedGroups: 1},
+			indexed: []string{"notes/hello", "notes/world"},
+			check: func(t *testing.T) {
+				if _, err := GDB.Groups.Get("root", "old"); !errors.Is(err, repo.ErrNotFound) {
+					t.Errorf("group of deleted dir = %v", err)
+				}
+				if got := searchIndex(t, "old", "cherry"); len(got) != 0 {
+					t.Errorf("search deleted group = %v", got)
+				}
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			newReconcileServer(t)
+			tc.change(t)
+			report, err := reconcile(context.Background(), "root", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got = *report
+			got.StartAt, got.EndAt = 0, 0
+			tc.want.Username = "root"
+			if got != tc.want {
+				t.Errorf("report = %+v, want %+v", got, tc.want)
+			}
+			if keys := indexedDocs(t); !reflect.DeepEqual(keys, tc.indexed) {
+				t.Errorf("indexed = %v, want %v", keys, tc.indexed)
+			}
+			if tc.check != nil {
+				tc.check(t)
+			}
+			// 再次对账没有变化
+			again, err := reconcile(context.Background(), "root", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again.Indexed != 0 || again.Removed != 0 || again.RemovedGroups != 0 {
+				t.Errorf("second reconcile = %s", again)
+			}
+			if status := getReconcileStatus(); status.Running || status.Files != again.Files {
+				t.Errorf("status = %+v", status)
+			}
+		})
+	}
+}
+
+func TestReconcileRebuild(t *testing.T) {
+	newReconcileServer(t)
+	// 索引丢失且有文件被直接修改
+	if err := GDB.Docs.ResetIndex("root"); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchIndex(t, "notes", "apple"); len(got) != 0 {
+		t.Fatalf("search after reset = %v", got)
+	}
+	if err := Store.Write("root/notes/world.md", strings.NewReader("world fig")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := reconcile(context.Background(), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 重建时所有文档都重新索引
+	if report.Users != 1 || report.Files != 3 || report.Indexed != 3 || report.Removed != 0 || report.Errors != 0 || !report.Rebuild {
+		t.Errorf("report = %+v", report)
+	}
+	for _, tc := range []struct {
+		group, query string
+		want         []string
+	}{
+		{"notes", "apple", []string{"hello"}},
+		{"notes", "fig", []string{"world"}},
+		{"notes", "banana", nil},
+		{"old", "cherry", []string{"legacy"}},
+	} {
+		if got := searchIndex(t, tc.group, tc.query); strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("search %s %q = %v, want %v", tc.group, tc.query, got, tc.want)
+		}
+	}
+}
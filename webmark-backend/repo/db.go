@@ -0,0 +1,194 @@
+// 数据访问层，屏蔽 SQLite 与 PostgreSQL 的差异
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"           // 只注册驱动
+	_ "github.com/mattn/go-sqlite3" // 只注册驱动
+)
+
+// 数据库类型
+type Dialect string
+
+const (
+	SQLite   Dialect = "sqlite"
+	Postgres Dialect = "postgres"
+)
+
+// 记录不存在
+var ErrNotFound = errors.New("repo: not found")
+
+// 记录已存在
+var ErrExists = errors.New("repo: already exists")
+
+// 数据库连接，SQL 统一使用 ? 占位符，PostgreSQL 下自动转换为 $1、$2...
+type DB struct {
+	*sql.DB
+	Dialect  Dialect
+	Docs     Docs     // 文档与全文索引
+	Groups   Groups   // 分组
+	Users    Users    // 账户与登录失败记录
+	Sessions Sessions // 登录会话、两步验证票据与单点登录状态
+	TOTP     TOTP     // 两步验证密钥与恢复码
+	WebAuthn WebAuthn // 通行密钥与注册、登录挑战
+	Tokens   Tokens   // 访问令牌
+}
+
+// 打开数据库，sqlite 的 dsn 为文件路径
+func Open(dialect Dialect, dsn string) (*DB, error) {
+	var db *sql.DB
+	var err error
+	switch dialect {
+	case SQLite:
+		// 文件不存在会自动创建；事务以 BEGIN IMMEDIATE 开始，避免读后写升级锁时失败
+		db, err = sql.Open("sqlite3", dsn+"?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate")
+	case Postgres:
+		db, err = sql.Open("postgres", dsn)
+	default:
+		return nil, fmt.Errorf("repo: unknown dialect %q", dialect)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	var d = &DB{DB: db, Dialect: dialect}
+	d.Docs = newDocs(d)
+	d.Groups = &groups{db: d}
+	d.Users = &users{db: d}
+	d.Sessions = &sessions{db: d}
+	d.TOTP = &totp{db: d}
+	d.WebAuthn = &webauthn{db: d}
+	d.Tokens = &tokens{db: d}
+	return d, nil
+}
+
+// 把 ? 占位符转换为当前数据库的格式，字符串字面量中的 ? 不处理
+func (db *DB) Rebind(query string) string {
+	if db.Dialect != Postgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	var n = 0
+	var quoted = false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.Rebind(query), args...)
+}
+
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.Rebind(query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.Rebind(query), args...)
+}
+
+// 开启事务
+func (db *DB) Begin() (*Tx, error) {
+	tx, err := db.DB.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, db: db}, nil
+}
+
+// 事务，占位符规则与 DB 相同
+type Tx struct {
+	*sql.Tx
+	db *DB
+}
+
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.db.Rebind(query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.db.Rebind(query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(tx.db.Rebind(query), args...)
+}
+
+// 关闭前合并 WAL 日志，PostgreSQL 无需处理
+func (db *DB) Checkpoint() error {
+	if db.Dialect != SQLite {
+		return nil
+	}
+	_, err := db.DB.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`)
+	return err
+}
+
+// 查询结果不存在时转换为 ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// 读取单列字符串结果
+func scanStrings(rows *sql.Rows, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res = make([]string, 0)
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, rows.Err()
+}
+
+// 读取单列整数结果
+func scanInt64s(rows *sql.Rows, err error) ([]int64, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res = make([]int64, 0)
+	for rows.Next() {
+		var v int64
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+	return res, rows.Err()
+}
+
+// 是否恰好影响了一行，用于一次性数据(票据、挑战、恢复码)的并发消费
+func affectedOne(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
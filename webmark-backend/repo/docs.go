@@ -0,0 +1,509 @@
+package repo
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// 公开文档
+type PublicDoc struct {
+	Groupname string `json:"groupname"`
+	Title     string `json:"title"`
+	Username  string `json:"username"`
+	ViewCount int    `json:"view_count"`
+}
+
+// 订阅源中的公开文档，时间为 unix 秒
+type FeedDoc struct {
+	Username  string
+	Groupname string
+	Title     string
+	Published int64 // 最近一次公开的时间
+	Updated   int64 // 公开或内容变化时间中较晚的一个
+}
+
+// 已索引的文档
+type DocRef struct {
+	Username  string
+	Groupname string
+	Title     string
+	Hash      string // 建索引时文档内容的 sha256
+}
+
+// 文档描述(docs_info)与全文索引(docs)
+// 分词在调用方完成，terms 为分词后的关键词
+type Docs interface {
+	// 建立或刷新文档索引，hash 为文档内容的 sha256
+	Index(username, group, title, hash string, titleTerms, contentTerms []string) error
+	// 删除文档描述及索引
+	Delete(username, group, title string) error
+	// 删除分组下所有文档描述及索引
+	DeleteGroup(username, group string) error
+	// 分组内搜索，terms 为空时返回全部已建立全文索引的文档，按修改时间倒序返回标题
+	Search(username, group string, terms []string) ([]string, error)
+	// 建索引时文档内容的 sha256，未索引时返回 ErrNotFound
+	Hash(username, group, title string) (string, error)
+	// 已索引的文档，username 为空时返回所有用户
+	List(username string) ([]*DocRef, error)
+	// 清空全文索引并清除内容哈希，之后需要重新建索引，username 为空时清空所有用户
+	ResetIndex(username string) error
+	// 没有对应 docs_info 的全文索引
+	OrphanIndex() ([]int64, error)
+	// 删除一条全文索引
+	RemoveIndex(doc_id int64) error
+	// 有 docs_info 但没有全文索引的文档
+	Unindexed() ([]*DocRef, error)
+	// 公开文档列表，按点击量倒序
+	PublicList() ([]*PublicDoc, error)
+	// 搜索公开文档，terms 为空时按标题和分组名模糊匹配 query
+	PublicSearch(terms []string, query string) ([]*PublicDoc, error)
+	// 设置公开状态，由不公开变为公开时记录公开时间，文档未索引时返回 false
+	SetPublic(username, group, title string, public bool) (bool, error)
+	// 最近公开或修改的公开文档，username、group 为空时不限
+	Feed(username, group string, limit int) ([]*FeedDoc, error)
+	// 公开文档的作者，username 为空时不限，未公开时返回 ErrNotFound
+	PublicOwner(username, group, title string) (string, error)
+	// 公开文档的点击量加一
+	AddView(username, group, title string) error
+	// 文档的公开状态与点击量，未索引时返回 ErrNotFound
+	PublicStatus(username, group, title string) (public bool, views int, err error)
+	// 执行一次全文检索，确认索引可以查询
+	Ping() error
+}
+
+// 全文索引在两种数据库下的差异
+type fts interface {
+	// 写入索引
+	put(tx *Tx, doc_id int64, title, content string) error
+	// 删除索引
+	remove(tx *Tx, doc_id int64) error
+	// 与 docs_info di 关联并匹配关键词的 from 与 where 子句，以及对应的参数
+	match(terms []string) (from string, where string, arg any)
+	// 不区分大小写的模糊匹配
+	like() string
+	// 清空所有索引
+	reset(tx *Tx) error
+	// 索引中对应 doc_id 的字段
+	id() string
+}
+
+// SQLite，使用 fts5 虚拟表，rowid 即 doc_id
+type sqliteFTS struct{}
+
+func (sqliteFTS) put(tx *Tx, doc_id int64, title, content string) error {
+	_, err := tx.Exec(`insert into docs(rowid, title, content) values (?, ?, ?)`, doc_id, title, content)
+	return err
+}
+
+func (sqliteFTS) remove(tx *Tx, doc_id int64) error {
+	_, err := tx.Exec(`delete from docs where rowid = ?`, doc_id)
+	return err
+}
+
+func (sqliteFTS) match(terms []string) (string, string, any) {
+	return "docs d", "di.doc_id = d.rowid AND d.docs MATCH ?", strings.Join(terms, " AND ")
+}
+
+func (sqliteFTS) like() string {
+	return "LIKE"
+}
+
+func (sqliteFTS) id() string {
+	return "rowid"
+}
+
+// 重建虚拟表，索引损坏时也能恢复
+func (sqliteFTS) reset(tx *Tx) error {
+	return tx.execAll([]string{
+		`DROP TABLE IF EXISTS docs`,
+		`CREATE VIRTUAL TABLE docs USING fts5(title, content)`,
+	})
+}
+
+// PostgreSQL，docs.tsv 为 title 与 content 生成的 tsvector
+// 关键词已经分好，使用 simple 配置不再做词干处理
+type pgFTS struct{}
+
+func (pgFTS) put(tx *Tx, doc_id int64, title, content string) error {
+	_, err := tx.Exec(`insert into docs(doc_id, title, content) values (?, ?, ?)`, doc_id, title, content)
+	return err
+}
+
+func (pgFTS) remove(tx *Tx, doc_id int64) error {
+	_, err := tx.Exec(`delete from docs where doc_id = ?`, doc_id)
+	return err
+}
+
+func (pgFTS) match(terms []string) (string, string, any) {
+	return "docs d", "di.doc_id = d.doc_id AND d.tsv @@ plainto_tsquery('simple', ?)", strings.Join(terms, " ")
+}
+
+func (pgFTS) like() string {
+	return "ILIKE"
+}
+
+func (pgFTS) id() string {
+	return "doc_id"
+}
+
+func (pgFTS) reset(tx *Tx) error {
+	_, err := tx.Exec(`TRUNCATE docs`)
+	return err
+}
+
+type docs struct {
+	db  *DB
+	fts fts
+}
+
+func newDocs(db *DB) *docs {
+	if db.Dialect == Postgres {
+		return &docs{db: db, fts: pgFTS{}}
+	}
+	return &docs{db: db, fts: sqliteFTS{}}
+}
+
+func (d *docs) Index(username, group, title, hash string, titleTerms, contentTerms []string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// 文档描述按 (username, groupname, title) 唯一，并发建索引时不会重复插入
+	// updated_at 只在内容变化时刷新；重建索引会清空内容哈希，此时视为未变化
+	var now = time.Now().Unix()
+	var doc_id int64
+	err = tx.QueryRow(`insert into docs_info(groupname, title, username, create_at, content_hash, updated_at) values (?, ?, ?, ?, ?, ?)
+		on conflict (username, groupname, title) do update set create_at = excluded.create_at, content_hash = excluded.content_hash,
+		updated_at = case when docs_info.content_hash in (excluded.content_hash, '') then docs_info.updated_at else excluded.updated_at end
+		returning doc_id`, group, title, username, now, hash, now).Scan(&doc_id)
+	if err != nil {
+		return err
+	}
+	if err = d.fts.remove(tx, doc_id); err != nil {
+		return err
+	}
+	if err = d.fts.put(tx, doc_id, strings.Join(titleTerms, " "), strings.Join(contentTerms, " ")); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *docs) Delete(username, group, title string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var doc_id int64
+	err = tx.QueryRow(`select doc_id from docs_info where groupname = ? and username = ? and title = ?`, group, username, title).Scan(&doc_id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = d.fts.remove(tx, doc_id); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`delete from docs_info where doc_id = ?`, doc_id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *docs) DeleteGroup(username, group string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`delete from docs_group where username = ? and groupname = ?`, username, group)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(`select doc_id from docs_info where username = ? and groupname = ?`, username, group)
+	if err != nil {
+		return err
+	}
+	var doc_ids = make([]int64, 0)
+	for rows.Next() {
+		var doc_id int64
+		if err := rows.Scan(&doc_id); err != nil {
+			rows.Close()
+			return err
+		}
+		doc_ids = append(doc_ids, doc_id)
+	}
+	rows.Close()
+	for _, doc_id := range doc_ids {
+		if err := d.fts.remove(tx, doc_id); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`delete from docs_info where username = ? and groupname = ?`, username, group)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *docs) Search(username, group string, terms []string) ([]string, error) {
+	var rows *sql.Rows
+	var err error
+	if len(terms) > 0 {
+		from, where, arg := d.fts.match(terms)
+		rows, err = d.db.Query(`select di.title from `+from+`, docs_info di where `+where+` and di.username = ? and di.groupname = ? order by di.create_at DESC`,
+			arg, username, group)
+	} else {
+		// 与全文索引关联，索引缺失(等待重建)的文档不列出
+		rows, err = d.db.Query(`select di.title from docs d, docs_info di where di.doc_id = d.`+d.fts.id()+` and di.username = ? and di.groupname = ? order by di.create_at DESC`,
+			username, group)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res = make([]string, 0)
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err != nil {
+			return nil, err
+		}
+		res = append(res, title)
+	}
+	return res, rows.Err()
+}
+
+func (d *docs) Hash(username, group, title string) (string, error) {
+	var hash string
+	err := d.db.QueryRow(`select coalesce(content_hash, '') from docs_info where username = ? and groupname = ? and title = ?`, username, group, title).Scan(&hash)
+	return hash, notFound(err)
+}
+
+func (d *docs) List(username string) ([]*DocRef, error) {
+	var query = `select username, groupname, title, coalesce(content_hash, '') from docs_info`
+	var args []any
+	if username != "" {
+		query += ` where username = ?`
+		args = append(args, username)
+	}
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res = make([]*DocRef, 0)
+	for rows.Next() {
+		var ref DocRef
+		if err := rows.Scan(&ref.Username, &ref.Groupname, &ref.Title, &ref.Hash); err != nil {
+			return nil, err
+		}
+		res = append(res, &ref)
+	}
+	return res, rows.Err()
+}
+
+func (d *docs) ResetIndex(username string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if username == "" {
+		if err := d.fts.reset(tx); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`update docs_info set content_hash = ''`); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	rows, err := tx.Query(`select doc_id from docs_info where username = ?`, username)
+	if err != nil {
+		return err
+	}
+	var doc_ids = make([]int64, 0)
+	for rows.Next() {
+		var doc_id int64
+		if err := rows.Scan(&doc_id); err != nil {
+			rows.Close()
+			return err
+		}
+		doc_ids = append(doc_ids, doc_id)
+	}
+	rows.Close()
+	for _, doc_id := range doc_ids {
+		if err := d.fts.remove(tx, doc_id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`update docs_info set content_hash = '' where username = ?`, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *docs) Ping() error {
+	from, where, arg := d.fts.match([]string{"webmark"})
+	var n int
+	return d.db.QueryRow(`select count(1) from (select di.doc_id from `+from+`, docs_info di where `+where+` limit 1) t`, arg).Scan(&n)
+}
+
+func (d *docs) OrphanIndex() ([]int64, error) {
+	var id = d.fts.id()
+	rows, err := d.db.Query(`select ` + id + ` from docs where ` + id + ` not in (select doc_id from docs_info)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res = make([]int64, 0)
+	for rows.Next() {
+		var doc_id int64
+		if err := rows.Scan(&doc_id); err != nil {
+			return nil, err
+		}
+		res = append(res, doc_id)
+	}
+	return res, rows.Err()
+}
+
+func (d *docs) RemoveIndex(doc_id int64) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := d.fts.remove(tx, doc_id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *docs) Unindexed() ([]*DocRef, error) {
+	rows, err := d.db.Query(`select username, groupname, title, coalesce(content_hash, '') from docs_info
+		where doc_id not in (select ` + d.fts.id() + ` from docs)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res = make([]*DocRef, 0)
+	for rows.Next() {
+		var ref DocRef
+		if err := rows.Scan(&ref.Username, &ref.Groupname, &ref.Title, &ref.Hash); err != nil {
+			return nil, err
+		}
+		res = append(res, &ref)
+	}
+	return res, rows.Err()
+}
+
+func (d *docs) PublicList() ([]*PublicDoc, error) {
+	return d.public(d.db.Query(`select groupname, title, username, view_count from docs_info where is_public = 1 ORDER BY view_count DESC`))
+}
+
+func (d *docs) PublicSearch(terms []string, query string) ([]*PublicDoc, error) {
+	if len(terms) > 0 {
+		from, where, arg := d.fts.match(terms)
+		return d.public(d.db.Query(`SELECT di.groupname, di.title, di.username, di.view_count
+			FROM `+from+`, docs_info di
+			WHERE `+where+` AND di.is_public = 1
+			ORDER BY di.view_count DESC`, arg))
+	}
+	// 没有分词结果，使用模糊匹配
+	var like = d.fts.like()
+	return d.public(d.db.Query(`
+		SELECT di.groupname, di.title, di.username, di.view_count
+		FROM docs_info di
+		WHERE di.is_public = 1 AND (di.title `+like+` ? OR di.groupname `+like+` ?)
+		ORDER BY di.view_count DESC
+	`, "%"+query+"%", "%"+query+"%"))
+}
+
+func (d *docs) SetPublic(username, group, title string, public bool) (bool, error) {
+	var res sql.Result
+	var err error
+	if public {
+		res, err = d.db.Exec(`update docs_info set is_public = 1, published_at = case when is_public = 1 then published_at else ? end
+			where username = ? and groupname = ? and title = ?`, time.Now().Unix(), username, group, title)
+	} else {
+		res, err = d.db.Exec(`update docs_info set is_public = 0 where username = ? and groupname = ? and title = ?`, username, group, title)
+	}
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (d *docs) Feed(username, group string, limit int) ([]*FeedDoc, error) {
+	var where = `is_public = 1`
+	var args = make([]any, 0, 3)
+	if username != "" {
+		where += ` and username = ?`
+		args = append(args, username)
+	}
+	if group != "" {
+		where += ` and groupname = ?`
+		args = append(args, group)
+	}
+	args = append(args, limit)
+	rows, err := d.db.Query(`select username, groupname, title, published_at, updated from (
+		select username, groupname, title, published_at, case when updated_at > published_at then updated_at else published_at end as updated
+		from docs_info where `+where+`) t order by updated desc limit ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res = make([]*FeedDoc, 0)
+	for rows.Next() {
+		var doc FeedDoc
+		if err := rows.Scan(&doc.Username, &doc.Groupname, &doc.Title, &doc.Published, &doc.Updated); err != nil {
+			return nil, err
+		}
+		res = append(res, &doc)
+	}
+	return res, rows.Err()
+}
+
+func (d *docs) PublicOwner(username, group, title string) (string, error) {
+	var where = `groupname = ? and title = ? and is_public = 1`
+	var args = []any{group, title}
+	if username != "" {
+		where += ` and username = ?`
+		args = append(args, username)
+	}
+	var owner string
+	err := d.db.QueryRow(`select username from docs_info where `+where+` order by doc_id limit 1`, args...).Scan(&owner)
+	return owner, notFound(err)
+}
+
+func (d *docs) AddView(username, group, title string) error {
+	_, err := d.db.Exec(`update docs_info set view_count = view_count + 1 where username = ? and groupname = ? and title = ? and is_public = 1`, username, group, title)
+	return err
+}
+
+func (d *docs) PublicStatus(username, group, title string) (bool, int, error) {
+	var public, views int
+	err := d.db.QueryRow(`select is_public, view_count from docs_info where username = ? and groupname = ? and title = ?`, username, group, title).
+		Scan(&public, &views)
+	return public == 1, views, notFound(err)
+}
+
+func (d *docs) public(rows *sql.Rows, err error) ([]*PublicDoc, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res = make([]*PublicDoc, 0)
+	for rows.Next() {
+		var doc PublicDoc
+		if err := rows.Scan(&doc.Groupname, &doc.Title, &doc.Username, &doc.ViewCount); err != nil {
+			continue
+		}
+		res = append(res, &doc)
+	}
+	return res, rows.Err()
+}
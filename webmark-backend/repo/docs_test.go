@@ -0,0 +1,75 @@
+package repo
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 临时目录中的 SQLite 数据库，没有 fts5 时跳过
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := Open(SQLite, filepath.Join(t.TempDir(), "webmark.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Migrate(false); err != nil {
+		if strings.Contains(err.Error(), "fts5") {
+			t.Skip("sqlite built without fts5, run with -tags fts5")
+		}
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSearchIndexedOnly(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.Docs.Index("alice", "notes", "hello", "h1", []string{"hello"}, []string{"world"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Docs.Index("alice", "notes", "todo", "h2", []string{"todo"}, []string{"milk"}); err != nil {
+		t.Fatal(err)
+	}
+	// 只有描述没有全文索引，例如索引重建到一半
+	if _, err := db.Exec(`insert into docs_info(groupname, title, username, create_at) values (?, ?, ?, ?)`, "notes", "orphan", "alice", 1); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name  string
+		group string
+		terms []string
+		want  []string
+	}{
+		{"all", "notes", nil, []string{"hello", "todo"}},
+		{"match", "notes", []string{"milk"}, []string{"todo"}},
+		{"other group", "diary", nil, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.Docs.Search("alice", tt.group, tt.terms)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 同一秒建立的索引顺序不固定
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Search = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// 重置后全部文档都等待重建，列表为空
+	if err := db.Docs.ResetIndex("alice"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Docs.Search("alice", "notes", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Search after reset = %v, want none", got)
+	}
+}
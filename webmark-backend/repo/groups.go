@@ -0,0 +1,82 @@
+package repo
+
+// 分组
+type Group struct {
+	Name     string
+	CreateAt int64
+	Docs     int // 已索引的文档数
+}
+
+// 分组(docs_group)
+type Groups interface {
+	// 查询分组，不存在时返回 ErrNotFound，不含文档数
+	Get(username, group string) (*Group, error)
+	// 分组不存在时登记，返回是否新建
+	Ensure(username, group string, now int64) (bool, error)
+	// 用户的分组及文档数，按创建时间倒序
+	List(username string) ([]*Group, error)
+	// 登记过的分组，包括只有索引的分组
+	Names(username string) ([]string, error)
+	// 有分组或文档的用户
+	Owners() ([]string, error)
+}
+
+type groups struct {
+	db *DB
+}
+
+func (g *groups) Get(username, group string) (*Group, error) {
+	var res = Group{Name: group}
+	err := g.db.QueryRow(`select create_at from docs_group where username = ? and groupname = ?`, username, group).Scan(&res.CreateAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &res, nil
+}
+
+func (g *groups) Ensure(username, group string, now int64) (bool, error) {
+	tx, err := g.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var count int
+	if err := tx.QueryRow(`select count(1) from docs_group where username = ? and groupname = ?`, username, group).Scan(&count); err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(`insert into docs_group (username, groupname, create_at) values (?, ?, ?)`, username, group, now); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (g *groups) List(username string) ([]*Group, error) {
+	rows, err := g.db.Query(`select g.groupname, g.create_at, count(di.doc_id) from docs_group g
+		left join docs_info di on di.username = g.username and di.groupname = g.groupname
+		where g.username = ? group by g.groupname, g.create_at order by g.create_at desc`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res = make([]*Group, 0)
+	for rows.Next() {
+		var gr Group
+		if err := rows.Scan(&gr.Name, &gr.CreateAt, &gr.Docs); err != nil {
+			return nil, err
+		}
+		res = append(res, &gr)
+	}
+	return res, rows.Err()
+}
+
+func (g *groups) Names(username string) ([]string, error) {
+	return scanStrings(g.db.Query(`select groupname from docs_group where username = ?
+		union select groupname from docs_info where username = ?`, username, username))
+}
+
+func (g *groups) Owners() ([]string, error) {
+	return scanStrings(g.db.Query(`select username from docs_info union select username from docs_group`))
+}
@@ -0,0 +1,332 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 数据库结构版本迁移
+// 每个迁移在独立的事务中执行，执行成功后写入 schema_version
+// 已发布的迁移不要修改，结构变化一律追加新的迁移
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *Tx) error
+}
+
+// 数据库结构比程序新，通常是回退了程序版本
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// PostgreSQL 多实例同时启动时，用咨询锁串行执行迁移
+const migrateLockKey = 0x7765626d61726b // "webmark"
+
+var migrations = []Migration{
+	{1, "initial", func(tx *Tx) error {
+		var stmts = []string{
+			`CREATE TABLE IF NOT EXISTS user_info (username varchar(100), password varchar(100))`,
+			`CREATE TABLE IF NOT EXISTS session_info (session_id varchar(100), username varchar(100), expire BIGINT)`,
+			`CREATE TABLE IF NOT EXISTS login_record (username varchar(100), last_time BIGINT, login_count INTEGER)`,
+			`CREATE TABLE IF NOT EXISTS docs_group (groupname varchar(100), username varchar(100), create_at BIGINT)`,
+			`CREATE INDEX IF NOT EXISTS docs_group_username ON docs_group(username)`,
+		}
+		if tx.Dialect() == Postgres {
+			stmts = append(stmts,
+				`CREATE TABLE IF NOT EXISTS docs_info (doc_id SERIAL PRIMARY KEY, groupname varchar(100), title varchar(100), username varchar(100), create_at BIGINT)`,
+				`CREATE TABLE IF NOT EXISTS docs (
+					doc_id INTEGER PRIMARY KEY,
+					title text,
+					content text,
+					tsv tsvector GENERATED ALWAYS AS (to_tsvector('simple', coalesce(title, '') || ' ' || coalesce(content, ''))) STORED
+				)`,
+				`CREATE INDEX IF NOT EXISTS docs_tsv ON docs USING GIN (tsv)`,
+			)
+		} else {
+			stmts = append(stmts,
+				`CREATE TABLE IF NOT EXISTS docs_info (doc_id INTEGER PRIMARY KEY AUTOINCREMENT, groupname varchar(100), title varchar(100), username varchar(100), create_at INTEGER)`,
+				`CREATE VIRTUAL TABLE IF NOT EXISTS docs USING fts5(title, content)`,
+			)
+		}
+		stmts = append(stmts,
+			`CREATE INDEX IF NOT EXISTS docs_username ON docs_info(username)`,
+			`CREATE INDEX IF NOT EXISTS docs_groupname ON docs_info(groupname)`,
+		)
+		return tx.execAll(stmts)
+	}},
+	{2, "docs_public", func(tx *Tx) error {
+		if err := tx.addColumn("docs_info", "is_public", "INTEGER DEFAULT 0"); err != nil {
+			return err
+		}
+		return tx.addColumn("docs_info", "view_count", "INTEGER DEFAULT 0")
+	}},
+	{3, "totp", func(tx *Tx) error {
+		return tx.execAll([]string{
+			`CREATE TABLE IF NOT EXISTS user_totp (username varchar(100) PRIMARY KEY, secret varchar(100), enabled INTEGER DEFAULT 0, last_step BIGINT DEFAULT 0, create_at BIGINT)`,
+			`CREATE TABLE IF NOT EXISTS totp_recovery (username varchar(100), code_hash varchar(100))`,
+			`CREATE TABLE IF NOT EXISTS login_ticket (ticket varchar(100) PRIMARY KEY, username varchar(100), expire BIGINT)`,
+		})
+	}},
+	{4, "webauthn", func(tx *Tx) error {
+		var blob = "BLOB"
+		if tx.Dialect() == Postgres {
+			blob = "BYTEA"
+		}
+		return tx.execAll([]string{
+			`CREATE TABLE IF NOT EXISTS webauthn_credential (credential_id varchar(1400) PRIMARY KEY, username varchar(100), user_handle varchar(100), public_key ` + blob + `, sign_count BIGINT DEFAULT 0, name varchar(100), create_at BIGINT, last_used BIGINT DEFAULT 0)`,
+			`CREATE INDEX IF NOT EXISTS webauthn_credential_username ON webauthn_credential(username)`,
+			`CREATE TABLE IF NOT EXISTS webauthn_challenge (challenge varchar(100) PRIMARY KEY, username varchar(100), user_handle varchar(100), kind varchar(20), expire BIGINT)`,
+		})
+	}},
+	{5, "external_identity", func(tx *Tx) error {
+		// 用户来源(local/ldap/oidc)与角色
+		if err := tx.addColumn("user_info", "source", "varchar(20) DEFAULT 'local'"); err != nil {
+			return err
+		}
+		if err := tx.addColumn("user_info", "role", "varchar(20) DEFAULT 'user'"); err != nil {
+			return err
+		}
+		return tx.execAll([]string{
+			`CREATE TABLE IF NOT EXISTS oidc_state (state varchar(100) PRIMARY KEY, nonce varchar(100), expire BIGINT)`,
+		})
+	}},
+	{6, "session_metadata", func(tx *Tx) error {
+		// 会话的创建时间、最后活跃时间与设备信息
+		for _, c := range [][2]string{
+			{"create_at", "BIGINT DEFAULT 0"},
+			{"last_seen", "BIGINT DEFAULT 0"},
+			{"ip", "varchar(64) DEFAULT ''"},
+			{"user_agent", "varchar(255) DEFAULT ''"},
+		} {
+			if err := tx.addColumn("session_info", c[0], c[1]); err != nil {
+				return err
+			}
+		}
+		// 旧版本以明文保存会话ID，改为哈希
+		rows, err := tx.Query(`select session_id from session_info where length(session_id) != 64`)
+		if err != nil {
+			return err
+		}
+		var plains = make([]string, 0)
+		for rows.Next() {
+			var session_id string
+			if rows.Scan(&session_id) == nil {
+				plains = append(plains, session_id)
+			}
+		}
+		rows.Close()
+		for _, session_id := range plains {
+			sum := sha256.Sum256([]byte(session_id))
+			_, err = tx.Exec(`update session_info set session_id = ? where session_id = ?`, hex.EncodeToString(sum[:]), session_id)
+			if err != nil {
+				return err
+			}
+		}
+		var now = time.Now().Unix()
+		_, err = tx.Exec(`update session_info set last_seen = ?, create_at = ? where last_seen = 0`, now, now)
+		if err != nil {
+			return err
+		}
+		return tx.execAll([]string{
+			`CREATE INDEX IF NOT EXISTS session_info_id ON session_info(session_id)`,
+			`CREATE INDEX IF NOT EXISTS session_info_username ON session_info(username)`,
+		})
+	}},
+	{7, "docs_unique", func(tx *Tx) error {
+		// 并发建索引可能为同一文档插入多条描述，保留最早的一条(公开状态与点击量都记在它上面)
+		dups, err := scanInt64s(tx.Query(`select doc_id from docs_info di where exists (select 1 from docs_info o
+			where o.username = di.username and o.groupname = di.groupname and o.title = di.title and o.doc_id < di.doc_id)`))
+		if err != nil {
+			return err
+		}
+		var f = newDocs(tx.db).fts
+		for _, doc_id := range dups {
+			if err := f.remove(tx, doc_id); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`delete from docs_info where doc_id = ?`, doc_id); err != nil {
+				return err
+			}
+		}
+		return tx.execAll([]string{
+			`CREATE UNIQUE INDEX IF NOT EXISTS docs_info_doc ON docs_info(username, groupname, title)`,
+		})
+	}},
+	{8, "docs_hash", func(tx *Tx) error {
+		// 文档内容的 sha256，对账时用于判断文件是否被修改
+		return tx.addColumn("docs_info", "content_hash", "varchar(64) DEFAULT ''")
+	}},
+	{9, "api_token", func(tx *Tx) error {
+		// 访问令牌，只保存哈希
+		return tx.execAll([]string{
+			`CREATE TABLE IF NOT EXISTS api_token (token_hash varchar(64) PRIMARY KEY, username varchar(100), name varchar(100), create_at BIGINT, last_used BIGINT DEFAULT 0)`,
+			`CREATE INDEX IF NOT EXISTS api_token_username ON api_token(username)`,
+		})
+	}},
+	{10, "docs_published", func(tx *Tx) error {
+		// 最近一次公开的时间，订阅源按公开或修改时间排序；已公开的文档以修改时间作为公开时间
+		if err := tx.addColumn("docs_info", "published_at", "BIGINT DEFAULT 0"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`update docs_info set published_at = create_at where is_public = 1`)
+		return err
+	}},
+	{11, "docs_updated", func(tx *Tx) error {
+		// 内容最后一次变化的时间，create_at 每次建索引都会刷新，不能作为订阅源的更新时间
+		if err := tx.addColumn("docs_info", "updated_at", "BIGINT DEFAULT 0"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`update docs_info set updated_at = create_at`)
+		return err
+	}},
+}
+
+// 程序支持的最新版本
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// 迁移状态
+type MigrateStatus struct {
+	Current int         // 数据库当前版本
+	Latest  int         // 程序支持的最新版本
+	Pending []Migration // 待执行的迁移
+}
+
+func (db *DB) createVersionTable() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, name varchar(100), applied_at BIGINT)`)
+	return err
+}
+
+// 当前版本，未执行过迁移时为 0
+func (db *DB) SchemaVersion() (int, error) {
+	if err := db.createVersionTable(); err != nil {
+		return 0, err
+	}
+	return currentVersion(db.QueryRow(`select coalesce(max(version), 0) from schema_version`))
+}
+
+func currentVersion(row *sql.Row) (int, error) {
+	var v int
+	err := row.Scan(&v)
+	return v, err
+}
+
+// 查看迁移状态，不做任何修改
+func (db *DB) MigrateStatus() (*MigrateStatus, error) {
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	var st = &MigrateStatus{Current: current, Latest: LatestVersion(), Pending: make([]Migration, 0)}
+	for _, m := range migrations {
+		if m.Version > current {
+			st.Pending = append(st.Pending, m)
+		}
+	}
+	if current > st.Latest {
+		return st, fmt.Errorf("%w: database version %d, binary supports %d", ErrSchemaTooNew, current, st.Latest)
+	}
+	return st, nil
+}
+
+// 执行所有待执行的迁移
+// dryRun 为 true 时在同一个事务中执行全部迁移后回滚，用于提前发现错误
+func (db *DB) Migrate(dryRun bool) (*MigrateStatus, error) {
+	st, err := db.MigrateStatus()
+	if err != nil {
+		return st, err
+	}
+	if dryRun {
+		return st, db.dryRun(st.Pending)
+	}
+	for _, m := range st.Pending {
+		if err := db.apply(m); err != nil {
+			return st, fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+	}
+	return st, nil
+}
+
+func (db *DB) apply(m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.lock(); err != nil {
+		return err
+	}
+	// 其他实例可能已经执行过
+	current, err := currentVersion(tx.QueryRow(`select coalesce(max(version), 0) from schema_version`))
+	if err != nil {
+		return err
+	}
+	if current >= m.Version {
+		return nil
+	}
+	if err := m.Up(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`insert into schema_version(version, name, applied_at) values (?, ?, ?)`, m.Version, m.Name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) dryRun(pending []Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, m := range pending {
+		if err := m.Up(tx); err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+func (tx *Tx) Dialect() Dialect {
+	return tx.db.Dialect
+}
+
+func (tx *Tx) lock() error {
+	if tx.Dialect() != Postgres {
+		// SQLite 的事务以 BEGIN IMMEDIATE 开始，已经持有写锁
+		return nil
+	}
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(?)`, migrateLockKey)
+	return err
+}
+
+func (tx *Tx) execAll(stmts []string) error {
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 添加字段，已存在时跳过(早期版本通过 ALTER TABLE 添加过部分字段)
+func (tx *Tx) addColumn(table, column, def string) error {
+	if tx.Dialect() == Postgres {
+		_, err := tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN IF NOT EXISTS ` + column + ` ` + def)
+		return err
+	}
+	var count int
+	err := tx.QueryRow(`select count(1) from pragma_table_info(?) where name = ?`, table, column).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + def)
+	return err
+}
@@ -0,0 +1,180 @@
+package repo
+
+// 登录会话，ID 为会话ID的哈希
+type Session struct {
+	ID        string
+	Username  string
+	Expire    int64
+	CreateAt  int64
+	LastSeen  int64
+	IP        string
+	UserAgent string
+}
+
+// 登录会话(session_info)、两步验证的登录票据(login_ticket)与单点登录状态(oidc_state)
+// 时间参数均为 unix 秒，idleSince 之前没有活动的会话视为失效
+type Sessions interface {
+	// 新建会话
+	Create(s *Session) error
+	// 查询会话，不存在时返回 ErrNotFound
+	Get(id string) (*Session, error)
+	// 刷新最后活跃时间与设备信息
+	Touch(id string, lastSeen int64, ip, userAgent string) error
+	// 删除会话
+	Delete(id string) error
+	// 删除用户的一个会话
+	DeleteOwned(username, id string) error
+	// 删除用户的所有会话，except 不为空时保留该会话
+	DeleteUser(username, except string) error
+	// 用户的有效会话，按最后活跃时间倒序
+	Active(username string, now, idleSince int64) ([]*Session, error)
+	// 所有用户的有效会话数
+	CountActive(now, idleSince int64) (int, error)
+	// 删除过期或长时间未使用的会话
+	Expire(now, idleSince int64) error
+
+	// 发放登录票据
+	CreateTicket(ticket, username string, expire int64) error
+	// 票据对应的用户与过期时间，不存在时返回 ErrNotFound
+	Ticket(ticket string) (username string, expire int64, err error)
+	// 兑换票据，并发兑换同一票据时只有一个返回 true
+	TakeTicket(ticket string) (bool, error)
+	// 作废用户所有未完成的登录
+	DeleteTickets(username string) error
+	// 清理过期票据
+	ExpireTickets(now int64) error
+
+	// 保存单点登录的 state 与 nonce
+	CreateOIDCState(state, nonce string, expire int64) error
+	// 取出 state(一次性)，不存在或已被使用时返回 ErrNotFound
+	TakeOIDCState(state string) (nonce string, expire int64, err error)
+	// 清理过期的 state
+	ExpireOIDCStates(now int64) error
+}
+
+type sessions struct {
+	db *DB
+}
+
+func (s *sessions) Create(se *Session) error {
+	_, err := s.db.Exec(`insert into session_info(session_id, username, expire, create_at, last_seen, ip, user_agent) values (?, ?, ?, ?, ?, ?, ?)`,
+		se.ID, se.Username, se.Expire, se.CreateAt, se.LastSeen, se.IP, se.UserAgent)
+	return err
+}
+
+func (s *sessions) Get(id string) (*Session, error) {
+	var se = Session{ID: id}
+	err := s.db.QueryRow(`select username, expire, create_at, last_seen, ip, user_agent from session_info where session_id = ?`, id).
+		Scan(&se.Username, &se.Expire, &se.CreateAt, &se.LastSeen, &se.IP, &se.UserAgent)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &se, nil
+}
+
+func (s *sessions) Touch(id string, lastSeen int64, ip, userAgent string) error {
+	_, err := s.db.Exec(`update session_info set last_seen = ?, ip = ?, user_agent = ? where session_id = ?`, lastSeen, ip, userAgent, id)
+	return err
+}
+
+func (s *sessions) Delete(id string) error {
+	_, err := s.db.Exec(`delete from session_info where session_id = ?`, id)
+	return err
+}
+
+func (s *sessions) DeleteOwned(username, id string) error {
+	_, err := s.db.Exec(`delete from session_info where username = ? and session_id = ?`, username, id)
+	return err
+}
+
+func (s *sessions) DeleteUser(username, except string) error {
+	_, err := s.db.Exec(`delete from session_info where username = ? and session_id != ?`, username, except)
+	return err
+}
+
+func (s *sessions) Active(username string, now, idleSince int64) ([]*Session, error) {
+	rows, err := s.db.Query(`select session_id, expire, create_at, last_seen, ip, user_agent from session_info
+		where username = ? and expire >= ? and last_seen >= ? order by last_seen desc`, username, now, idleSince)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res = make([]*Session, 0)
+	for rows.Next() {
+		var se = Session{Username: username}
+		if err := rows.Scan(&se.ID, &se.Expire, &se.CreateAt, &se.LastSeen, &se.IP, &se.UserAgent); err != nil {
+			return nil, err
+		}
+		res = append(res, &se)
+	}
+	return res, rows.Err()
+}
+
+func (s *sessions) CountActive(now, idleSince int64) (int, error) {
+	var n int
+	err := s.db.QueryRow(`select count(1) from session_info where username != '' and expire > ? and last_seen > ?`, now, idleSince).Scan(&n)
+	return n, err
+}
+
+func (s *sessions) Expire(now, idleSince int64) error {
+	_, err := s.db.Exec(`delete from session_info where expire < ? or last_seen < ?`, now, idleSince)
+	return err
+}
+
+func (s *sessions) CreateTicket(ticket, username string, expire int64) error {
+	_, err := s.db.Exec(`insert into login_ticket(ticket, username, expire) values (?, ?, ?)`, ticket, username, expire)
+	return err
+}
+
+func (s *sessions) Ticket(ticket string) (string, int64, error) {
+	var username string
+	var expire int64
+	err := s.db.QueryRow(`select username, expire from login_ticket where ticket = ?`, ticket).Scan(&username, &expire)
+	return username, expire, notFound(err)
+}
+
+func (s *sessions) TakeTicket(ticket string) (bool, error) {
+	return affectedOne(s.db.Exec(`delete from login_ticket where ticket = ?`, ticket))
+}
+
+func (s *sessions) DeleteTickets(username string) error {
+	_, err := s.db.Exec(`delete from login_ticket where username = ?`, username)
+	return err
+}
+
+func (s *sessions) ExpireTickets(now int64) error {
+	_, err := s.db.Exec(`delete from login_ticket where expire < ?`, now)
+	return err
+}
+
+func (s *sessions) CreateOIDCState(state, nonce string, expire int64) error {
+	_, err := s.db.Exec(`insert into oidc_state(state, nonce, expire) values (?, ?, ?)`, state, nonce, expire)
+	return err
+}
+
+func (s *sessions) TakeOIDCState(state string) (string, int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+	var nonce string
+	var expire int64
+	if err := tx.QueryRow(`select nonce, expire from oidc_state where state = ?`, state).Scan(&nonce, &expire); err != nil {
+		return "", 0, notFound(err)
+	}
+	// state 只能使用一次
+	ok, err := affectedOne(tx.Exec(`delete from oidc_state where state = ?`, state))
+	if err != nil {
+		return "", 0, err
+	}
+	if !ok {
+		return "", 0, ErrNotFound
+	}
+	return nonce, expire, tx.Commit()
+}
+
+func (s *sessions) ExpireOIDCStates(now int64) error {
+	_, err := s.db.Exec(`delete from oidc_state where expire < ?`, now)
+	return err
+}
@@ -0,0 +1,70 @@
+package repo
+
+// 访问令牌，Hash 为令牌的哈希
+type Token struct {
+	Hash     string
+	Username string
+	Name     string
+	CreateAt int64
+	LastUsed int64
+}
+
+// 访问令牌(api_token)
+type Tokens interface {
+	// 保存令牌
+	Create(t *Token) error
+	// 按哈希查询令牌，不存在时返回 ErrNotFound
+	Get(hash string) (*Token, error)
+	// 刷新最后使用时间
+	Touch(hash string, lastUsed int64) error
+	// 用户的令牌，按创建时间倒序
+	List(username string) ([]*Token, error)
+	// 删除用户哈希以 prefix 开头的令牌，prefix 只能是十六进制字符
+	Delete(username, prefix string) error
+}
+
+type tokens struct {
+	db *DB
+}
+
+func (t *tokens) Create(tk *Token) error {
+	_, err := t.db.Exec(`insert into api_token(token_hash, username, name, create_at) values (?, ?, ?, ?)`, tk.Hash, tk.Username, tk.Name, tk.CreateAt)
+	return err
+}
+
+func (t *tokens) Get(hash string) (*Token, error) {
+	var tk Token
+	err := t.db.QueryRow(`select token_hash, username, name, create_at, last_used from api_token where token_hash = ?`, hash).
+		Scan(&tk.Hash, &tk.Username, &tk.Name, &tk.CreateAt, &tk.LastUsed)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &tk, nil
+}
+
+func (t *tokens) Touch(hash string, lastUsed int64) error {
+	_, err := t.db.Exec(`update api_token set last_used = ? where token_hash = ?`, lastUsed, hash)
+	return err
+}
+
+func (t *tokens) List(username string) ([]*Token, error) {
+	rows, err := t.db.Query(`select token_hash, name, create_at, last_used from api_token where username = ? order by create_at desc`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res = make([]*Token, 0)
+	for rows.Next() {
+		var tk = Token{Username: username}
+		if err := rows.Scan(&tk.Hash, &tk.Name, &tk.CreateAt, &tk.LastUsed); err != nil {
+			return nil, err
+		}
+		res = append(res, &tk)
+	}
+	return res, rows.Err()
+}
+
+func (t *tokens) Delete(username, prefix string) error {
+	_, err := t.db.Exec(`delete from api_token where username = ? and token_hash like ?`, username, prefix+"%")
+	return err
+}
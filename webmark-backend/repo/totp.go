@@ -0,0 +1,106 @@
+package repo
+
+// 两步验证密钥(user_totp)与恢复码(totp_recovery)
+type TOTP interface {
+	// 是否已开启两步验证
+	Enabled(username string) (bool, error)
+	// 保存新密钥，开启前需要用验证码确认
+	Setup(username, secret string, now int64) error
+	// 开启两步验证
+	Enable(username string) error
+	// 密钥与最后使用的时间步，未设置时返回 ErrNotFound
+	Secret(username string) (secret string, lastStep int64, err error)
+	// 记录使用过的时间步，并发使用同一时间步时只有一个返回 true
+	UseStep(username string, step int64) (bool, error)
+	// 删除密钥与恢复码
+	Clear(username string) error
+	// 恢复码哈希
+	RecoveryHashes(username string) ([]string, error)
+	// 替换全部恢复码
+	SetRecoveryCodes(username string, hashes []string) error
+	// 使用恢复码，并发使用同一恢复码时只有一个返回 true
+	UseRecoveryCode(username, hash string) (bool, error)
+	// 剩余的恢复码数量
+	RecoveryRemaining(username string) (int, error)
+}
+
+type totp struct {
+	db *DB
+}
+
+func (t *totp) Enabled(username string) (bool, error) {
+	var enabled int
+	err := t.db.QueryRow(`select enabled from user_totp where username = ?`, username).Scan(&enabled)
+	if err = notFound(err); err == ErrNotFound {
+		return false, nil
+	}
+	return enabled == 1, err
+}
+
+func (t *totp) Setup(username, secret string, now int64) error {
+	_, err := t.db.Exec(`insert into user_totp(username, secret, enabled, last_step, create_at) values (?, ?, 0, 0, ?)
+		on conflict(username) do update set secret = excluded.secret, enabled = 0, last_step = 0, create_at = excluded.create_at`, username, secret, now)
+	return err
+}
+
+func (t *totp) Enable(username string) error {
+	_, err := t.db.Exec(`update user_totp set enabled = 1 where username = ?`, username)
+	return err
+}
+
+func (t *totp) Secret(username string) (string, int64, error) {
+	var secret string
+	var lastStep int64
+	err := t.db.QueryRow(`select secret, last_step from user_totp where username = ?`, username).Scan(&secret, &lastStep)
+	return secret, lastStep, notFound(err)
+}
+
+func (t *totp) UseStep(username string, step int64) (bool, error) {
+	return affectedOne(t.db.Exec(`update user_totp set last_step = ? where username = ? and last_step < ?`, step, username, step))
+}
+
+func (t *totp) Clear(username string) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`delete from user_totp where username = ?`, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`delete from totp_recovery where username = ?`, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (t *totp) RecoveryHashes(username string) ([]string, error) {
+	return scanStrings(t.db.Query(`select code_hash from totp_recovery where username = ?`, username))
+}
+
+func (t *totp) SetRecoveryCodes(username string, hashes []string) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`delete from totp_recovery where username = ?`, username); err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		if _, err := tx.Exec(`insert into totp_recovery(username, code_hash) values (?, ?)`, username, h); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (t *totp) UseRecoveryCode(username, hash string) (bool, error) {
+	return affectedOne(t.db.Exec(`delete from totp_recovery where username = ? and code_hash = ?`, username, hash))
+}
+
+func (t *totp) RecoveryRemaining(username string) (int, error) {
+	var n int
+	err := t.db.QueryRow(`select count(1) from totp_recovery where username = ?`, username).Scan(&n)
+	return n, err
+}
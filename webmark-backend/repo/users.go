@@ -0,0 +1,182 @@
+package repo
+
+// 账户
+type User struct {
+	Username string
+	Password string // 密码哈希，外部账户为空
+	Source   string // 来源：local、ldap、oidc
+	Role     string // user 或 admin
+}
+
+// 账户列表中的一项
+type UserSummary struct {
+	Username string
+	Role     string
+	Source   string
+	Docs     int  // 已索引的文档数
+	TOTP     bool // 是否开启了两步验证
+}
+
+// 账户(user_info)与登录失败记录(login_record)
+type Users interface {
+	// 查询账户，不存在时返回 ErrNotFound
+	Get(username string) (*User, error)
+	// 新建账户，已存在时返回 ErrExists
+	Create(u *User) error
+	// 修改密码哈希
+	SetPassword(username, hash string) error
+	// 修改角色
+	SetRole(username, role string) error
+	// 删除账户及会话、两步验证、通行密钥、令牌等登录相关数据，文档与索引不受影响
+	Delete(username string) error
+	// 所有账户，按用户名排序
+	List() ([]*UserSummary, error)
+	// 累计的登录失败次数
+	Failures(username string) (int, error)
+	// 记录一次登录失败，返回累计次数
+	RecordFailure(username string, now int64) (int, error)
+	// 清除失败次数超过 max 且最后一次尝试早于 before 的记录，返回被解锁的用户
+	ClearLockouts(max int, before int64) ([]string, error)
+	// 失败次数超过 max 的账户数
+	CountLocked(max int) (int, error)
+}
+
+type users struct {
+	db *DB
+}
+
+func (u *users) Get(username string) (*User, error) {
+	var user = User{Username: username}
+	err := u.db.QueryRow(`select coalesce(password, ''), coalesce(source, 'local'), coalesce(role, 'user') from user_info where username = ?`, username).
+		Scan(&user.Password, &user.Source, &user.Role)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (u *users) Create(user *User) error {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var count int
+	if err := tx.QueryRow(`select count(1) from user_info where username = ?`, user.Username).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrExists
+	}
+	var source, role = user.Source, user.Role
+	if source == "" {
+		source = "local"
+	}
+	if role == "" {
+		role = "user"
+	}
+	_, err = tx.Exec(`insert into user_info (username, password, source, role) values (?, ?, ?, ?)`, user.Username, user.Password, source, role)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (u *users) SetPassword(username, hash string) error {
+	_, err := u.db.Exec(`update user_info set password = ? where username = ?`, hash, username)
+	return err
+}
+
+func (u *users) SetRole(username, role string) error {
+	_, err := u.db.Exec(`update user_info set role = ? where username = ?`, role, username)
+	return err
+}
+
+func (u *users) Delete(username string) error {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"user_info", "session_info", "login_record", "login_ticket", "user_totp",
+		"totp_recovery", "webauthn_credential", "webauthn_challenge", "api_token"} {
+		if _, err := tx.Exec(`delete from `+table+` where username = ?`, username); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (u *users) List() ([]*UserSummary, error) {
+	rows, err := u.db.Query(`select u.username, coalesce(u.role, 'user'), coalesce(u.source, 'local'),
+		(select count(1) from docs_info di where di.username = u.username),
+		(select count(1) from user_totp t where t.username = u.username and t.enabled = 1)
+		from user_info u order by u.username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res = make([]*UserSummary, 0)
+	for rows.Next() {
+		var s UserSummary
+		var totp int
+		if err := rows.Scan(&s.Username, &s.Role, &s.Source, &s.Docs, &totp); err != nil {
+			return nil, err
+		}
+		s.TOTP = totp > 0
+		res = append(res, &s)
+	}
+	return res, rows.Err()
+}
+
+func (u *users) Failures(username string) (int, error) {
+	var count int
+	err := u.db.QueryRow(`select coalesce(max(login_count), 0) from login_record where username = ?`, username).Scan(&count)
+	return count, err
+}
+
+func (u *users) RecordFailure(username string, now int64) (int, error) {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`update login_record set last_time = ?, login_count = login_count + 1 where username = ?`, now, username)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		if _, err := tx.Exec(`insert into login_record(username, last_time, login_count) values (?, ?, 1)`, username, now); err != nil {
+			return 0, err
+		}
+	}
+	var count int
+	if err := tx.QueryRow(`select max(login_count) from login_record where username = ?`, username).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+func (u *users) ClearLockouts(max int, before int64) ([]string, error) {
+	tx, err := u.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	names, err := scanStrings(tx.Query(`select username from login_record where login_count > ? and last_time < ?`, max, before))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`delete from login_record where login_count > ? and last_time < ?`, max, before); err != nil {
+		return nil, err
+	}
+	return names, tx.Commit()
+}
+
+func (u *users) CountLocked(max int) (int, error) {
+	var n int
+	err := u.db.QueryRow(`select count(1) from login_record where login_count > ?`, max).Scan(&n)
+	return n, err
+}
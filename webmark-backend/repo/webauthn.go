@@ -0,0 +1,149 @@
+package repo
+
+// 通行密钥凭据
+type Credential struct {
+	ID         string // base64url 编码的凭据ID
+	Username   string
+	UserHandle string
+	PublicKey  []byte // COSE 格式的公钥
+	SignCount  uint32
+	Name       string
+	CreateAt   int64
+	LastUsed   int64
+}
+
+// 注册或登录挑战
+type Challenge struct {
+	Challenge  string
+	Username   string // 登录时可以为空，由认证器选择凭据
+	UserHandle string // 注册时发给认证器的用户句柄
+	Kind       string // register 或 login
+	Expire     int64
+}
+
+// 通行密钥凭据(webauthn_credential)与挑战(webauthn_challenge)
+type WebAuthn interface {
+	// 用户的凭据，按注册时间倒序
+	Credentials(username string) ([]*Credential, error)
+	// 查询凭据，不存在时返回 ErrNotFound
+	Credential(id string) (*Credential, error)
+	// 用户已有凭据的用户句柄，没有凭据时返回空
+	UserHandle(username string) (string, error)
+	// 保存凭据，凭据ID重复时返回 ErrExists
+	AddCredential(c *Credential) error
+	// 更新签名计数，计数已被并发的登录修改时返回 false
+	UpdateSignCount(id string, old, count uint32, lastUsed int64) (bool, error)
+	// 删除用户的凭据
+	DeleteCredential(username, id string) error
+
+	// 保存挑战
+	CreateChallenge(c *Challenge) error
+	// 取出挑战(一次性)，不存在或已被使用时返回 ErrNotFound
+	TakeChallenge(challenge, kind string) (*Challenge, error)
+	// 清理过期的挑战
+	ExpireChallenges(now int64) error
+}
+
+type webauthn struct {
+	db *DB
+}
+
+func (wa *webauthn) Credentials(username string) ([]*Credential, error) {
+	rows, err := wa.db.Query(`select credential_id, user_handle, public_key, sign_count, name, create_at, last_used from webauthn_credential
+		where username = ? order by create_at desc`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res = make([]*Credential, 0)
+	for rows.Next() {
+		var c = Credential{Username: username}
+		if err := rows.Scan(&c.ID, &c.UserHandle, &c.PublicKey, &c.SignCount, &c.Name, &c.CreateAt, &c.LastUsed); err != nil {
+			return nil, err
+		}
+		res = append(res, &c)
+	}
+	return res, rows.Err()
+}
+
+func (wa *webauthn) Credential(id string) (*Credential, error) {
+	var c = Credential{ID: id}
+	err := wa.db.QueryRow(`select username, user_handle, public_key, sign_count, name, create_at, last_used from webauthn_credential where credential_id = ?`, id).
+		Scan(&c.Username, &c.UserHandle, &c.PublicKey, &c.SignCount, &c.Name, &c.CreateAt, &c.LastUsed)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &c, nil
+}
+
+func (wa *webauthn) UserHandle(username string) (string, error) {
+	var handle string
+	err := wa.db.QueryRow(`select user_handle from webauthn_credential where username = ? limit 1`, username).Scan(&handle)
+	if err = notFound(err); err == ErrNotFound {
+		return "", nil
+	}
+	return handle, err
+}
+
+func (wa *webauthn) AddCredential(c *Credential) error {
+	tx, err := wa.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var count int
+	if err := tx.QueryRow(`select count(1) from webauthn_credential where credential_id = ?`, c.ID).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrExists
+	}
+	_, err = tx.Exec(`insert into webauthn_credential(credential_id, username, user_handle, public_key, sign_count, name, create_at, last_used) values (?, ?, ?, ?, ?, ?, ?, ?)`,
+		c.ID, c.Username, c.UserHandle, c.PublicKey, c.SignCount, c.Name, c.CreateAt, c.LastUsed)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (wa *webauthn) UpdateSignCount(id string, old, count uint32, lastUsed int64) (bool, error) {
+	return affectedOne(wa.db.Exec(`update webauthn_credential set sign_count = ?, last_used = ? where credential_id = ? and sign_count = ?`, count, lastUsed, id, old))
+}
+
+func (wa *webauthn) DeleteCredential(username, id string) error {
+	_, err := wa.db.Exec(`delete from webauthn_credential where credential_id = ? and username = ?`, id, username)
+	return err
+}
+
+func (wa *webauthn) CreateChallenge(c *Challenge) error {
+	_, err := wa.db.Exec(`insert into webauthn_challenge(challenge, username, user_handle, kind, expire) values (?, ?, ?, ?, ?)`,
+		c.Challenge, c.Username, c.UserHandle, c.Kind, c.Expire)
+	return err
+}
+
+func (wa *webauthn) TakeChallenge(challenge, kind string) (*Challenge, error) {
+	tx, err := wa.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var c = Challenge{Challenge: challenge, Kind: kind}
+	err = tx.QueryRow(`select username, user_handle, expire from webauthn_challenge where challenge = ? and kind = ?`, challenge, kind).
+		Scan(&c.Username, &c.UserHandle, &c.Expire)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	ok, err := affectedOne(tx.Exec(`delete from webauthn_challenge where challenge = ?`, challenge))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &c, tx.Commit()
+}
+
+func (wa *webauthn) ExpireChallenges(now int64) error {
+	_, err := wa.db.Exec(`delete from webauthn_challenge where expire < ?`, now)
+	return err
+}
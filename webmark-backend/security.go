@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CSRF 令牌所在的 cookie 与请求头，前端读取 cookie 后放入请求头(双重提交)
+const CsrfCookieName = "csrf_token"
+const CsrfHeaderName = "X-CSRF-Token"
+
+// 客户端是否经由 TLS 访问，包括可信代理终止 TLS 的情况
+func isTLS(r *http.Request) bool {
+	return requestScheme(r) == "https"
+}
+
+// 写入 cookie，统一设置 SameSite 与 Secure
+// httpOnly 为 false 的 cookie 需要被前端脚本读取
+func setCookie(w http.ResponseWriter, r *http.Request, name, value string, expires time.Time, httpOnly bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Expires:  expires,
+		Path:     basePath("/"),
+		HttpOnly: httpOnly,
+		Secure:   isTLS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// 删除 cookie
+func clearCookie(w http.ResponseWriter, r *http.Request, name string, httpOnly bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		MaxAge:   -1,
+		Path:     basePath("/"),
+		HttpOnly: httpOnly,
+		Secure:   isTLS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// 限制请求方法，其他方法返回 405
+func method(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	var allow = strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				h(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		ErrorResponseWithStatus(w, r, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// 登录前的接口没有会话可以绑定令牌，只做来源检查
+var csrfExempt = map[string]bool{
+	"/wmapi/login":                 true,
+	"/wmapi/totp-login":            true,
+	"/wmapi/webauthn-login-begin":  true,
+	"/wmapi/webauthn-login-finish": true,
+}
+
+// 已登录但还没有令牌时补发(如升级前登录的会话)
+func ensureCsrfCookie(w http.ResponseWriter, r *http.Request, expires time.Time) {
+	if c, err := r.Cookie(CsrfCookieName); err == nil && c.Value != "" {
+		return
+	}
+	setCookie(w, r, CsrfCookieName, Uuid(), expires, false)
+}
+
+func safeMethod(m string) bool {
+	return m == "GET" || m == "HEAD" || m == "OPTIONS"
+}
+
+// 来源是否与当前站点一致
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return strings.EqualFold(u.Host, requestHost(r)) && u.Scheme == requestScheme(r)
+}
+
+// CSRF 检查失败，/api 使用带错误码的格式
+func csrfFail(w http.ResponseWriter, r *http.Request, msg string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		apiFail(w, http.StatusForbidden, codeForbidden, msg)
+		return
+	}
+	ErrorResponseWithStatus(w, r, http.StatusForbidden, msg)
+}
+
+// CSRF 防护，作用于所有修改数据的 /wmapi 与 /api 请求
+// 1. 浏览器携带的 Origin(或 Referer)必须是本站
+// 2. 已登录的请求必须在请求头中带上与 cookie 一致的令牌
+func csrf_protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if safeMethod(r.Method) || !(strings.HasPrefix(r.URL.Path, "/wmapi/") || strings.HasPrefix(r.URL.Path, "/api/")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if !sameOrigin(r, origin) {
+				csrfFail(w, r, "csrf origin")
+				return
+			}
+		} else if referer := r.Header.Get("Referer"); referer != "" {
+			if !sameOrigin(r, referer) {
+				csrfFail(w, r, "csrf referer")
+				return
+			}
+		}
+		// 使用访问令牌时不依赖 cookie，浏览器跨站请求也无法带上 Authorization
+		var bearer = strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, err := r.Cookie("session_id"); err == nil && !csrfExempt[r.URL.Path] && !bearer {
+			cookie, err := r.Cookie(CsrfCookieName)
+			var header = r.Header.Get(CsrfHeaderName)
+			if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+				csrfFail(w, r, "csrf token")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
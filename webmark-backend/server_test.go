@@ -0,0 +1,441 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"webmark/client"
+	"webmark/config"
+	"webmark/utils"
+)
+
+// 在临时目录中启动完整的服务(路由与中间件与 main 相同)，root 用户密码为 root
+// 数据库不支持 fts5 时(没有 -tags fts5)跳过
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	var dir = t.TempDir()
+	old := Conf
+	Conf = config.Default()
+	Conf.Server.DataDir = filepath.Join(dir, "markdown")
+	Conf.Database.Path = filepath.Join(dir, "webmark.db")
+	Conf.Log.Level = "error"
+	t.Cleanup(func() {
+		Conf = old
+		applyConfig(Conf)
+	})
+	if err := applyConfig(Conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := openDB(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		closeDB()
+		GDB = nil
+	})
+	if err := createTable(); err != nil {
+		if strings.Contains(err.Error(), "fts5") {
+			t.Skip("sqlite built without fts5, run with -tags fts5")
+		}
+		t.Fatal(err)
+	}
+	init_work()
+	srv := httptest.NewServer(newHandler(http.NewServeMux()))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestClient(t *testing.T, srv *httptest.Server, c client.Config) *client.Client {
+	t.Helper()
+	c.BaseURL = srv.URL
+	cl, err := client.New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cl
+}
+
+// 以 root 登录的客户端，jar 中保存会话与 CSRF 令牌
+func loginRoot(t *testing.T, srv *httptest.Server) (*client.Client, http.CookieJar) {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	cl := newTestClient(t, srv, client.Config{HTTPClient: &http.Client{Jar: jar}})
+	res, err := cl.Login(context.Background(), "root", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.TOTP {
+		t.Fatal("unexpected totp challenge")
+	}
+	return cl, jar
+}
+
+func TestServerLogin(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	cl := newTestClient(t, srv, client.Config{})
+	if _, err := cl.Groups(ctx); !client.IsUnauthenticated(err) {
+		t.Fatalf("Groups before login: %v", err)
+	}
+	if _, err := cl.Login(ctx, "root", "wrong"); err == nil || client.ErrorCode(err) != "" {
+		t.Fatalf("Login with wrong password: %v", err)
+	}
+	if _, err := cl.Login(ctx, "root", "root"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Groups(ctx); err != nil {
+		t.Fatalf("Groups after login: %v", err)
+	}
+	if err := cl.Logout(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Groups(ctx); !client.IsUnauthenticated(err) {
+		t.Fatalf("Groups after logout: %v", err)
+	}
+}
+
+func TestServerLoginTOTP(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	secret, err := utils.GenerateTotpSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := GDB.TOTP.Setup("root", secret, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if err := GDB.TOTP.Enable("root"); err != nil {
+		t.Fatal(err)
+	}
+	cl := newTestClient(t, srv, client.Config{})
+	res, err := cl.Login(ctx, "root", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.TOTP || res.Ticket == "" {
+		t.Fatalf("Login = %+v, want totp ticket", res)
+	}
+	// 只通过了密码时还没有会话
+	if _, err := cl.Groups(ctx); !client.IsUnauthenticated(err) {
+		t.Fatalf("Groups before totp: %v", err)
+	}
+	if err := cl.LoginTOTP(ctx, res.Ticket, "000000x"); err == nil {
+		t.Fatal("LoginTOTP with a bad code succeeded")
+	}
+	code, err := utils.TotpCode(secret, utils.TotpStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.LoginTOTP(ctx, res.Ticket, code); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Groups(ctx); err != nil {
+		t.Fatalf("Groups after totp: %v", err)
+	}
+	// 票据只能兑换一次
+	if err := newTestClient(t, srv, client.Config{}).LoginTOTP(ctx, res.Ticket, code); err == nil {
+		t.Fatal("ticket reused")
+	}
+}
+
+func TestServerToken(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	cl, _ := loginRoot(t, srv)
+	tk, err := cl.CreateToken(ctx, "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.Id == "" || !strings.HasPrefix(tk.Token, apiTokenPrefix) {
+		t.Fatalf("CreateToken = %+v", tk)
+	}
+	tokens, err := cl.Tokens(ctx)
+	if err != nil || len(tokens) != 1 || tokens[0].Id != tk.Id || tokens[0].Name != "ci" {
+		t.Fatalf("Tokens = %+v, %v", tokens, err)
+	}
+
+	// Bearer 请求不需要 cookie 与 CSRF 令牌
+	bearer := newTestClient(t, srv, client.Config{Token: tk.Token})
+	if _, _, err := bearer.CreateGroup(ctx, "notes"); err != nil {
+		t.Fatalf("CreateGroup with token: %v", err)
+	}
+	groups, err := bearer.Groups(ctx)
+	if err != nil || len(groups) != 1 || groups[0].Name != "notes" {
+		t.Fatalf("Groups with token = %+v, %v", groups, err)
+	}
+	if _, err := newTestClient(t, srv, client.Config{Token: tk.Token + "x"}).Groups(ctx); !client.IsUnauthenticated(err) {
+		t.Fatalf("Groups with a bad token: %v", err)
+	}
+
+	if err := cl.DeleteToken(ctx, tk.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bearer.Groups(ctx); !client.IsUnauthenticated(err) {
+		t.Fatalf("Groups with a deleted token: %v", err)
+	}
+}
+
+func TestServerDocuments(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	cl, _ := loginRoot(t, srv)
+
+	group, created, err := cl.CreateGroup(ctx, "notes")
+	if err != nil || !created || group.Name != "notes" {
+		t.Fatalf("CreateGroup = %+v, %v, %v", group, created, err)
+	}
+	if _, created, err := cl.CreateGroup(ctx, "notes"); err != nil || created {
+		t.Fatalf("CreateGroup again = %v, %v", created, err)
+	}
+
+	// If-Match: * 只修改已有的文档
+	if err := cl.UpdateDocument(ctx, "notes", "hello", "# 你好"); !client.IsPreconditionFailed(err) {
+		t.Fatalf("UpdateDocument missing: %v", err)
+	}
+	if err := cl.CreateDocument(ctx, "notes", "hello", "# 你好\n\n全文检索"); err != nil {
+		t.Fatal(err)
+	}
+	// If-None-Match: * 只新建
+	if err := cl.CreateDocument(ctx, "notes", "hello", "# 覆盖"); !client.IsPreconditionFailed(err) {
+		t.Fatalf("CreateDocument existing: %v", err)
+	}
+	if err := cl.UpdateDocument(ctx, "notes", "hello", "# 你好\n\n全文检索 修改"); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := cl.Document(ctx, "notes", "hello")
+	if err != nil || doc.Content != "# 你好\n\n全文检索 修改" || doc.Public {
+		t.Fatalf("Document = %+v, %v", doc, err)
+	}
+	if created, err := cl.PutDocument(ctx, "notes", "other", "别的内容"); err != nil || !created {
+		t.Fatalf("PutDocument = %v, %v", created, err)
+	}
+
+	if _, err := cl.Document(ctx, "notes", "missing"); !client.IsNotFound(err) {
+		t.Fatalf("Document missing: %v", err)
+	}
+	if _, err := cl.Search(ctx, "missing", ""); !client.IsNotFound(err) {
+		t.Fatalf("Search missing group: %v", err)
+	}
+
+	docs, err := cl.Search(ctx, "notes", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles = make([]string, 0, len(docs))
+	for _, d := range docs {
+		titles = append(titles, d.Title)
+	}
+	sort.Strings(titles)
+	if strings.Join(titles, ",") != "hello,other" {
+		t.Fatalf("Search all = %v", titles)
+	}
+	docs, err = cl.Search(ctx, "notes", "检索")
+	if err != nil || len(docs) != 1 || docs[0].Title != "hello" || docs[0].Group != "notes" {
+		t.Fatalf("Search = %+v, %v", docs, err)
+	}
+
+	if err := cl.DeleteDocument(ctx, "notes", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.DeleteDocument(ctx, "notes", "other"); !client.IsNotFound(err) {
+		t.Fatalf("DeleteDocument missing: %v", err)
+	}
+}
+
+func TestServerAttachment(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	cl, _ := loginRoot(t, srv)
+	if err := cl.CreateDocument(ctx, "notes", "hello", "![图](hello/a.png)"); err != nil {
+		t.Fatal(err)
+	}
+	var data = []byte("\x89PNG\r\n\x1a\nfake")
+	if err := cl.Upload(ctx, "notes", "hello", "a.png", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := cl.Attachment(ctx, "notes", "hello", "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Attachment = %q, %v", got, err)
+	}
+	if err := cl.DeleteAttachment(ctx, "notes", "hello", "a.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Attachment(ctx, "notes", "hello", "a.png"); !client.IsNotFound(err) {
+		t.Fatalf("Attachment after delete: %v", err)
+	}
+}
+
+func TestServerPublic(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	cl, _ := loginRoot(t, srv)
+	if err := cl.CreateDocument(ctx, "notes", "shared", "# 公开的笔记"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.CreateDocument(ctx, "notes", "private", "# 私有的笔记"); err != nil {
+		t.Fatal(err)
+	}
+	anon := newTestClient(t, srv, client.Config{})
+	if docs, err := anon.PublicDocuments(ctx, ""); err != nil || len(docs) != 0 {
+		t.Fatalf("PublicDocuments before SetPublic = %+v, %v", docs, err)
+	}
+	if _, err := anon.PublicMarkdown(ctx, "root", "notes", "shared"); !client.IsNotFound(err) {
+		t.Fatalf("PublicMarkdown of a private document: %v", err)
+	}
+	if err := cl.SetPublic(ctx, "notes", "shared", true); err != nil {
+		t.Fatal(err)
+	}
+	docs, err := anon.PublicDocuments(ctx, "")
+	if err != nil || len(docs) != 1 || docs[0].Title != "shared" || docs[0].Groupname != "notes" || docs[0].Username != "root" {
+		t.Fatalf("PublicDocuments = %+v, %v", docs, err)
+	}
+	if docs, err := anon.PublicDocuments(ctx, "私有"); err != nil || len(docs) != 0 {
+		t.Fatalf("PublicDocuments search private = %+v, %v", docs, err)
+	}
+	md, err := anon.PublicMarkdown(ctx, "root", "notes", "shared")
+	if err != nil || md != "# 公开的笔记" {
+		t.Fatalf("PublicMarkdown = %q, %v", md, err)
+	}
+	if docs, err := anon.PublicDocuments(ctx, ""); err != nil || len(docs) != 1 || docs[0].ViewCount != 1 {
+		t.Fatalf("PublicDocuments view count = %+v, %v", docs, err)
+	}
+
+	// 另一个用户公开同名的分组与文档，按用户区分
+	if err := AddUser("alice", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	jar, _ := cookiejar.New(nil)
+	alice := newTestClient(t, srv, client.Config{HTTPClient: &http.Client{Jar: jar}})
+	if _, err := alice.Login(ctx, "alice", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.CreateDocument(ctx, "notes", "shared", "# alice 的笔记"); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SetPublic(ctx, "notes", "shared", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		username, title, want string
+	}{
+		{"root", "shared", "# 公开的笔记"},
+		{"alice", "shared", "# alice 的笔记"},
+	} {
+		if md, err := anon.PublicMarkdown(ctx, tc.username, "notes", tc.title); err != nil || md != tc.want {
+			t.Errorf("PublicMarkdown %s = %q, %v", tc.username, md, err)
+		}
+	}
+	for _, tc := range []struct{ username, title string }{
+		{"root", "private"},
+		{"alice", "private"},
+		{"bob", "shared"},
+	} {
+		if _, err := anon.PublicMarkdown(ctx, tc.username, "notes", tc.title); !client.IsNotFound(err) {
+			t.Errorf("PublicMarkdown %s/%s: %v", tc.username, tc.title, err)
+		}
+	}
+	if err := cl.SetPublic(ctx, "notes", "missing", true); !client.IsNotFound(err) {
+		t.Fatalf("SetPublic missing: %v", err)
+	}
+}
+
+func TestServerExport(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	cl, _ := loginRoot(t, srv)
+	if err := cl.CreateDocument(ctx, "notes", "hello", "# hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.CreateDocument(ctx, "diary", "today", "# today"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		group, title string
+		want         string
+	}{
+		{"", "", "diary/today.md,notes/hello.md"},
+		{"notes", "", "hello.md"},
+		{"notes", "hello", "hello.md"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := cl.Export(ctx, &buf, tt.group, tt.title); err != nil {
+			t.Fatalf("Export(%q, %q): %v", tt.group, tt.title, err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("Export(%q, %q): %v", tt.group, tt.title, err)
+		}
+		var names = make([]string, 0)
+		for _, f := range zr.File {
+			if !strings.HasSuffix(f.Name, "/") {
+				names = append(names, f.Name)
+			}
+		}
+		sort.Strings(names)
+		if got := strings.Join(names, ","); got != tt.want {
+			t.Errorf("Export(%q, %q) files = %s, want %s", tt.group, tt.title, got, tt.want)
+		}
+	}
+	if err := cl.Export(ctx, io.Discard, "missing", ""); !client.IsNotFound(err) {
+		t.Fatalf("Export missing: %v", err)
+	}
+	if err := newTestClient(t, srv, client.Config{}).Export(ctx, io.Discard, "", ""); err == nil {
+		t.Fatal("Export without login succeeded")
+	}
+}
+
+// 给请求加上 Origin 头
+type originTransport string
+
+func (o originTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Origin", string(o))
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestServerCSRF(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	_, jar := loginRoot(t, srv)
+
+	// 其他站点发起的请求
+	cross := newTestClient(t, srv, client.Config{HTTPClient: &http.Client{Jar: jar, Transport: originTransport("http://evil.example.com")}})
+	if _, _, err := cross.CreateGroup(ctx, "notes"); client.ErrorCode(err) != client.CodeForbidden {
+		t.Fatalf("cross-site CreateGroup: %v", err)
+	}
+	// 读取不受影响
+	if _, err := cross.Groups(ctx); err != nil {
+		t.Fatalf("cross-site Groups: %v", err)
+	}
+	same := newTestClient(t, srv, client.Config{HTTPClient: &http.Client{Jar: jar, Transport: originTransport(srv.URL)}})
+	if _, _, err := same.CreateGroup(ctx, "notes"); err != nil {
+		t.Fatalf("same-site CreateGroup: %v", err)
+	}
+
+	// 会话 cookie 还在，CSRF 令牌丢失
+	u, _ := url.Parse(srv.URL)
+	jar.SetCookies(u, []*http.Cookie{{Name: CsrfCookieName, Value: "", Path: "/", MaxAge: -1}})
+	if err := same.CreateDocument(ctx, "notes", "hello", "# hello"); client.ErrorCode(err) != client.CodeForbidden {
+		t.Fatalf("CreateDocument without csrf token: %v", err)
+	}
+	if _, err := same.CreateToken(ctx, "ci"); client.ErrorCode(err) != client.CodeForbidden {
+		t.Fatalf("CreateToken without csrf token: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 最后活跃时间的刷新间隔，避免每个请求都写库
+const sessionTouchInterval = time.Minute
+
+// 会话ID的哈希，数据库中只保存哈希值
+func hashSessionId(session_id string) string {
+	sum := sha256.Sum256([]byte(session_id))
+	return hex.EncodeToString(sum[:])
+}
+
+// 客户端IP
+// 来自可信代理时从 X-Forwarded-For 中由右向左取第一个不可信的地址
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !fromTrustedProxy(r) {
+		return host
+	}
+	var hops = strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hop := strings.TrimSpace(hops[i]); hop != "" && !trustedIP(hop) {
+			return hop
+		}
+	}
+	return host
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// 刷新会话最后活跃时间与设备信息
+func touchSession(session_id string, last_seen int64, r *http.Request) {
+	var now = time.Now()
+	if now.Unix()-last_seen < int64(sessionTouchInterval/time.Second) {
+		return
+	}
+	err := GDB.Sessions.Touch(session_id, now.Unix(), clientIP(r), truncate(r.UserAgent(), 255))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "touch session failed", "err", err)
+	}
+}
+
+type SessionInfo struct {
+	Id        string `json:"id"` // 会话ID的哈希，用于注销
+	CreateAt  int64  `json:"create_at"`
+	LastSeen  int64  `json:"last_seen"`
+	Expire    int64  `json:"expire"`
+	Ip        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	Current   bool   `json:"current"` // 是否当前会话
+}
+
+// 当前用户的有效会话
+// /session-list
+func session_list(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	var now = time.Now()
+	sessions, err := GDB.Sessions.Active(session.Name, now.Unix(), now.Add(-SessionIdleTimeout).Unix())
+	if err != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	var res = make([]*SessionInfo, 0, len(sessions))
+	for _, se := range sessions {
+		res = append(res, &SessionInfo{
+			Id:        se.ID,
+			CreateAt:  se.CreateAt,
+			LastSeen:  se.LastSeen,
+			Expire:    se.Expire,
+			Ip:        se.IP,
+			UserAgent: se.UserAgent,
+			Current:   se.ID == session.SessionId,
+		})
+	}
+	SuccessResponse(w, r, res)
+}
+
+type SessionRevoke struct {
+	Id     string `json:"id"`     // 注销指定会话
+	Others bool   `json:"others"` // 注销除当前会话外的全部会话
+}
+
+// 注销会话
+// /session-revoke
+func session_revoke(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	if r.Method != "POST" {
+		ErrorResponse(w, r)
+		return
+	}
+	var sr SessionRevoke
+	if nil != ReadJson(r, &sr) {
+		ErrorResponse(w, r)
+		return
+	}
+	var err error
+	if sr.Others {
+		err = GDB.Sessions.DeleteUser(session.Name, session.SessionId)
+	} else if sr.Id != "" {
+		err = GDB.Sessions.DeleteOwned(session.Name, sr.Id)
+	} else {
+		ErrorResponse(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "revoke session failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	SuccessResponse(w, r, true)
+}
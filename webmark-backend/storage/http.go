@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+// 转换为 http.FileSystem，供 http.FileServer 使用
+func FileSystem(s Storage) http.FileSystem {
+	return httpFS{s}
+}
+
+type httpFS struct {
+	s Storage
+}
+
+func (h httpFS) Open(name string) (http.File, error) {
+	var key = Clean(name)
+	info, err := h.s.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir {
+		return &httpDir{s: h.s, key: key, info: info}, nil
+	}
+	rc, err := h.s.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	// 本地文件本身就支持 Seek
+	if f, ok := rc.(http.File); ok {
+		return f, nil
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return &httpFile{Reader: bytes.NewReader(data), info: info}, nil
+}
+
+// 读到内存中的文件，用于支持 Range 请求
+type httpFile struct {
+	*bytes.Reader
+	info FileInfo
+}
+
+func (f *httpFile) Close() error {
+	return nil
+}
+
+func (f *httpFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *httpFile) Stat() (fs.FileInfo, error) {
+	return fileInfo{f.info}, nil
+}
+
+type httpDir struct {
+	s    Storage
+	key  string
+	info FileInfo
+	read bool
+}
+
+func (d *httpDir) Close() error {
+	return nil
+}
+
+func (d *httpDir) Read([]byte) (int, error) {
+	return 0, errors.New("is a directory")
+}
+
+func (d *httpDir) Seek(int64, int) (int64, error) {
+	return 0, nil
+}
+
+func (d *httpDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if d.read {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	d.read = true
+	items, err := d.s.List(d.key)
+	if err != nil {
+		return nil, err
+	}
+	var res = make([]fs.FileInfo, 0, len(items))
+	for _, item := range items {
+		res = append(res, fileInfo{item})
+	}
+	return res, nil
+}
+
+func (d *httpDir) Stat() (fs.FileInfo, error) {
+	return fileInfo{d.info}, nil
+}
+
+// 实现 fs.FileInfo
+type fileInfo struct {
+	fi FileInfo
+}
+
+func (i fileInfo) Name() string       { return i.fi.Name }
+func (i fileInfo) Size() int64        { return i.fi.Size }
+func (i fileInfo) ModTime() time.Time { return i.fi.ModTime }
+func (i fileInfo) IsDir() bool        { return i.fi.IsDir }
+func (i fileInfo) Sys() any           { return nil }
+func (i fileInfo) Mode() fs.FileMode {
+	if i.fi.IsDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
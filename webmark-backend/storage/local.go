@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 本地文件系统存储
+type Local struct {
+	Root string
+}
+
+func NewLocal(root string) *Local {
+	return &Local{Root: root}
+}
+
+func (l *Local) path(key string) string {
+	return filepath.Join(l.Root, filepath.FromSlash(Clean(key)))
+}
+
+func (l *Local) Open(key string) (io.ReadCloser, error) {
+	return os.Open(l.path(key))
+}
+
+// 先写临时文件再改名，避免写到一半时留下不完整的文档
+func (l *Local) Write(key string, r io.Reader) error {
+	var name = l.path(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (l *Local) Stat(key string) (FileInfo, error) {
+	info, err := os.Stat(l.path(key))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return localInfo(info), nil
+}
+
+func (l *Local) List(dir string) ([]FileInfo, error) {
+	entries, err := os.ReadDir(l.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	var res = make([]FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		// 写入中的临时文件
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		res = append(res, localInfo(info))
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+func (l *Local) Remove(key string) error {
+	err := os.Remove(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (l *Local) RemoveAll(dir string) error {
+	if Clean(dir) == "" {
+		return errors.New("storage: refuse to remove root")
+	}
+	return os.RemoveAll(l.path(dir))
+}
+
+func (l *Local) MkdirAll(dir string) error {
+	return os.MkdirAll(l.path(dir), 0755)
+}
+
+func localInfo(info fs.FileInfo) FileInfo {
+	var fi = FileInfo{Name: info.Name(), ModTime: info.ModTime(), IsDir: info.IsDir()}
+	if !fi.IsDir {
+		fi.Size = info.Size()
+	}
+	return fi
+}
@@ -0,0 +1,408 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3 兼容的对象存储配置
+type S3Config struct {
+	Endpoint  string // 如 https://s3.us-east-1.amazonaws.com 或 http://127.0.0.1:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string // 所有 key 的公共前缀，可为空
+	PathStyle bool   // 使用 endpoint/bucket/key 形式的地址，MinIO 等需要开启
+}
+
+func (c S3Config) Validate() error {
+	if c.Endpoint == "" || c.Bucket == "" {
+		return errors.New("s3: endpoint and bucket are required")
+	}
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return errors.New("s3: access key and secret key are required")
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("s3: invalid endpoint %q", c.Endpoint)
+	}
+	return nil
+}
+
+// S3 兼容的对象存储，目录以 / 分隔的前缀表示
+type S3 struct {
+	conf   S3Config
+	base   *url.URL
+	prefix string
+	client *http.Client
+}
+
+func NewS3(conf S3Config) (*S3, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	base, _ := url.Parse(strings.TrimSuffix(conf.Endpoint, "/"))
+	if !conf.PathStyle {
+		base.Host = conf.Bucket + "." + base.Host
+	}
+	return &S3{
+		conf:   conf,
+		base:   base,
+		prefix: Clean(conf.Prefix),
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// 对象的完整 key
+func (s *S3) object(key string) string {
+	return path.Join(s.prefix, Clean(key))
+}
+
+// 目录前缀，以 / 结尾，根目录为空
+func (s *S3) dirPrefix(dir string) string {
+	var p = s.object(dir)
+	if p == "" {
+		return ""
+	}
+	return p + "/"
+}
+
+func (s *S3) Open(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.object(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, notExist("open", key)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.fail(resp, "GET", key)
+	}
+	return resp.Body, nil
+}
+
+// 签名需要内容的哈希，所以先读到内存中
+func (s *S3) Write(key string, r io.Reader) error {
+	if Clean(key) == "" {
+		return errors.New("s3: empty key")
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return s.put(s.object(key), data)
+}
+
+func (s *S3) put(object string, data []byte) error {
+	resp, err := s.do("PUT", object, nil, data)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s.fail(resp, "PUT", object)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Stat(key string) (FileInfo, error) {
+	var name = path.Base("/" + Clean(key))
+	if Clean(key) == "" {
+		return FileInfo{Name: "/", IsDir: true}, nil
+	}
+	resp, err := s.do("HEAD", s.object(key), nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		mod, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return FileInfo{Name: name, Size: resp.ContentLength, ModTime: mod}, nil
+	case http.StatusNotFound:
+	default:
+		return FileInfo{}, fmt.Errorf("s3: HEAD %s: %s", key, resp.Status)
+	}
+	// 没有同名对象时，检查是否为目录
+	res, err := s.list(s.dirPrefix(key), "/", 1, "")
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if len(res.Contents) == 0 && len(res.CommonPrefixes) == 0 {
+		return FileInfo{}, notExist("stat", key)
+	}
+	return FileInfo{Name: name, IsDir: true}, nil
+}
+
+func (s *S3) List(dir string) ([]FileInfo, error) {
+	var prefix = s.dirPrefix(dir)
+	var items = make([]FileInfo, 0)
+	var seen = make(map[string]bool)
+	var token string
+	for {
+		res, err := s.list(prefix, "/", 1000, token)
+		if err != nil {
+			return nil, err
+		}
+		for _, cp := range res.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(cp.Prefix, prefix), "/")
+			if name != "" && !seen[name] {
+				seen[name] = true
+				items = append(items, FileInfo{Name: name, IsDir: true})
+			}
+		}
+		for _, obj := range res.Contents {
+			name := strings.TrimPrefix(obj.Key, prefix)
+			// 目录标记，部分实现不会将其归入 CommonPrefixes
+			if name == "" {
+				continue
+			}
+			if strings.HasSuffix(name, "/") {
+				name = strings.TrimSuffix(name, "/")
+				if !seen[name] {
+					seen[name] = true
+					items = append(items, FileInfo{Name: name, IsDir: true, ModTime: obj.LastModified})
+				}
+				continue
+			}
+			items = append(items, FileInfo{Name: name, Size: obj.Size, ModTime: obj.LastModified})
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			break
+		}
+		token = res.NextContinuationToken
+	}
+	if len(items) == 0 && prefix != "" {
+		if _, err := s.Stat(dir); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+	return items, nil
+}
+
+func (s *S3) Remove(key string) error {
+	return s.remove(s.object(key))
+}
+
+func (s *S3) remove(object string) error {
+	resp, err := s.do("DELETE", object, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s.fail(resp, "DELETE", object)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) RemoveAll(dir string) error {
+	var prefix = s.dirPrefix(dir)
+	if Clean(dir) == "" {
+		return errors.New("storage: refuse to remove root")
+	}
+	// 同名对象(非目录)也一并删除，与本地 os.RemoveAll 一致
+	if err := s.remove(s.object(dir)); err != nil {
+		return err
+	}
+	for {
+		res, err := s.list(prefix, "", 1000, "")
+		if err != nil {
+			return err
+		}
+		for _, obj := range res.Contents {
+			if err := s.remove(obj.Key); err != nil {
+				return err
+			}
+		}
+		if !res.IsTruncated {
+			return nil
+		}
+	}
+}
+
+func (s *S3) MkdirAll(dir string) error {
+	if Clean(dir) == "" {
+		return nil
+	}
+	if _, err := s.Stat(dir); err == nil {
+		return nil
+	}
+	return s.put(s.dirPrefix(dir), nil)
+}
+
+type listResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+// ListObjectsV2
+func (s *S3) list(prefix, delimiter string, max int, token string) (*listResult, error) {
+	var q = url.Values{}
+	q.Set("list-type", "2")
+	q.Set("prefix", prefix)
+	q.Set("max-keys", fmt.Sprint(max))
+	if delimiter != "" {
+		q.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	resp, err := s.do("GET", "", q, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.fail(resp, "LIST", prefix)
+	}
+	defer resp.Body.Close()
+	var res listResult
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("s3: decode list: %w", err)
+	}
+	return &res, nil
+}
+
+func (s *S3) fail(resp *http.Response, op, key string) error {
+	defer resp.Body.Close()
+	var e struct {
+		Code    string
+		Message string
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3: %s %s: %s: %s", op, key, e.Code, e.Message)
+	}
+	return fmt.Errorf("s3: %s %s: %s", op, key, resp.Status)
+}
+
+// 发送签名后的请求，object 为空时请求 bucket 本身
+func (s *S3) do(method, object string, query url.Values, body []byte) (*http.Response, error) {
+	var u = *s.base
+	var p = "/"
+	if s.conf.PathStyle {
+		p += s.conf.Bucket + "/"
+	}
+	p += object
+	u.Path = strings.TrimSuffix(s.base.Path, "/") + p
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 && method != "PUT" {
+		req.Body = nil
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// AWS Signature Version 4
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	var amzDate = now.Format("20060102T150405Z")
+	var date = now.Format("20060102")
+	var payload = sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	var signed = []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	var canonicalHeaders = "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payload + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	var canonical = strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		strings.Join(signed, ";"),
+		payload,
+	}, "\n")
+	var scope = date + "/" + s.conf.Region + "/s3/aws4_request"
+	var toSign = "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	var key = hmacSHA256([]byte("AWS4"+s.conf.SecretKey), date)
+	key = hmacSHA256(key, s.conf.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	var signature = hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.conf.AccessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signed, ";")+", Signature="+signature)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// 按 SigV4 规则编码，只保留 A-Z a-z 0-9 - _ . ~
+func uriEncode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func escapePath(p string) string {
+	return uriEncode(p, true)
+}
+
+// 参数按名称排序并编码
+func canonicalQuery(q url.Values) string {
+	if len(q) == 0 {
+		return ""
+	}
+	var keys = make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts = make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, uriEncode(k, false)+"="+uriEncode(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
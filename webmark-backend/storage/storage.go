@@ -0,0 +1,92 @@
+// 文档与附件的存储抽象，key 为以 / 分隔的相对路径，如 username/group/title.md
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// 文件或目录信息
+type FileInfo struct {
+	Name    string    // 最后一级名称
+	Size    int64     // 文件大小，目录为 0
+	ModTime time.Time // 修改时间
+	IsDir   bool
+}
+
+type Storage interface {
+	// 打开文件用于流式读取，调用方负责关闭
+	Open(key string) (io.ReadCloser, error)
+	// 写入文件，已存在时覆盖
+	Write(key string, r io.Reader) error
+	// 文件或目录信息，不存在时返回 fs.ErrNotExist
+	Stat(key string) (FileInfo, error)
+	// 列出目录下一级的文件和目录，按名称排序
+	List(dir string) ([]FileInfo, error)
+	// 删除文件，不存在时不报错
+	Remove(key string) error
+	// 删除目录及其下所有文件
+	RemoveAll(dir string) error
+	// 创建目录，对象存储中为空的目录标记
+	MkdirAll(dir string) error
+}
+
+// 规范化 key，去掉多余的 / 并禁止跳出根目录
+func Clean(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
+
+// 读取整个文件
+func ReadFile(s Storage, key string) ([]byte, error) {
+	rc, err := s.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// 写入整个文件
+func WriteFile(s Storage, key string, data []byte) error {
+	return s.Write(key, bytes.NewReader(data))
+}
+
+// 是否存在
+func Exists(s Storage, key string) bool {
+	_, err := s.Stat(key)
+	return err == nil
+}
+
+// 递归遍历目录下的所有文件和目录，key 为相对根的完整路径
+// fn 对目录返回 fs.SkipDir 时不进入该目录
+func Walk(s Storage, dir string, fn func(key string, fi FileInfo) error) error {
+	items, err := s.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range items {
+		key := path.Join(dir, fi.Name)
+		if err := fn(key, fi); err != nil {
+			// 跳过该目录
+			if fi.IsDir && errors.Is(err, fs.SkipDir) {
+				continue
+			}
+			return err
+		}
+		if fi.IsDir {
+			if err := Walk(s, key, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func notExist(op, key string) error {
+	return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+}
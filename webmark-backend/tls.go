@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"webmark/config"
+)
+
+// 握手时最多每隔这么久检查一次证书文件是否变化
+const certCheckInterval = 10 * time.Second
+
+// 自签名证书有效期
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// 证书文件修改后自动重新加载，加载失败时继续使用旧证书
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) load() error {
+	modTime, err := c.fileModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTime = &cert, modTime
+	return nil
+}
+
+// 证书与私钥中较晚的修改时间
+func (c *certReloader) fileModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+	if modTime, err := c.fileModTime(); err != nil || modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+	if err := c.load(); err != nil {
+		slog.Error("reload certificate failed", "cert", c.certFile, "err", err)
+		return c.cert, nil
+	}
+	slog.Info("certificate reloaded", "cert", c.certFile)
+	return c.cert, nil
+}
+
+// 按配置准备 HTTPS，需要时先生成自签名证书
+func tlsServerConfig(c config.TLS) (*tls.Config, error) {
+	if c.SelfSigned {
+		if _, err := os.Stat(c.CertFile); errors.Is(err, fs.ErrNotExist) {
+			if err := generateSelfSigned(c.CertFile, c.KeyFile, c.Hosts); err != nil {
+				return nil, fmt.Errorf("generate self-signed certificate: %w", err)
+			}
+		}
+	}
+	reloader, err := newCertReloader(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %w", err)
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.GetCertificate}, nil
+}
+
+// 生成 ECDSA 自签名证书，hosts 为空时包含 localhost 与绑定地址
+func generateSelfSigned(certFile, keyFile string, hosts []string) error {
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+		if host, _, err := net.SplitHostPort(Conf.Server.Bind); err == nil && host != "" && !net.ParseIP(host).IsUnspecified() && !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	var now = time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"webmark"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	// 先写私钥，证书文件存在即表示生成完成
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	slog.Warn("self-signed certificate generated", "cert", certFile, "hosts", hosts, "expires", tmpl.NotAfter.Format(time.DateOnly))
+	return nil
+}
+
+func writePEM(name, typ string, der []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), perm)
+}
+
+// HTTP 跳转到 HTTPS，端口取 server.bind
+// 使用 308，POST 等请求跳转后保持原方法与请求体
+func https_redirect(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+	if _, port, err := net.SplitHostPort(Conf.Server.Bind); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
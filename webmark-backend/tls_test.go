@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"webmark/config"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	old := Conf
+	Conf = config.Default()
+	Conf.Server.Bind = ":8443"
+	t.Cleanup(func() { Conf = old })
+
+	for _, m := range []string{"GET", "POST", "PUT", "DELETE"} {
+		r := httptest.NewRequest(m, "http://notes.example.com/wmapi/login?x=1", nil)
+		w := httptest.NewRecorder()
+		https_redirect(w, r)
+		// 308 保持请求方法，不会把 POST 变成 GET
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("%s: status = %d", m, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != "https://notes.example.com:8443/wmapi/login?x=1" {
+			t.Errorf("%s: location = %s", m, got)
+		}
+	}
+}
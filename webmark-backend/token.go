@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"webmark/repo"
+)
+
+// 访问令牌前缀，便于区分令牌与密码
+const apiTokenPrefix = "wmt_"
+
+// 令牌只在创建时返回一次，数据库只保存哈希
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 校验令牌，返回所属用户
+func tokenUser(token string) (string, bool) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return "", false
+	}
+	var hash = hashToken(token)
+	t, err := GDB.Tokens.Get(hash)
+	if err != nil || subtle.ConstantTimeCompare([]byte(hash), []byte(t.Hash)) != 1 {
+		return "", false
+	}
+	if err := GDB.Tokens.Touch(hash, time.Now().Unix()); err != nil {
+		slog.Error("token update failed", "err", err)
+	}
+	return t.Username, true
+}
+
+// Basic 认证，供 git、WebDAV 等客户端使用
+// 密码可以是登录密码或访问令牌；开启两步验证的账户只能使用令牌
+func basicAuth(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username, password, ok := r.BasicAuth()
+	var unauthorized = func() (string, bool) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="webmark", charset="UTF-8"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+	if !ok || loginLocked(username) {
+		return unauthorized()
+	}
+	if owner, ok := tokenUser(password); ok {
+		if owner != username {
+			loginErr(username)
+			return unauthorized()
+		}
+		return username, true
+	}
+	if _, err := authenticate(username, password); err != nil {
+		loginErr(username)
+		return unauthorized()
+	}
+	if totpEnabled(username) {
+		// 密码不能代替两步验证
+		http.Error(w, "two-factor authentication is enabled, use an access token", http.StatusForbidden)
+		return "", false
+	}
+	return username, true
+}
+
+type ApiToken struct {
+	Id       string `json:"id"` // 令牌哈希的前 16 位
+	Name     string `json:"name"`
+	CreateAt int64  `json:"create_at"`
+	LastUsed int64  `json:"last_used"`
+}
+
+// 当前用户的访问令牌
+// /token-list
+func token_list(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	tokens, err := GDB.Tokens.List(session.Name)
+	if err != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	var res = make([]*ApiToken, 0, len(tokens))
+	for _, t := range tokens {
+		res = append(res, &ApiToken{Id: t.Hash[:16], Name: t.Name, CreateAt: t.CreateAt, LastUsed: t.LastUsed})
+	}
+	SuccessResponse(w, r, res)
+}
+
+// 创建访问令牌，令牌只返回这一次
+// /token-create
+func token_create(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	var input struct {
+		Name string `json:"name"`
+	}
+	if nil != ReadJson(r, &input) {
+		ErrorResponse(w, r)
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" || len(input.Name) > 100 {
+		ErrorResponseWithMsg(w, r, "名称不能为空")
+		return
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	var token = apiTokenPrefix + hex.EncodeToString(b)
+	var hash = hashToken(token)
+	err := GDB.Tokens.Create(&repo.Token{Hash: hash, Username: session.Name, Name: input.Name, CreateAt: time.Now().Unix()})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "create token failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	SuccessResponse(w, r, map[string]any{"id": hash[:16], "token": token})
+}
+
+// 删除访问令牌
+// /token-delete
+func token_delete(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	var input struct {
+		Id string `json:"id"`
+	}
+	if nil != ReadJson(r, &input) || len(input.Id) != 16 {
+		ErrorResponse(w, r)
+		return
+	}
+	if _, err := hex.DecodeString(input.Id); err != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	err := GDB.Tokens.Delete(session.Name, input.Id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "delete token failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	SuccessResponse(w, r, true)
+}
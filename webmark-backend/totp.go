@@ -0,0 +1,325 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"webmark/utils"
+)
+
+// 两步验证签发者名称，显示在认证器中
+const TotpIssuer = "webmark"
+
+// 登录票据有效期，密码校验通过后需在此时间内提交验证码
+const LoginTicketExpires = 5 * time.Minute
+
+// 恢复码数量
+const RecoveryCodeCount = 10
+
+// 是否开启了两步验证
+func totpEnabled(username string) bool {
+	enabled, err := GDB.TOTP.Enabled(username)
+	return err == nil && enabled
+}
+
+// 发放登录票据
+func newLoginTicket(username string) (string, error) {
+	var ticket = Uuid()
+	err := GDB.Sessions.CreateTicket(ticket, username, time.Now().Add(LoginTicketExpires).Unix())
+	if err != nil {
+		return "", err
+	}
+	return ticket, nil
+}
+
+// 校验验证码，并记录使用过的时间步防止重放
+func totpVerify(username, code string) bool {
+	secret, last_step, err := GDB.TOTP.Secret(username)
+	if err != nil {
+		return false
+	}
+	step, ok := utils.TotpValidate(secret, code, time.Now(), 1)
+	if !ok || step <= last_step {
+		return false
+	}
+	// 并发的请求使用同一个验证码时只有一个能更新成功
+	ok, err = GDB.TOTP.UseStep(username, step)
+	if err != nil {
+		slog.Error("totp update failed", "err", err)
+		return false
+	}
+	return ok
+}
+
+// 使用恢复码，每个恢复码只能用一次
+func recoveryVerify(username, code string) bool {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if code == "" {
+		return false
+	}
+	hashes, err := GDB.TOTP.RecoveryHashes(username)
+	if err != nil {
+		return false
+	}
+	// 哈希带盐，可以唯一确定一个恢复码
+	var matched string
+	for _, code_hash := range hashes {
+		if Verify(code_hash, code) {
+			matched = code_hash
+			break
+		}
+	}
+	if matched == "" {
+		return false
+	}
+	// 删除成功才算使用，同一个恢复码并发使用时只有一个成功
+	ok, err := GDB.TOTP.UseRecoveryCode(username, matched)
+	if err != nil {
+		slog.Error("recovery code delete failed", "err", err)
+		return false
+	}
+	return ok
+}
+
+// 生成一组新的恢复码，数据库中只保存哈希
+func newRecoveryCodes(username string) ([]string, error) {
+	var codes = make([]string, 0, RecoveryCodeCount)
+	var hashes = make([]string, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		raw := strings.ReplaceAll(Uuid(), "-", "")[:10]
+		hashes = append(hashes, Genpass(raw))
+		codes = append(codes, raw[:5]+"-"+raw[5:])
+	}
+	if err := GDB.TOTP.SetRecoveryCodes(username, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// 清除用户的两步验证
+func totpClear(username string) error {
+	return GDB.TOTP.Clear(username)
+}
+
+// 清理过期的登录票据
+func loginTicketClear() {
+	err := GDB.Sessions.ExpireTickets(time.Now().Unix())
+	if err != nil {
+		slog.Error("login ticket clear failed", "err", err)
+	}
+}
+
+// 两步验证状态
+// /totp-status
+func totp_status(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	remaining, err := GDB.TOTP.RecoveryRemaining(session.Name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "totp status failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	SuccessResponse(w, r, map[string]any{"enabled": totpEnabled(session.Name), "recovery_remaining": remaining})
+}
+
+// 开始绑定认证器，返回密钥和二维码地址
+// /totp-setup
+func totp_setup(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	if r.Method != "POST" {
+		ErrorResponse(w, r)
+		return
+	}
+	if totpEnabled(session.Name) {
+		ErrorResponseWithMsg(w, r, "两步验证已开启")
+		return
+	}
+	secret, err := utils.GenerateTotpSecret()
+	if err != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	// 未确认前 enabled 为 0，重复调用会覆盖之前的密钥
+	err = GDB.TOTP.Setup(session.Name, secret, time.Now().Unix())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "totp setup failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	SuccessResponse(w, r, map[string]string{
+		"secret": secret,
+		"uri":    utils.TotpProvisioningURI(TotpIssuer, session.Name, secret),
+	})
+}
+
+type TotpCode struct {
+	Code string `json:"code"` // 验证码或恢复码
+}
+
+// 确认绑定，返回恢复码(仅此一次)
+// /totp-enable
+func totp_enable(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	if r.Method != "POST" {
+		ErrorResponse(w, r)
+		return
+	}
+	var tc TotpCode
+	if nil != ReadJson(r, &tc) {
+		ErrorResponse(w, r)
+		return
+	}
+	if totpEnabled(session.Name) {
+		ErrorResponseWithMsg(w, r, "两步验证已开启")
+		return
+	}
+	if !totpVerify(session.Name, tc.Code) {
+		ErrorResponseWithMsg(w, r, "验证码错误")
+		return
+	}
+	codes, err := newRecoveryCodes(session.Name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "recovery codes failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	err = GDB.TOTP.Enable(session.Name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "totp enable failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	SuccessResponse(w, r, codes)
+}
+
+type TotpDisable struct {
+	Password string `json:"password"` // 当前密码
+	Code     string `json:"code"`     // 验证码或恢复码
+}
+
+// 关闭两步验证，需要密码和验证码
+// /totp-disable
+func totp_disable(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	if r.Method != "POST" {
+		ErrorResponse(w, r)
+		return
+	}
+	var td TotpDisable
+	if nil != ReadJson(r, &td) {
+		ErrorResponse(w, r)
+		return
+	}
+	if _, err := authenticate(session.Name, td.Password); err != nil {
+		ErrorResponseWithMsg(w, r, "密码错误")
+		return
+	}
+	if !totpVerify(session.Name, td.Code) && !recoveryVerify(session.Name, td.Code) {
+		ErrorResponseWithMsg(w, r, "验证码错误")
+		return
+	}
+	if err := totpClear(session.Name); err != nil {
+		slog.ErrorContext(r.Context(), "totp disable failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	SuccessResponse(w, r, true)
+}
+
+type TotpLogin struct {
+	Ticket string `json:"ticket"` // 登录票据
+	Code   string `json:"code"`   // 验证码或恢复码
+}
+
+// 登录第二步，校验通过后创建会话
+// /totp-login
+func totp_login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		ErrorResponse(w, r)
+		return
+	}
+	var tl TotpLogin
+	if nil != ReadJson(r, &tl) {
+		ErrorResponse(w, r)
+		return
+	}
+	username, expire, err := GDB.Sessions.Ticket(tl.Ticket)
+	if err != nil || expire < time.Now().Unix() {
+		ErrorResponseWithMsg(w, r, "登录已过期，请重新登录")
+		return
+	}
+	// 与密码共用失败计数
+	if loginLocked(username) {
+		GDB.Sessions.TakeTicket(tl.Ticket)
+		ErrorResponseWithMsg(w, r, "fack off")
+		return
+	}
+	if !totpVerify(username, tl.Code) && !recoveryVerify(username, tl.Code) {
+		loginErr(username)
+		ErrorResponseWithMsg(w, r, "验证码错误")
+		return
+	}
+	// 票据只能兑换一次
+	taken, err := GDB.Sessions.TakeTicket(tl.Ticket)
+	if err != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	if !taken {
+		ErrorResponseWithMsg(w, r, "登录已过期，请重新登录")
+		return
+	}
+	if err := createSession(w, r, username); err != nil {
+		ErrorResponse(w, r)
+		return
+	}
+	SuccessResponse(w, r, "success")
+}
+
+type TotpReset struct {
+	Username string `json:"username"`
+}
+
+// 重置用户的两步验证，仅管理员可以
+// /totp-reset
+func totp_reset(w http.ResponseWriter, r *http.Request) {
+	var suc, session = Auth(w, r)
+	if !suc {
+		return
+	}
+	if !isAdmin(session.Name) {
+		ErrorResponse(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		ErrorResponse(w, r)
+		return
+	}
+	var tr TotpReset
+	if nil != ReadJson(r, &tr) || tr.Username == "" {
+		ErrorResponse(w, r)
+		return
+	}
+	if err := totpClear(tr.Username); err != nil {
+		slog.ErrorContext(r.Context(), "totp reset failed", "err", err)
+		ErrorResponse(w, r)
+		return
+	}
+	// 作废尚未完成的登录
+	GDB.Sessions.DeleteTickets(tr.Username)
+	slog.InfoContext(r.Context(), "totp reset", "user", tr.Username, "by", session.Name)
+	SuccessResponse(w, r, true)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"webmark/client"
+	"webmark/utils"
+)
+
+// 用密码登录拿到两步验证票据
+func totpTicket(t *testing.T, cl *client.Client) string {
+	t.Helper()
+	res, err := cl.Login(context.Background(), "root", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.TOTP || res.Ticket == "" {
+		t.Fatalf("Login = %+v, want totp ticket", res)
+	}
+	return res.Ticket
+}
+
+func TestServerTOTPReplay(t *testing.T) {
+	srv := newTestServer(t)
+	ctx := context.Background()
+	secret, err := utils.GenerateTotpSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := GDB.TOTP.Setup("root", secret, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if err := GDB.TOTP.Enable("root"); err != nil {
+		t.Fatal(err)
+	}
+	recovery, err := newRecoveryCodes("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := newTestClient(t, srv, client.Config{})
+
+	// 同一个时间步的验证码只能用一次
+	code, err := utils.TotpCode(secret, utils.TotpStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.LoginTOTP(ctx, totpTicket(t, cl), code); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.LoginTOTP(ctx, totpTicket(t, cl), code); err == nil {
+		t.Fatal("totp code reused")
+	}
+
+	// 恢复码只能用一次，格式不影响匹配
+	if err := cl.LoginTOTP(ctx, totpTicket(t, cl), recovery[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{recovery[0], strings.ReplaceAll(strings.ToUpper(recovery[0]), "-", "")} {
+		if err := cl.LoginTOTP(ctx, totpTicket(t, cl), c); err == nil {
+			t.Fatalf("recovery code %q reused", c)
+		}
+	}
+	if n, err := GDB.TOTP.RecoveryRemaining("root"); err != nil || n != RecoveryCodeCount-1 {
+		t.Fatalf("RecoveryRemaining = %d, %v, want %d", n, err, RecoveryCodeCount-1)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"webmark/repo"
+)
+
+// webmark user add|del|passwd|list
+func cmd_user(args []string) error {
+	var usage = errors.New("usage: webmark user add|del|passwd|list [flags] [username]")
+	if len(args) == 0 {
+		return usage
+	}
+	var action, rest = args[0], args[1:]
+	var configPath, password, role string
+	var purge bool
+	fs := flag.NewFlagSet("user "+action, flag.ExitOnError)
+	configFlags(fs, &configPath)
+	switch action {
+	case "add":
+		fs.StringVar(&password, "password", "", "密码，为空时从标准输入读取一行")
+		fs.StringVar(&role, "role", "user", "角色：user 或 admin")
+	case "passwd":
+		fs.StringVar(&password, "password", "", "新密码，为空时从标准输入读取一行")
+	case "del":
+		fs.BoolVar(&purge, "purge", false, "同时删除用户的所有文档")
+	case "list":
+	default:
+		return usage
+	}
+	flags, names, err := parseArgs(fs, rest)
+	if err != nil {
+		return err
+	}
+	// 只接受一个用户名，多余的参数视为用法错误，避免被静默忽略
+	var username string
+	switch {
+	case action == "list" && len(names) > 0, action != "list" && len(names) != 1:
+		return usage
+	case len(names) == 1:
+		username = names[0]
+	}
+	if action == "add" && role != "user" && role != "admin" {
+		return fmt.Errorf("user add: invalid role %q", role)
+	}
+	if (action == "add" || action == "passwd") && password == "" {
+		var err error
+		if password, err = readPassword(); err != nil {
+			return err
+		}
+	}
+	if err := loadConfig(fs, configPath, flags); err != nil {
+		return err
+	}
+	end, err := beginCommand()
+	if err != nil {
+		return err
+	}
+	defer end()
+	switch action {
+	case "add":
+		return userAdd(username, password, role)
+	case "passwd":
+		return userPasswd(username, password)
+	case "del":
+		return userDel(username, purge)
+	default:
+		return userList()
+	}
+}
+
+// 从标准输入读取密码，便于在脚本中通过管道传入
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		if err != nil {
+			return "", fmt.Errorf("read password: %w", err)
+		}
+		return "", errors.New("password is empty")
+	}
+	return line, nil
+}
+
+func userAdd(username, password, role string) error {
+	if !validName(username) {
+		return fmt.Errorf("user add: invalid username %q", username)
+	}
+	if err := AddUser(username, password); err != nil {
+		return fmt.Errorf("user add: %w", err)
+	}
+	if err := GDB.Users.SetRole(username, role); err != nil {
+		return err
+	}
+	user_check(username)
+	fmt.Printf("user %s added (%s)\n", username, role)
+	return nil
+}
+
+// 修改密码后该用户的所有会话下线
+func userPasswd(username, password string) error {
+	user, err := GDB.Users.Get(username)
+	if err != nil {
+		return fmt.Errorf("user passwd: user %s not found", username)
+	}
+	if user.Source != "" && user.Source != "local" {
+		return fmt.Errorf("user passwd: %s is managed by %s", username, user.Source)
+	}
+	if err := GDB.Users.SetPassword(username, Genpass(password)); err != nil {
+		return err
+	}
+	if err := GDB.Sessions.DeleteUser(username, ""); err != nil {
+		return err
+	}
+	fmt.Printf("password of %s updated, sessions revoked\n", username)
+	return nil
+}
+
+// 删除账户及其登录相关的数据，purge 时同时删除文档与索引
+func userDel(username string, purge bool) error {
+	if username == "root" {
+		return errors.New("user del: root cannot be deleted")
+	}
+	if _, err := GDB.Users.Get(username); errors.Is(err, repo.ErrNotFound) {
+		return fmt.Errorf("user del: user %s not found", username)
+	} else if err != nil {
+		return err
+	}
+	if err := GDB.Users.Delete(username); err != nil {
+		return fmt.Errorf("user del: %w", err)
+	}
+	if purge {
+		groups, err := GDB.Groups.Names(username)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			if err := GDB.Docs.DeleteGroup(username, group); err != nil {
+				return err
+			}
+		}
+		if err := Store.RemoveAll(username); err != nil {
+			return err
+		}
+		fmt.Printf("user %s deleted with %d groups\n", username, len(groups))
+		return nil
+	}
+	fmt.Printf("user %s deleted, documents kept\n", username)
+	return nil
+}
+
+func userList() error {
+	users, err := GDB.Users.List()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USERNAME\tROLE\tSOURCE\tDOCS\tTOTP")
+	for _, u := range users {
+		var role = u.Role
+		if u.Username == "root" {
+			role = "admin"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%v\n", u.Username, role, u.Source, u.Docs, u.TOTP)
+	}
+	return tw.Flush()
+}
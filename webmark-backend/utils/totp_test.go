@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 附录 B 的 SHA1 密钥 "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTotpCodeRFC6238(t *testing.T) {
+	// 附录 B 为 8 位验证码，这里取后 6 位
+	var tests = []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		got, err := TotpCode(rfcSecret, TotpStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.want[len(tt.want)-TotpDigits:]; got != want {
+			t.Errorf("TotpCode at %d = %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestTotpCodeSecretFormat(t *testing.T) {
+	want, _ := TotpCode(rfcSecret, 1)
+	// 认证器导出的密钥可能是小写或带填充
+	for _, s := range []string{strings.ToLower(rfcSecret), rfcSecret + "===="} {
+		got, err := TotpCode(s, 1)
+		if err != nil || got != want {
+			t.Errorf("TotpCode(%q) = %s, %v, want %s", s, got, err, want)
+		}
+	}
+	if _, err := TotpCode("not base32!", 1); err == nil {
+		t.Error("TotpCode accepted an invalid secret")
+	}
+}
+
+func TestTotpValidateSkew(t *testing.T) {
+	var now = time.Unix(1234567890, 0)
+	var step = TotpStep(now)
+	code := func(s int64) string {
+		c, err := TotpCode(rfcSecret, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	var tests = []struct {
+		name   string
+		code   string
+		skew   int
+		want   int64
+		wantOk bool
+	}{
+		{"current", code(step), 1, step, true},
+		{"previous", code(step - 1), 1, step - 1, true},
+		{"next", code(step + 1), 1, step + 1, true},
+		{"too old", code(step - 2), 1, 0, false},
+		{"too new", code(step + 2), 1, 0, false},
+		{"no skew", code(step - 1), 0, 0, false},
+		{"spaces", " " + code(step) + " ", 1, step, true},
+		{"short", code(step)[1:], 1, 0, false},
+		{"empty", "", 1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := TotpValidate(rfcSecret, tt.code, now, tt.skew)
+			if ok != tt.wantOk || got != tt.want {
+				t.Errorf("TotpValidate = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
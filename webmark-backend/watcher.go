@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"webmark/storage"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// 监听数据目录，直接修改文件后自动刷新索引
+var WatchEnabled = true
+
+// 最后一次变化后等待该时长再处理，编辑器保存时通常会连续产生多个事件
+var WatchDebounce = 500 * time.Millisecond
+
+// 数据目录结构为 用户/分组/文档.md，分别监听根目录、用户目录与分组目录
+// fsnotify 不支持递归监听，新建的目录在处理事件时补充监听
+type dataWatcher struct {
+	root    string
+	watcher *fsnotify.Watcher
+	pending map[string]struct{} // 待处理的路径，相对数据目录
+}
+
+// 启动监听，仅本地存储有效
+func watchData(ctx context.Context) {
+	local, ok := Store.(*storage.Local)
+	if !ok {
+		slog.Info("watch disabled, storage is not local")
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("watch failed", "err", err)
+		return
+	}
+	defer watcher.Close()
+	var dw = &dataWatcher{root: local.Root, watcher: watcher, pending: make(map[string]struct{})}
+	if err := os.MkdirAll(dw.root, 0755); err != nil {
+		slog.Error("watch failed", "err", err)
+		return
+	}
+	dw.add("")
+	slog.Info("watch data directory", "path", dw.root)
+
+	t := time.NewTimer(WatchDebounce)
+	t.Stop()
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if dw.enqueue(ev) {
+				t.Reset(WatchDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			// 事件队列溢出时会丢失事件，需要手动刷新索引
+			slog.Error("watch failed", "err", err)
+		case <-t.C:
+			dw.flush()
+		}
+	}
+}
+
+// 监听目录及其下两层以内的子目录，rel 为相对数据目录的路径
+func (dw *dataWatcher) add(rel string) {
+	if err := dw.watcher.Add(filepath.Join(dw.root, filepath.FromSlash(rel))); err != nil {
+		slog.Error("watch add failed", "path", rel, "err", err)
+		return
+	}
+	if depth(rel) >= 2 {
+		return
+	}
+	entries, err := os.ReadDir(filepath.Join(dw.root, filepath.FromSlash(rel)))
+	if err != nil {
+		slog.Error("watch add failed", "path", rel, "err", err)
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() && !ignored(e.Name()) {
+			dw.add(path.Join(rel, e.Name()))
+		}
+	}
+}
+
+// 目录层级，用户目录为 1，分组目录为 2
+func depth(rel string) int {
+	if rel == "" {
+		return 0
+	}
+	return strings.Count(rel, "/") + 1
+}
+
+// 隐藏文件与写入中的临时文件
+func ignored(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// 记录需要处理的路径，返回是否需要重新计时
+func (dw *dataWatcher) enqueue(ev fsnotify.Event) bool {
+	if ev.Op == fsnotify.Chmod {
+		return false
+	}
+	rel, err := filepath.Rel(dw.root, ev.Name)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	if ignored(path.Base(rel)) {
+		return false
+	}
+	switch depth(rel) {
+	case 1, 2:
+		// 用户目录、分组目录
+	case 3:
+		// 只关心文档，附件目录不处理
+		if !strings.HasSuffix(rel, ".md") {
+			return false
+		}
+	default:
+		return false
+	}
+	dw.pending[rel] = struct{}{}
+	indexQueueDepth.Store(int64(len(dw.pending)))
+	return true
+}
+
+// 处理积累的变化
+func (dw *dataWatcher) flush() {
+	// 与备份互斥，保证备份时数据库与文件一致
+	snapshotLock.RLock()
+	defer snapshotLock.RUnlock()
+	for rel := range dw.pending {
+		delete(dw.pending, rel)
+		indexQueueDepth.Store(int64(len(dw.pending)))
+		info, err := os.Stat(filepath.Join(dw.root, filepath.FromSlash(rel)))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("watch failed", "err", err)
+			continue
+		}
+		var exists = err == nil
+		var parts = strings.Split(rel, "/")
+		switch len(parts) {
+		case 1:
+			// 新用户目录，或者整个目录移动进来
+			if exists && info.IsDir() {
+				dw.add(rel)
+				indexUserFiles(parts[0])
+			}
+		case 2:
+			if exists && info.IsDir() {
+				dw.add(rel)
+				indexGroupFiles(parts[0], parts[1])
+			} else if !exists {
+				// 分组目录被删除或改名
+				slog.Info("watch remove group", "path", rel)
+				if err := GDB.Docs.DeleteGroup(parts[0], parts[1]); err != nil {
+					slog.Error("watch failed", "err", err)
+				}
+			}
+		case 3:
+			var title = strings.TrimSuffix(parts[2], ".md")
+			if !exists {
+				slog.Info("watch remove index", "path", rel)
+				DeleteIndex(parts[0], parts[1], title)
+			} else if !info.IsDir() {
+				indexDocFile(parts[0], parts[1], title)
+			}
+		}
+	}
+}
+
+// 刷新用户所有分组的索引
+func indexUserFiles(username string) {
+	groups, err := Store.List(username)
+	if err != nil {
+		slog.Error("index failed", "user", username, "err", err)
+		return
+	}
+	for _, group := range groups {
+		if group.IsDir && !ignored(group.Name) {
+			indexGroupFiles(username, group.Name)
+		}
+	}
+}
+
+// 登记分组并刷新分组下所有文档的索引
+func indexGroupFiles(username, group string) {
+	group_check(username, group)
+	files, err := Store.List(path.Join(username, group))
+	if err != nil {
+		slog.Error("index failed", "user", username, "group", group, "err", err)
+		return
+	}
+	for _, file := range files {
+		if !file.IsDir && !ignored(file.Name) && strings.HasSuffix(file.Name, ".md") {
+			indexDocFile(username, group, strings.TrimSuffix(file.Name, ".md"))
+		}
+	}
+}
+
+// 从文件刷新一篇文档的索引
+// 内容与建索引时相同则跳过，网页端保存时已经建过索引，随后的文件事件不再重复分词
+func indexDocFile(username, group, title string) {
+	content, err := storage.ReadFile(Store, path.Join(username, group, title+".md"))
+	if err != nil {
+		slog.Error("index failed", "user", username, "group", group, "title", title, "err", err)
+		return
+	}
+	if hash, err := GDB.Docs.Hash(username, group, title); err == nil && hash == contentHash(content) {
+		slog.Debug("index unchanged", "path", path.Join(username, group, title))
+		return
+	}
+	slog.Info("refresh index", "path", path.Join(username, group, title))
+	group_check(username, group)
+	MakeIndex(username, group, title, string(content))
+}
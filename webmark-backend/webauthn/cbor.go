@@ -0,0 +1,140 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// 只实现 WebAuthn 用到的 CBOR 子集：定长的整数、字节串、文本、数组、映射和简单值
+
+var errCbor = errors.New("invalid cbor")
+
+// 最大嵌套深度，防止恶意数据耗尽栈
+const cborMaxDepth = 16
+
+// 解码一个 CBOR 数据项，返回剩余字节
+// 映射的键为 int64 或 string
+func cborDecode(b []byte) (any, []byte, error) {
+	return cborDecodeDepth(b, 0)
+}
+
+func cborHead(b []byte) (major byte, arg uint64, rest []byte, err error) {
+	if len(b) < 1 {
+		return 0, 0, nil, errCbor
+	}
+	major = b[0] >> 5
+	info := b[0] & 0x1f
+	b = b[1:]
+	switch {
+	case info < 24:
+		return major, uint64(info), b, nil
+	case info == 24:
+		if len(b) < 1 {
+			return 0, 0, nil, errCbor
+		}
+		return major, uint64(b[0]), b[1:], nil
+	case info == 25:
+		if len(b) < 2 {
+			return 0, 0, nil, errCbor
+		}
+		return major, uint64(binary.BigEndian.Uint16(b)), b[2:], nil
+	case info == 26:
+		if len(b) < 4 {
+			return 0, 0, nil, errCbor
+		}
+		return major, uint64(binary.BigEndian.Uint32(b)), b[4:], nil
+	case info == 27:
+		if len(b) < 8 {
+			return 0, 0, nil, errCbor
+		}
+		return major, binary.BigEndian.Uint64(b), b[8:], nil
+	}
+	// 不支持不定长编码
+	return 0, 0, nil, errCbor
+}
+
+func cborDecodeDepth(b []byte, depth int) (any, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errCbor
+	}
+	major, arg, rest, err := cborHead(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCbor
+		}
+		return int64(arg), rest, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCbor
+		}
+		return -1 - int64(arg), rest, nil
+	case 2, 3:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCbor
+		}
+		if major == 2 {
+			return rest[:arg], rest[arg:], nil
+		}
+		return string(rest[:arg]), rest[arg:], nil
+	case 4:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCbor
+		}
+		var arr = make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var v any
+			v, rest, err = cborDecodeDepth(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, rest, nil
+	case 5:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCbor
+		}
+		var m = make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			var k, v any
+			k, rest, err = cborDecodeDepth(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCbor
+			}
+			v, rest, err = cborDecodeDepth(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, rest, nil
+	case 6:
+		// 标签直接忽略，返回被标记的值
+		return cborDecodeDepth(rest, depth+1)
+	case 7:
+		if b[0]&0x1f >= 24 {
+			// 浮点数等不支持
+			return nil, nil, errCbor
+		}
+		switch arg {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		}
+		return nil, nil, errCbor
+	}
+	return nil, nil, errCbor
+}
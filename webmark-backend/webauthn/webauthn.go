@@ -0,0 +1,277 @@
+// WebAuthn 注册与认证仪式的服务端校验
+// 只接受 "none" 形式的证明，不校验认证器厂商证书
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// 认证器数据标志位
+const (
+	FlagUserPresent  = 0x01
+	FlagUserVerified = 0x04
+	FlagAttested     = 0x40
+	FlagExtensions   = 0x80
+)
+
+// COSE 算法编号
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// 支持的算法，按优先顺序
+var SupportedAlgs = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+var Encoding = base64.RawURLEncoding
+
+// 生成随机挑战，base64url 编码
+func NewChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return Encoding.EncodeToString(b), nil
+}
+
+// 客户端数据
+type ClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+func checkClientData(raw []byte, typ, challenge, origin string) error {
+	var cd ClientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return fmt.Errorf("client data: %w", err)
+	}
+	if cd.Type != typ {
+		return fmt.Errorf("client data type %q", cd.Type)
+	}
+	if cd.Challenge != challenge {
+		return errors.New("challenge mismatch")
+	}
+	if cd.Origin != origin {
+		return fmt.Errorf("origin mismatch: %s", cd.Origin)
+	}
+	if cd.CrossOrigin {
+		return errors.New("cross origin not allowed")
+	}
+	return nil
+}
+
+// 认证器数据
+type AuthenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte // COSE 编码的公钥
+}
+
+func ParseAuthenticatorData(b []byte) (*AuthenticatorData, error) {
+	if len(b) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	ad := &AuthenticatorData{
+		RPIDHash:  b[:32],
+		Flags:     b[32],
+		SignCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	rest := b[37:]
+	if ad.Flags&FlagAttested != 0 {
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data too short")
+		}
+		ad.AAGUID = rest[:16]
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if n == 0 || n > 1023 || len(rest) < n {
+			return nil, errors.New("invalid credential id")
+		}
+		ad.CredentialID = rest[:n]
+		rest = rest[n:]
+		_, after, err := cborDecode(rest)
+		if err != nil {
+			return nil, fmt.Errorf("credential public key: %w", err)
+		}
+		ad.PublicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+	if ad.Flags&FlagExtensions != 0 {
+		_, after, err := cborDecode(rest)
+		if err != nil {
+			return nil, fmt.Errorf("extensions: %w", err)
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing authenticator data")
+	}
+	return ad, nil
+}
+
+func (ad *AuthenticatorData) check(rpID string, requireUV bool) error {
+	h := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(ad.RPIDHash, h[:]) {
+		return errors.New("rp id hash mismatch")
+	}
+	if ad.Flags&FlagUserPresent == 0 {
+		return errors.New("user not present")
+	}
+	if requireUV && ad.Flags&FlagUserVerified == 0 {
+		return errors.New("user not verified")
+	}
+	return nil
+}
+
+// 解析 COSE 公钥
+func ParsePublicKey(cose []byte) (crypto.PublicKey, int64, error) {
+	v, rest, err := cborDecode(cose)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, ok := v.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return nil, 0, errors.New("invalid cose key")
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == AlgES256:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("invalid ec2 key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, errors.New("point not on curve")
+		}
+		return pub, alg, nil
+	case kty == 1 && alg == AlgEdDSA:
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("invalid okp key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case kty == 3 && alg == AlgRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("invalid rsa key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, alg, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported key type %d alg %d", kty, alg)
+}
+
+// 使用 COSE 公钥校验签名
+func VerifySignature(cose, data, sig []byte) error {
+	pub, alg, err := ParsePublicKey(cose)
+	if err != nil {
+		return err
+	}
+	switch alg {
+	case AlgES256:
+		h := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), h[:], sig) {
+			return errors.New("bad signature")
+		}
+	case AlgEdDSA:
+		if !ed25519.Verify(pub.(ed25519.PublicKey), data, sig) {
+			return errors.New("bad signature")
+		}
+	case AlgRS256:
+		h := sha256.Sum256(data)
+		if err := rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, h[:], sig); err != nil {
+			return errors.New("bad signature")
+		}
+	}
+	return nil
+}
+
+// 注册结果
+type Credential struct {
+	ID        []byte
+	PublicKey []byte
+	SignCount uint32
+}
+
+// 校验注册仪式 (navigator.credentials.create)
+func VerifyRegistration(rpID, origin, challenge string, clientDataJSON, attestationObject []byte, requireUV bool) (*Credential, error) {
+	if err := checkClientData(clientDataJSON, "webauthn.create", challenge, origin); err != nil {
+		return nil, err
+	}
+	v, rest, err := cborDecode(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("attestation object: %w", err)
+	}
+	m, ok := v.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return nil, errors.New("invalid attestation object")
+	}
+	raw, _ := m["authData"].([]byte)
+	ad, err := ParseAuthenticatorData(raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := ad.check(rpID, requireUV); err != nil {
+		return nil, err
+	}
+	if ad.Flags&FlagAttested == 0 {
+		return nil, errors.New("no attested credential")
+	}
+	if _, _, err := ParsePublicKey(ad.PublicKey); err != nil {
+		return nil, err
+	}
+	return &Credential{ID: ad.CredentialID, PublicKey: ad.PublicKey, SignCount: ad.SignCount}, nil
+}
+
+// 校验认证仪式 (navigator.credentials.get)，返回认证器数据供调用方检查签名计数
+func VerifyAssertion(rpID, origin, challenge string, publicKey, clientDataJSON, authenticatorData, signature []byte, requireUV bool) (*AuthenticatorData, error) {
+	if err := checkClientData(clientDataJSON, "webauthn.get", challenge, origin); err != nil {
+		return nil, err
+	}
+	ad, err := ParseAuthenticatorData(authenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	if err := ad.check(rpID, requireUV); err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authenticatorData...), h[:]...)
+	if err := VerifySignature(publicKey, signed, signature); err != nil {
+		return nil, err
+	}
+	return ad, nil
+}
+
+// 签名计数检查，计数没有增长说明认证器可能被克隆
+// 两边都为 0 表示认证器不支持计数
+func SignCountValid(stored, received uint32) bool {
+	if stored == 0 && received == 0 {
+		return true
+	}
+	return received > stored
+}
@@ -0,0 +1,295 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const (
+	testRPID   = "notes.example.com"
+	testOrigin = "https://notes.example.com"
+)
+
+// 测试用的 CBOR 编码，只覆盖认证器会产生的类型
+func cborEncode(v any) []byte {
+	var buf bytes.Buffer
+	cborWrite(&buf, v)
+	return buf.Bytes()
+}
+
+func cborWriteHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major<<5 | byte(n))
+	case n <= 0xff:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(n))
+	case n <= 0xffff:
+		buf.WriteByte(major<<5 | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(major<<5 | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func cborWrite(buf *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case int:
+		if v >= 0 {
+			cborWriteHead(buf, 0, uint64(v))
+		} else {
+			cborWriteHead(buf, 1, uint64(-1-v))
+		}
+	case []byte:
+		cborWriteHead(buf, 2, uint64(len(v)))
+		buf.Write(v)
+	case string:
+		cborWriteHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case map[int]any:
+		keys := make([]int, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Ints(keys)
+		cborWriteHead(buf, 5, uint64(len(v)))
+		for _, k := range keys {
+			cborWrite(buf, k)
+			cborWrite(buf, v[k])
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		cborWriteHead(buf, 5, uint64(len(v)))
+		for _, k := range keys {
+			cborWrite(buf, k)
+			cborWrite(buf, v[k])
+		}
+	default:
+		panic("cbor: unsupported type")
+	}
+}
+
+// 软件认证器，ES256 密钥
+type softAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	credID    []byte
+	signCount uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{key: key, credID: []byte("credential-0001")}
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	return cborEncode(map[int]any{1: 2, 3: AlgES256, -1: 1, -2: x, -3: y})
+}
+
+func authData(rpID string, flags byte, signCount uint32, attested []byte) []byte {
+	h := sha256.Sum256([]byte(rpID))
+	var buf bytes.Buffer
+	buf.Write(h[:])
+	buf.WriteByte(flags)
+	binary.Write(&buf, binary.BigEndian, signCount)
+	buf.Write(attested)
+	return buf.Bytes()
+}
+
+func clientData(typ, challenge, origin string) []byte {
+	b, _ := json.Marshal(ClientData{Type: typ, Challenge: challenge, Origin: origin})
+	return b
+}
+
+// navigator.credentials.create
+func (a *softAuthenticator) create(rpID string, flags byte) []byte {
+	var attested bytes.Buffer
+	attested.Write(make([]byte, 16)) // AAGUID
+	binary.Write(&attested, binary.BigEndian, uint16(len(a.credID)))
+	attested.Write(a.credID)
+	attested.Write(a.coseKey())
+	ad := authData(rpID, flags|FlagAttested, a.signCount, attested.Bytes())
+	return cborEncode(map[string]any{"fmt": "none", "attStmt": map[string]any{}, "authData": ad})
+}
+
+// navigator.credentials.get，返回认证器数据与签名
+func (a *softAuthenticator) get(t *testing.T, rpID string, flags byte, cdj []byte) ([]byte, []byte) {
+	t.Helper()
+	a.signCount++
+	ad := authData(rpID, flags, a.signCount, nil)
+	h := sha256.Sum256(cdj)
+	digest := sha256.Sum256(append(append([]byte{}, ad...), h[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ad, sig
+}
+
+func register(t *testing.T, a *softAuthenticator) *Credential {
+	t.Helper()
+	challenge, _ := NewChallenge()
+	cred, err := VerifyRegistration(testRPID, testOrigin, challenge,
+		clientData("webauthn.create", challenge, testOrigin), a.create(testRPID, FlagUserPresent), false)
+	if err != nil {
+		t.Fatalf("VerifyRegistration: %v", err)
+	}
+	return cred
+}
+
+func TestRegistrationAssertionRoundTrip(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	cred := register(t, a)
+	if !bytes.Equal(cred.ID, a.credID) {
+		t.Fatalf("credential id = %q, want %q", cred.ID, a.credID)
+	}
+	challenge, _ := NewChallenge()
+	cdj := clientData("webauthn.get", challenge, testOrigin)
+	ad, sig := a.get(t, testRPID, FlagUserPresent|FlagUserVerified, cdj)
+	got, err := VerifyAssertion(testRPID, testOrigin, challenge, cred.PublicKey, cdj, ad, sig, true)
+	if err != nil {
+		t.Fatalf("VerifyAssertion: %v", err)
+	}
+	if got.SignCount != 1 || !SignCountValid(cred.SignCount, got.SignCount) {
+		t.Fatalf("sign count = %d", got.SignCount)
+	}
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	challenge, _ := NewChallenge()
+	tests := []struct {
+		name      string
+		clientDat []byte
+		attObj    []byte
+		requireUV bool
+		want      string
+	}{
+		{"bad origin", clientData("webauthn.create", challenge, "https://evil.example.com"), a.create(testRPID, FlagUserPresent), false, "origin mismatch"},
+		{"bad challenge", clientData("webauthn.create", "other", testOrigin), a.create(testRPID, FlagUserPresent), false, "challenge mismatch"},
+		{"wrong type", clientData("webauthn.get", challenge, testOrigin), a.create(testRPID, FlagUserPresent), false, "client data type"},
+		{"bad rp id hash", clientData("webauthn.create", challenge, testOrigin), a.create("evil.example.com", FlagUserPresent), false, "rp id hash mismatch"},
+		{"user not present", clientData("webauthn.create", challenge, testOrigin), a.create(testRPID, 0), false, "user not present"},
+		{"user not verified", clientData("webauthn.create", challenge, testOrigin), a.create(testRPID, FlagUserPresent), true, "user not verified"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := VerifyRegistration(testRPID, testOrigin, challenge, tt.clientDat, tt.attObj, tt.requireUV)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssertionRejected(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	cred := register(t, a)
+	challenge, _ := NewChallenge()
+	cdj := clientData("webauthn.get", challenge, testOrigin)
+
+	t.Run("bad origin", func(t *testing.T) {
+		evil := clientData("webauthn.get", challenge, "https://evil.example.com")
+		ad, sig := a.get(t, testRPID, FlagUserPresent, evil)
+		_, err := VerifyAssertion(testRPID, testOrigin, challenge, cred.PublicKey, evil, ad, sig, false)
+		if err == nil || !strings.Contains(err.Error(), "origin mismatch") {
+			t.Fatalf("err = %v", err)
+		}
+	})
+	t.Run("bad rp id hash", func(t *testing.T) {
+		ad, sig := a.get(t, "evil.example.com", FlagUserPresent, cdj)
+		_, err := VerifyAssertion(testRPID, testOrigin, challenge, cred.PublicKey, cdj, ad, sig, false)
+		if err == nil || !strings.Contains(err.Error(), "rp id hash mismatch") {
+			t.Fatalf("err = %v", err)
+		}
+	})
+	t.Run("user not present", func(t *testing.T) {
+		ad, sig := a.get(t, testRPID, 0, cdj)
+		_, err := VerifyAssertion(testRPID, testOrigin, challenge, cred.PublicKey, cdj, ad, sig, false)
+		if err == nil || !strings.Contains(err.Error(), "user not present") {
+			t.Fatalf("err = %v", err)
+		}
+	})
+	t.Run("tampered authenticator data", func(t *testing.T) {
+		ad, sig := a.get(t, testRPID, FlagUserPresent, cdj)
+		ad[36]++ // 改动签名计数
+		_, err := VerifyAssertion(testRPID, testOrigin, challenge, cred.PublicKey, cdj, ad, sig, false)
+		if err == nil || !strings.Contains(err.Error(), "bad signature") {
+			t.Fatalf("err = %v", err)
+		}
+	})
+	t.Run("other key", func(t *testing.T) {
+		other := newSoftAuthenticator(t)
+		ad, sig := other.get(t, testRPID, FlagUserPresent, cdj)
+		_, err := VerifyAssertion(testRPID, testOrigin, challenge, cred.PublicKey, cdj, ad, sig, false)
+		if err == nil || !strings.Contains(err.Error(), "bad signature") {
+			t.Fatalf("err = %v", err)
+		}
+	})
+}
+
+func TestSignCountValid(t *testing.T) {
+	tests := []struct {
+		stored, received uint32
+		want             bool
+	}{
+		{0, 0, true}, // 认证器不支持计数
+		{0, 1, true},
+		{5, 6, true},
+		{5, 5, false}, // 没有增长，可能被克隆
+		{5, 3, false},
+		{5, 0, false},
+	}
+	for _, tt := range tests {
+		if got := SignCountValid(tt.stored, tt.received); got != tt.want {
+			t.Errorf("SignCountValid(%d, %d) = %v, want %v", tt.stored, tt.received, got, tt.want)
+		}
+	}
+}
+
+func TestCborDecode(t *testing.T) {
+	v, rest, err := cborDecode(cborEncode(map[int]any{1: 2, -7: []byte("x"), 3: "text"}))
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("decode: %v, rest %d", err, len(rest))
+	}
+	m := v.(map[any]any)
+	if m[int64(1)] != int64(2) || m[int64(3)] != "text" || !bytes.Equal(m[int64(-7)].([]byte), []byte("x")) {
+		t.Fatalf("decoded %#v", m)
+	}
+
+	nested := make([]byte, 0, cborMaxDepth+2)
+	for i := 0; i < cborMaxDepth+2; i++ {
+		nested = append(nested, 0x81) // 长度为 1 的数组
+	}
+	nested = append(nested, 0x00)
+	for name, b := range map[string][]byte{
+		"truncated":         cborEncode([]byte("abcdef"))[:4],
+		"indefinite length": {0x5f, 0x41, 0x00, 0xff},
+		"too deep":          nested,
+		"empty":             {},
+	} {
+		if _, _, err := cborDecode(b); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"webmark/storage"
+
+	"golang.org/x/net/webdav"
+)
+
+// WebDAV 挂载，仅本地存储
+var WebDAVEnabled = false
+
+// WebDAV 路径前缀
+const davPrefix = "/wmapi/dav"
+
+// 每个用户一个锁管理器，同一用户的多个客户端共享
+var davLocks sync.Map
+
+// 用户目录映射为 WebDAV 根目录：分组为文件夹，文档为 .md 文件
+// 修改后与网页端一样登记分组、刷新索引并提交版本库
+type davFS struct {
+	username string
+	dir      webdav.Dir
+}
+
+func newDavFS(username string) *davFS {
+	return &davFS{username: username, dir: webdav.Dir(filepath.Join(Store.(*storage.Local).Root, username))}
+}
+
+// 路径拆分为 分组/文档，根目录为空
+func davParts(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// 版本库对 WebDAV 不可见
+func davHidden(parts []string) bool {
+	for _, p := range parts {
+		if p == ".git" || p == ".gitignore" {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否为文档，分组下的 .md 文件
+func davDoc(parts []string) (group, title string, ok bool) {
+	if len(parts) != 2 || ignored(parts[0]) || ignored(parts[1]) || !strings.HasSuffix(parts[1], ".md") {
+		return "", "", false
+	}
+	return parts[0], strings.TrimSuffix(parts[1], ".md"), true
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	parts := davParts(name)
+	if len(parts) == 0 || davHidden(parts) {
+		return os.ErrPermission
+	}
+	if err := d.dir.Mkdir(ctx, name, perm); err != nil {
+		return err
+	}
+	if len(parts) == 1 && !ignored(parts[0]) {
+		group_check(d.username, parts[0])
+	}
+	return nil
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	parts := davParts(name)
+	if davHidden(parts) {
+		return nil, os.ErrNotExist
+	}
+	var write = flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	if write && len(parts) < 2 {
+		// 根目录下只能是分组
+		return nil, os.ErrPermission
+	}
+	f, err := d.dir.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	var df = &davFile{File: f}
+	if write {
+		df.onClose = func() { d.changed(parts, "webdav put "+path.Join(parts...)) }
+	}
+	return df, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	parts := davParts(name)
+	if len(parts) == 0 || davHidden(parts) {
+		return os.ErrPermission
+	}
+	if err := d.dir.RemoveAll(ctx, name); err != nil {
+		return err
+	}
+	d.removed(parts)
+	gitCommit(d.username, "webdav delete "+path.Join(parts...))
+	return nil
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldParts, newParts := davParts(oldName), davParts(newName)
+	if len(oldParts) == 0 || len(newParts) == 0 || davHidden(oldParts) || davHidden(newParts) {
+		return os.ErrPermission
+	}
+	fi, err := d.dir.Stat(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	if len(newParts) == 1 && !fi.IsDir() {
+		return os.ErrPermission
+	}
+	if err := d.dir.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	d.removed(oldParts)
+	d.changed(newParts, "webdav move "+path.Join(oldParts...)+" -> "+path.Join(newParts...))
+	return nil
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if davHidden(davParts(name)) {
+		return nil, os.ErrNotExist
+	}
+	return d.dir.Stat(ctx, name)
+}
+
+// 新建、修改或移入后刷新索引并提交
+func (d *davFS) changed(parts []string, message string) {
+	if len(parts) == 1 && !ignored(parts[0]) {
+		indexGroupFiles(d.username, parts[0])
+	} else if group, title, ok := davDoc(parts); ok {
+		indexDocFile(d.username, group, title)
+	}
+	gitCommit(d.username, message)
+}
+
+// 删除或移出后清理索引
+func (d *davFS) removed(parts []string) {
+	if len(parts) == 1 && !ignored(parts[0]) {
+		if err := GDB.Docs.DeleteGroup(d.username, parts[0]); err != nil {
+			slog.Error("webdav delete group failed", "err", err)
+		}
+	} else if group, title, ok := davDoc(parts); ok {
+		DeleteIndex(d.username, group, title)
+	}
+}
+
+// 关闭时回调，并在目录列表中隐藏版本库
+type davFile struct {
+	webdav.File
+	onClose func()
+}
+
+func (f *davFile) Close() error {
+	err := f.File.Close()
+	if err == nil && f.onClose != nil {
+		f.onClose()
+	}
+	return err
+}
+
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	items, err := f.File.Readdir(count)
+	var res = items[:0]
+	for _, fi := range items {
+		if !davHidden([]string{fi.Name()}) {
+			res = append(res, fi)
+		}
+	}
+	return res, err
+}
+
+// 只读的 WebDAV 方法
+func davReadOnly(m string) bool {
+	return m == "GET" || m == "HEAD" || m == "OPTIONS" || m == "PROPFIND"
+}
+
+// WebDAV，使用登录密码或访问令牌(Basic 认证)
+// /wmapi/dav/...
+func webdav_handler(w http.ResponseWriter, r *http.Request) {
+	if !WebDAVEnabled {
+		http.NotFound(w, r)
+		return
+	}
+	username, ok := basicAuth(w, r)
+	if !ok {
+		return
+	}
+	user_check(username)
+	ls, _ := davLocks.LoadOrStore(username, webdav.NewMemLS())
+	handler := &webdav.Handler{
+		Prefix:     basePath(davPrefix),
+		FileSystem: newDavFS(username),
+		LockSystem: ls.(webdav.LockSystem),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsNotExist(err) {
+				slog.WarnContext(r.Context(), "webdav error", "method", r.Method, "path", r.URL.Path, "err", err)
+			}
+		},
+	}
+	// 生成的链接与 Destination 请求头都带有挂载路径
+	r.URL.Path = basePath(r.URL.Path)
+	if davReadOnly(r.Method) {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	// 与备份互斥，保证备份时数据库与文件一致
+	snapshotLock.RLock()
+	defer snapshotLock.RUnlock()
+	handler.ServeHTTP(w, r)
+}
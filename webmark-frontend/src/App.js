@@ -3,6 +3,7 @@ import { Layout, Input, Button, Typography } from 'antd';
 import Cookies from 'js-cookie'; // 用于操作 cookie
 
 import { useNavigate, BrowserRouter, Route, Routes } from 'react-router-dom';
+import { BASE } from './base';
 
 const { Content } = Layout;
 const { Title } = Typography;
@@ -15,8 +16,11 @@ const PublicDocViewer = lazy(() => import('./PublicDocViewer'));
 // 登录页面组件
 const LoginPage = () => {
     const navigate = useNavigate();
-    const token = Cookies.get('session_id'); // 检查 cookie
+    const token = Cookies.get('username'); // 检查 cookie，session_id 为 HttpOnly 无法读取
     const [user, setUser] = useState({});
+    // 两步验证票据，单点登录回调时通过 #ticket= 带回
+    const [ticket, setTicket] = useState(() => new URLSearchParams(window.location.hash.slice(1)).get('ticket') || '');
+    const [code, setCode] = useState('');
 
     // 登录逻辑
     const handleLogin = () => {
@@ -27,12 +31,34 @@ const LoginPage = () => {
                 'Content-Type': 'application/json'
             },
             body: JSON.stringify(user)
+        })
+            .then(response => response.json())
+            .then(d => {
+                if (d.ok && d.data && d.data.totp) {
+                    setTicket(d.data.ticket);
+                } else if (d.ok) {
+                    navigate('/user-main');
+                } else {
+                    alert(d.msg);
+                }
+            });
+    };
+
+    // 两步验证
+    const handleTotp = () => {
+        fetch('/wmapi/totp-login', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ ticket, code })
         })
             .then(response => response.json())
             .then(d => {
                 if (d.ok) {
                     navigate('/user-main');
                 } else {
+                    setCode('');
                     alert(d.msg);
                 }
             });
@@ -61,6 +87,18 @@ const LoginPage = () => {
                             <Title level={3} style={{ textAlign: 'center' }}>
                                 用户登录
                             </Title>
+                            {ticket ? <>
+                            <Input
+                                placeholder="请输入验证码或恢复码"
+                                value={code}
+                                onChange={(e) => setCode(e.target.value)}
+                                onPressEnter={handleTotp}
+                                style={{ marginBottom: '15px' }}
+                            />
+                            <Button type="primary" block onClick={handleTotp}>
+                                验证
+                            </Button>
+                            </> : <>
                             <Input
                                 placeholder="请输入用户名"
                                 value={user.username}
@@ -82,6 +120,7 @@ const LoginPage = () => {
                             <Button type="primary" block onClick={handleLogin}>
                                 登录
                             </Button>
+                            </>}
                         </div>
                     </Content>
                 </Layout>}
@@ -114,7 +153,7 @@ const PublicDocViewerWrapper = ({ onBack }) => {
 // 路由入口组件，处理路由逻辑
 const AppContent = () => {
     const navigate = useNavigate();
-    const token = Cookies.get('session_id');
+    const token = Cookies.get('username');
 
     const handleViewDoc = (doc) => {
         navigate(`/public-doc?username=${doc.username}&groupname=${doc.groupname}&title=${doc.title}`);
@@ -150,7 +189,7 @@ const AppContent = () => {
 
 // 主应用组件
 const App = () => {
-    return (<BrowserRouter>
+    return (<BrowserRouter basename={BASE || '/'}>
         <AppContent />
     </BrowserRouter>)
 };
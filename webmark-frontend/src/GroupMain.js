@@ -13,6 +13,7 @@ import {
 } from '@ant-design/icons';
 
 import { useSearchParams } from 'react-router-dom';
+import Cookies from 'js-cookie';
 
 import math from '@bytemd/plugin-math';
 import mathLocale from '@bytemd/plugin-math/locales/zh_Hans.json';
@@ -34,6 +35,7 @@ import './ComMain.css';
 import { visit } from 'unist-util-visit'
 
 import CryptoJS from 'crypto-js';
+import { withBase } from './base';
 import './GroupMain.css';
 
 const headerStyle = {
@@ -101,7 +103,7 @@ const imagePrefix = (groupname) => {
             processor.use(() => (tree) => {
                 visit(tree, ['image', 'link'], (node) => {
                     if (typeof node.url === 'string' && !node.url.startsWith('http')) {
-                        node.url = `/wmapi/markdown/${groupname}/${node.url.replace(/^\/+/, '')}`;
+                        node.url = withBase(`/wmapi/markdown/${groupname}/${node.url.replace(/^\/+/, '')}`);
                     }
                 });
             }),
@@ -273,7 +275,8 @@ const GroupMain = () => {
                     console.log('上传取消');
                 });
                 // 发送请求
-                xhr.open('POST', `/wmapi/upload/${groupname}/${mdname}`);
+                xhr.open('POST', withBase(`/wmapi/upload/${groupname}/${mdname}`));
+                xhr.setRequestHeader('X-CSRF-Token', Cookies.get('csrf_token') || '');
                 xhr.send(formData);
             }),
         }),
@@ -516,7 +519,7 @@ const GroupMain = () => {
         })
             .then(response => response.text())
             .then(d => {
-                window.location.href = "/";
+                window.location.href = withBase("/");
             });
     };
     const encrypt = () => {
@@ -645,7 +648,7 @@ const GroupMain = () => {
                     <Space>
                         {groupname}
                         <Button icon={<HomeOutlined />} onClick={() => {
-                            window.location.href = "/";
+                            window.location.href = withBase("/");
                         }}>首页</Button>
                         <Space.Compact style={{ width: '100%' }}>
                             <Input onKeyDown={(k) => {
@@ -659,7 +662,7 @@ const GroupMain = () => {
                             setIsNewMarkdownModalOpen(true);
                         }}>新建文档</Button>
                         <Button icon={<ExportOutlined />} onClick={() => {
-                            window.open(`/wmapi/export/${groupname}`);
+                            window.open(withBase(`/wmapi/export/${groupname}`));
                         }}>导出分组</Button>
                         <Popconfirm
                             title="删除分组"
@@ -742,7 +745,7 @@ const GroupMain = () => {
                                                         setIsCryptoModalOpen(true);
                                                     }}>加解密</Button>
                                                     <Button icon={<ExportOutlined />} onClick={() => {
-                                                        window.open(`/wmapi/export/${groupname}/${mdname}`);
+                                                        window.open(withBase(`/wmapi/export/${groupname}/${mdname}`));
                                                     }}>导出</Button>
 
                                                     <Popconfirm
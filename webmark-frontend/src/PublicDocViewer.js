@@ -13,6 +13,7 @@ import 'katex/dist/katex.css';
 import mermaid from '@bytemd/plugin-mermaid';
 import mermaidLocale from '@bytemd/plugin-mermaid/locales/zh_Hans.json';
 import { visit } from 'unist-util-visit';
+import { withBase } from './base';
 
 import {
     ArrowLeftOutlined,
@@ -28,7 +29,7 @@ const publicImagePrefix = (groupname, username) => {
             processor.use(() => (tree) => {
                 visit(tree, ['image', 'link'], (node) => {
                     if (typeof node.url === 'string' && !node.url.startsWith('http')) {
-                        node.url = `/wmapi/public-markdown/${groupname}/${node.url.replace(/^\/+/, '')}`;
+                        node.url = withBase(`/wmapi/public-markdown/${groupname}/${node.url.replace(/^\/+/, '')}`);
                     }
                 });
             }),
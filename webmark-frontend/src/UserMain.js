@@ -12,6 +12,7 @@ import {
 import './ComMain.css';
 import { useNavigate } from 'react-router-dom';
 import Cookies from 'js-cookie';
+import { withBase } from './base';
 
 const { Header, Content } = Layout;
 
@@ -62,7 +63,7 @@ const UserMain = () => {
 
     const updateIndex = () => {
         fetch('/wmapi/update-index', {
-            method: 'GET',
+            method: 'POST',
         })
             .then(response => response.json())
             .then(d => {
@@ -135,7 +136,7 @@ const UserMain = () => {
     }
     const logout = () => {
         fetch('/wmapi/logout', {
-            method: 'GET'
+            method: 'POST'
         })
             .then(response => response.json())
             .then(d => {
@@ -274,7 +275,7 @@ const UserMain = () => {
                             setIsNewGroupModalOpen(true);
                         }}>新建分组</Button>
                         <Button icon={<ExportOutlined />} onClick={() => {
-                            window.open(`/wmapi/export`);
+                            window.open(withBase(`/wmapi/export`));
                         }}>导出</Button>
                         <Button icon={<UserAddOutlined />} onClick={() => {
                             setIsNewUserModalOpen(true);
@@ -0,0 +1,5 @@
+// 挂载路径，由后端注入到首页，如 /notes，根路径时为空
+export const BASE = window.WEBMARK_BASE || '';
+
+// 以 / 开头的地址加上挂载路径
+export const withBase = (url) => (typeof url === 'string' && url.startsWith('/') ? BASE + url : url);
@@ -1,6 +1,21 @@
 import React from 'react';
 import ReactDOM from 'react-dom/client';
 import App from './App';
+import Cookies from 'js-cookie';
+import { withBase } from './base';
+
+// 接口地址加上挂载路径，修改数据的请求带上 CSRF 令牌
+const rawFetch = window.fetch;
+window.fetch = (input, init = {}) => {
+  input = withBase(input);
+  const method = (init.method || 'GET').toUpperCase();
+  if (!['GET', 'HEAD', 'OPTIONS'].includes(method)) {
+    const headers = new Headers(init.headers || {});
+    headers.set('X-CSRF-Token', Cookies.get('csrf_token') || '');
+    init = { ...init, headers };
+  }
+  return rawFetch(input, init);
+};
 
 const root = ReactDOM.createRoot(document.getElementById('root'));
 root.render(
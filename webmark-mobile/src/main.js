@@ -1,6 +1,19 @@
 import { createApp } from 'vue'
 import App from './App.vue'
 import router from './router'
+import Cookies from 'js-cookie'
+
+// 修改数据的请求带上 CSRF 令牌
+const rawFetch = window.fetch
+window.fetch = (input, init = {}) => {
+    const method = (init.method || 'GET').toUpperCase()
+    if (!['GET', 'HEAD', 'OPTIONS'].includes(method)) {
+        const headers = new Headers(init.headers || {})
+        headers.set('X-CSRF-Token', Cookies.get('csrf_token') || '')
+        init = { ...init, headers }
+    }
+    return rawFetch(input, init)
+}
 
 const app = createApp(App)
 